@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/go-timeless-api/repeatr/fmt"
+	"go.polydawn.net/repeatr/executor"
+)
+
+type (
+	// batch is the content of a batch file: a set of named steps,
+	// each of which is a formula (and its context), plus instructions for
+	// wiring the outputs of other steps into its inputs.
+	batch struct {
+		Steps map[string]batchStep
+	}
+	batchStep struct {
+		Formula api.Formula
+		Context repeatr.FormulaContext
+		Imports map[api.AbsPath]string // Input path -> "step:/output/path".
+		Options executor.JobOptions
+	}
+)
+
+var (
+	batch_AtlasEntry     = atlas.BuildEntry(batch{}).StructMap().Autogenerate().Complete()
+	batchStep_AtlasEntry = atlas.BuildEntry(batchStep{}).StructMap().Autogenerate().Complete()
+
+	atl_batch = atlas.MustBuild(
+		batch_AtlasEntry,
+		batchStep_AtlasEntry,
+		jobOptions_AtlasEntry,
+		api.Formula_AtlasEntry,
+		api.FilesetPackFilter_AtlasEntry,
+		api.FormulaAction_AtlasEntry,
+		api.FormulaUserinfo_AtlasEntry,
+		api.FormulaOutputSpec_AtlasEntry,
+		api.WareID_AtlasEntry,
+		repeatr.FormulaContext_AtlasEntry,
+	)
+)
+
+func loadBatch(batchPath string) (*batch, error) {
+	f, err := os.Open(batchPath)
+	if err != nil {
+		return nil, Errorf(repeatr.ErrUsage, "error opening batch file: %s", err)
+	}
+	defer f.Close()
+	var slot batch
+	if err := json.NewUnmarshallerAtlased(f, atl_batch).Unmarshal(&slot); err != nil {
+		return nil, Errorf(repeatr.ErrUsage, "batch file does not parse: %s", err)
+	}
+	return &slot, nil
+}
+
+// An import, parsed.
+type batchImport struct {
+	Step string
+	Path api.AbsPath
+}
+
+func parseBatchImport(s string) (batchImport, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+		return batchImport{}, Errorf(repeatr.ErrUsage, "invalid import %q: must be of the form 'step:/output/path'", s)
+	}
+	return batchImport{parts[0], api.AbsPath(parts[1])}, nil
+}
+
+/*
+	Check all the imports in the batch refer to real steps and outputs,
+	and return the step names in an order which satisfies all dependencies.
+
+	Steps with no ordering constraint between them are sorted by name,
+	so the result is deterministic.  Errors if there's a cycle.
+*/
+func orderSteps(b batch) ([]string, error) {
+	dependents := map[string][]string{}
+	blockers := map[string]int{}
+	for name, step := range b.Steps {
+		blockers[name] += 0
+		seen := map[string]bool{}
+		for inPath, str := range step.Imports {
+			imp, err := parseBatchImport(str)
+			if err != nil {
+				return nil, Errorf(repeatr.ErrUsage, "step %q: %s", name, err)
+			}
+			dep, exists := b.Steps[imp.Step]
+			if !exists {
+				return nil, Errorf(repeatr.ErrUsage, "step %q: import for %q refers to unknown step %q", name, inPath, imp.Step)
+			}
+			if _, exists := dep.Formula.Outputs[imp.Path]; !exists {
+				return nil, Errorf(repeatr.ErrUsage, "step %q: import for %q refers to %q, which is not an output of step %q", name, inPath, imp.Path, imp.Step)
+			}
+			if _, exists := dep.Context.SaveUrls[imp.Path]; !exists {
+				return nil, Errorf(repeatr.ErrUsage, "step %q: import for %q refers to %q, but step %q does not save that output anywhere it can be fetched from", name, inPath, imp.Path, imp.Step)
+			}
+			if seen[imp.Step] {
+				continue
+			}
+			seen[imp.Step] = true
+			dependents[imp.Step] = append(dependents[imp.Step], name)
+			blockers[name]++
+		}
+	}
+	var ready, order []string
+	for name, n := range blockers {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			blockers[dependent]--
+			if blockers[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(order) != len(b.Steps) {
+		var stuck []string
+		for name, n := range blockers {
+			if n > 0 {
+				stuck = append(stuck, name)
+			}
+		}
+		sort.Strings(stuck)
+		return nil, Errorf(repeatr.ErrUsage, "batch has a dependency cycle among steps %s", strings.Join(stuck, ", "))
+	}
+	return order, nil
+}
+
+/*
+	Fill in a step's imported inputs with the results of the steps they
+	came from, and add the warehouses those results were saved to as
+	fetch urls.
+
+	All the steps it imports from must already have results.
+*/
+func resolveImports(b batch, name string, results map[string]*api.FormulaRunRecord) (api.Formula, repeatr.FormulaContext) {
+	step := b.Steps[name]
+	frm := step.Formula.Clone()
+	frmCtx := repeatr.FormulaContext{
+		FetchUrls: map[api.AbsPath][]api.WarehouseLocation{},
+		SaveUrls:  step.Context.SaveUrls,
+	}
+	for k, v := range step.Context.FetchUrls {
+		frmCtx.FetchUrls[k] = v
+	}
+	if frm.Inputs == nil {
+		frm.Inputs = map[api.AbsPath]api.WareID{}
+	}
+	for inPath, str := range step.Imports {
+		imp, _ := parseBatchImport(str) // already validated by orderSteps.
+		frm.Inputs[inPath] = results[imp.Step].Results[imp.Path]
+		frmCtx.FetchUrls[inPath] = append(
+			[]api.WarehouseLocation{b.Steps[imp.Step].Context.SaveUrls[imp.Path]},
+			frmCtx.FetchUrls[inPath]...,
+		)
+	}
+	return frm, frmCtx
+}
+
+func BatchCmd(
+	ctx context.Context,
+	executorName string,
+	execCfg executor.Config,
+	batchPath string,
+	parallelism int,
+	printer repeatrfmt.Printer,
+	layers runLayers,
+) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+
+	// Load batch and plan order of execution.
+	b, err := loadBatch(batchPath)
+	if err != nil {
+		return err
+	}
+	order, err := orderSteps(*b)
+	if err != nil {
+		return err
+	}
+	if parallelism < 1 {
+		return Errorf(repeatr.ErrUsage, "parallelism must be at least 1")
+	}
+
+	// Launch a worker for every step, each of which waits for the steps
+	//  it depends on, then for a slot in the semaphore.
+	//  Workers are launched in dependency order, so every step's
+	//  dependencies have their 'done' channels already made.
+	var (
+		mu       sync.Mutex // Guards results, errs, and skipped.
+		results  = map[string]*api.FormulaRunRecord{}
+		errs     = map[string]error{}
+		skipped  = map[string]string{} // Step -> the dependency which failed.
+		done     = map[string]chan struct{}{}
+		sem      = make(chan struct{}, parallelism)
+		wg       sync.WaitGroup
+		printMu  sync.Mutex
+		firstErr string
+	)
+	for _, name := range order {
+		name := name
+		done[name] = make(chan struct{})
+		var deps []chan struct{}
+		var depNames []string
+		for _, str := range b.Steps[name].Imports {
+			imp, _ := parseBatchImport(str)
+			deps = append(deps, done[imp.Step])
+			depNames = append(depNames, imp.Step)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[name])
+			for _, dep := range deps {
+				<-dep
+			}
+			mu.Lock()
+			for _, depName := range depNames {
+				if errs[depName] != nil || results[depName] == nil || results[depName].ExitCode != 0 {
+					skipped[name] = depName
+					mu.Unlock()
+					return
+				}
+			}
+			frm, frmCtx := resolveImports(*b, name, results)
+			mu.Unlock()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			stepCfg := execCfg
+			stepCfg.Job = b.Steps[name].Options
+			rr, err := Run(ctx, executorName, stepCfg, frm, frmCtx,
+				stepPrinter{name, printer, &printMu},
+				layers,
+			)
+			mu.Lock()
+			results[name], errs[name] = rr, err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Report each step's outcome, then the aggregate result.
+	//  As with `run`, a step exiting non-zero is its own business, and
+	//  shows in the results; only steps which couldn't run are errors.
+	for _, name := range order {
+		switch {
+		case skipped[name] != "":
+			printer.PrintLog(repeatr.Event_Log{
+				Time:  time.Now(),
+				Level: repeatr.LogWarn,
+				Msg:   fmt.Sprintf("step %q not run: dependency %q failed", name, skipped[name]),
+				Detail: [][2]string{
+					{"step", name},
+					{"dependency", skipped[name]},
+				},
+			})
+		case errs[name] != nil:
+			if firstErr == "" {
+				firstErr = name
+			}
+			printer.PrintLog(repeatr.Event_Log{
+				Time:  time.Now(),
+				Level: repeatr.LogError,
+				Msg:   fmt.Sprintf("step %q failed: %s", name, errs[name]),
+				Detail: [][2]string{
+					{"step", name},
+					{"error", errs[name].Error()},
+				},
+			})
+		case results[name].ExitCode != 0:
+			printer.PrintLog(repeatr.Event_Log{
+				Time:  time.Now(),
+				Level: repeatr.LogWarn,
+				Msg:   fmt.Sprintf("step %q exited with code %d", name, results[name].ExitCode),
+				Detail: [][2]string{
+					{"step", name},
+				},
+			})
+		}
+	}
+	for name, rr := range results {
+		if rr == nil {
+			delete(results, name)
+		}
+	}
+	printBatchResult(printer, results)
+	if firstErr != "" {
+		err := errs[firstErr]
+		return Errorf(Category(err), "step %q failed: %s", firstErr, err)
+	}
+	return nil
+}
+
+// Wraps a printer to label log and output events with the step name,
+// and serialize them (steps run in parallel).
+// Results are dropped; the batch emits its own aggregate result at the end.
+type stepPrinter struct {
+	name    string
+	printer repeatrfmt.Printer
+	mu      *sync.Mutex
+}
+
+func (p stepPrinter) PrintLog(evt repeatr.Event_Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	evt.Msg = "[" + p.name + "] " + evt.Msg
+	p.printer.PrintLog(evt)
+}
+func (p stepPrinter) PrintOutput(evt repeatr.Event_Output) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	evt.Msg = "[" + p.name + "] " + evt.Msg
+	p.printer.PrintOutput(evt)
+}
+func (p stepPrinter) PrintStreamOutput(evt executor.Event_StreamOutput) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	evt.Msg = "[" + p.name + "] " + evt.Msg
+	printOutput(p.printer, evt)
+}
+func (p stepPrinter) PrintProgress(evt executor.Event_Progress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	evt.Msg = "[" + p.name + "] " + evt.Msg
+	printProgress(p.printer, evt)
+}
+func (p stepPrinter) PrintResult(repeatr.Event_Result) {}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestOrderSteps(t *testing.T) {
+	producer := func() batchStep {
+		return batchStep{
+			Formula: api.Formula{Outputs: map[api.AbsPath]api.FormulaOutputSpec{"/out": {}}},
+			Context: repeatr.FormulaContext{SaveUrls: map[api.AbsPath]api.WarehouseLocation{"/out": "ca+file://./wares/"}},
+		}
+	}
+	consumer := func(imports ...string) batchStep {
+		step := producer()
+		step.Imports = map[api.AbsPath]string{}
+		for i, imp := range imports {
+			step.Imports[api.AbsPath("/in"+string('a'+rune(i)))] = imp
+		}
+		return step
+	}
+	t.Run("independent steps sort by name", func(t *testing.T) {
+		order, err := orderSteps(batch{map[string]batchStep{
+			"c": producer(),
+			"a": producer(),
+			"b": producer(),
+		}})
+		WantNoError(t, err)
+		WantEqual(t, order, []string{"a", "b", "c"})
+	})
+	t.Run("dependencies come first", func(t *testing.T) {
+		order, err := orderSteps(batch{map[string]batchStep{
+			"a": consumer("c:/out", "b:/out"),
+			"b": consumer("d:/out"),
+			"c": producer(),
+			"d": producer(),
+		}})
+		WantNoError(t, err)
+		WantEqual(t, order, []string{"c", "d", "b", "a"})
+	})
+	t.Run("cycles are rejected", func(t *testing.T) {
+		_, err := orderSteps(batch{map[string]batchStep{
+			"a": consumer("b:/out"),
+			"b": consumer("a:/out"),
+			"c": producer(),
+		}})
+		WantEqual(t, Category(err), repeatr.ErrUsage)
+	})
+	t.Run("bad imports are rejected", func(t *testing.T) {
+		for _, imp := range []string{
+			"nope:/out",
+			"b:/nope",
+			"b",
+			"b:out",
+		} {
+			_, err := orderSteps(batch{map[string]batchStep{
+				"a": consumer(imp),
+				"b": producer(),
+			}})
+			WantEqual(t, Category(err), repeatr.ErrUsage)
+		}
+	})
+}
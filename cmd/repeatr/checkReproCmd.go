@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/go-timeless-api/repeatr/fmt"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/rio/client/exec"
+	"go.polydawn.net/repeatr/executor"
+)
+
+/*
+	Run a formula several times -- cycling through the given executors --
+	and check every run got the same exit code and results.
+
+	Memoization is never used (it would rather defeat the point).
+
+	If keepDir is set, outputs which diverge are unpacked into it, as
+	`<keepDir>/<output_path>/run<N>` (slashes in the output path
+	becoming underscores), ready to diff.  Outputs without a
+	save URL in the formula context are saved to a warehouse in keepDir
+	so that this is possible.
+
+	Returns ErrJobInvalid if the runs didn't all agree.
+*/
+func CheckReproCmd(
+	ctx context.Context,
+	executorNames []string,
+	execCfg executor.Config,
+	formulaPath string,
+	runs int,
+	keepDir string,
+	printer repeatrfmt.Printer,
+	format format,
+	stdout io.Writer,
+) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+
+	if runs < 2 {
+		return Errorf(repeatr.ErrUsage, "need at least 2 runs to compare")
+	}
+	if len(executorNames) == 0 {
+		return Errorf(repeatr.ErrUsage, "need at least one executor")
+	}
+	frmPlus, err := loadFormula(formulaPath)
+	if err != nil {
+		return err
+	}
+	execCfg.Job = frmPlus.Options
+	frmCtx := frmPlus.Context
+	if keepDir != "" {
+		keepDir, err = filepath.Abs(keepDir)
+		if err != nil {
+			return Errorf(repeatr.ErrUsage, "invalid keep dir: %s", err)
+		}
+		frmCtx = withDefaultSaveUrls(frmPlus.Formula, frmCtx, api.WarehouseLocation("ca+file://"+filepath.Join(keepDir, ".warehouse")))
+	}
+
+	// Run them all.  One at a time: they'd only compete, otherwise.
+	results := make([]checkReproRun, runs)
+	printMu := sync.Mutex{}
+	for i := range results {
+		results[i].Executor = executorNames[i%len(executorNames)]
+		rr, err := Run(ctx, results[i].Executor, execCfg, frmPlus.Formula, frmCtx,
+			stepPrinter{fmt.Sprintf("run %d", i+1), printer, &printMu},
+			runLayers{},
+		)
+		if err != nil {
+			return err
+		}
+		results[i].RunRecord = rr
+	}
+
+	// Compare, and report.
+	report := checkReproReport{Runs: results}
+	rrs := make([]*api.FormulaRunRecord, runs)
+	for i, run := range results {
+		rrs[i] = run.RunRecord
+	}
+	report.Diverged, report.ExitCodesDiffer = compareRuns(rrs)
+	if keepDir != "" {
+		for _, pth := range report.Diverged {
+			if err := unpackDiverged(ctx, keepDir, pth, rrs, frmCtx.SaveUrls[pth]); err != nil {
+				return err
+			}
+		}
+	}
+	switch format {
+	case format_Json:
+		emitJson(stdout, atl_checkReproReport, report)
+	default:
+		for i, run := range results {
+			fmt.Fprintf(stdout, "run %d (%s): exit %d, %s\n", i+1, run.Executor, run.RunRecord.ExitCode, formatResults(run.RunRecord.Results))
+		}
+		if report.ExitCodesDiffer {
+			fmt.Fprintf(stdout, "exit codes differ\n")
+		}
+		for _, pth := range report.Diverged {
+			fmt.Fprintf(stdout, "diverged: %s\n", pth)
+		}
+		if len(report.Diverged) == 0 && !report.ExitCodesDiffer {
+			fmt.Fprintf(stdout, "all %d runs agree\n", runs)
+		}
+	}
+	if len(report.Diverged) > 0 || report.ExitCodesDiffer {
+		return Errorf(repeatr.ErrJobInvalid, "formula is not reproducible: runs diverged")
+	}
+	return nil
+}
+
+type checkReproRun struct {
+	Executor  string
+	RunRecord *api.FormulaRunRecord
+}
+
+type checkReproReport struct {
+	Runs            []checkReproRun
+	Diverged        []api.AbsPath
+	ExitCodesDiffer bool
+}
+
+var atl_checkReproReport = atlas.MustBuild(
+	atlas.BuildEntry(checkReproRun{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(checkReproReport{}).StructMap().Autogenerate().Complete(),
+	api.FormulaRunRecord_AtlasEntry,
+	api.WareID_AtlasEntry,
+)
+
+/*
+	Compare the run records of several runs of a formula.
+	Returns the output paths whose results weren't all the same
+	(including if some runs lack them), sorted, and whether the
+	exit codes differed.
+*/
+func compareRuns(rrs []*api.FormulaRunRecord) (diverged []api.AbsPath, exitCodesDiffer bool) {
+	paths := map[api.AbsPath]struct{}{}
+	for _, rr := range rrs {
+		for pth := range rr.Results {
+			paths[pth] = struct{}{}
+		}
+		if rr.ExitCode != rrs[0].ExitCode {
+			exitCodesDiffer = true
+		}
+	}
+	for pth := range paths {
+		want, ok := rrs[0].Results[pth]
+		for _, rr := range rrs[1:] {
+			got, ok2 := rr.Results[pth]
+			if ok != ok2 || got != want {
+				diverged = append(diverged, pth)
+				break
+			}
+		}
+	}
+	sort.Slice(diverged, func(i, j int) bool { return diverged[i] < diverged[j] })
+	return
+}
+
+// Fill in a save URL for each of the formula's outputs that don't have one.
+func withDefaultSaveUrls(frm api.Formula, frmCtx repeatr.FormulaContext, warehouse api.WarehouseLocation) repeatr.FormulaContext {
+	saveUrls := map[api.AbsPath]api.WarehouseLocation{}
+	for pth, url := range frmCtx.SaveUrls {
+		saveUrls[pth] = url
+	}
+	for pth := range frm.Outputs {
+		if _, ok := saveUrls[pth]; !ok {
+			saveUrls[pth] = warehouse
+		}
+	}
+	frmCtx.SaveUrls = saveUrls
+	return frmCtx
+}
+
+// Unpack each run's result for a diverged output path into keepDir,
+//  so they can be diffed.
+func unpackDiverged(ctx context.Context, keepDir string, pth api.AbsPath, rrs []*api.FormulaRunRecord, warehouse api.WarehouseLocation) error {
+	var unpackTool rio.UnpackFunc = rioclient.UnpackFunc
+	dirName := strings.Replace(strings.Trim(string(pth), "/"), "/", "_", -1)
+	if dirName == "" {
+		dirName = "_root"
+	}
+	for i, rr := range rrs {
+		wareID, ok := rr.Results[pth]
+		if !ok {
+			continue
+		}
+		dest := filepath.Join(keepDir, dirName, fmt.Sprintf("run%d", i+1))
+		_, err := unpackTool(ctx, wareID, dest,
+			api.FilesetUnpackFilter_LowPriv,
+			rio.Placement_Direct,
+			[]api.WarehouseLocation{warehouse},
+			rio.Monitor{},
+		)
+		if err != nil {
+			return Errorf(repeatr.ErrWarehouseUnavailable, "could not unpack result %s of run %d: %s", pth, i+1, err)
+		}
+	}
+	return nil
+}
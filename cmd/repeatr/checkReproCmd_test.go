@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestCompareRuns(t *testing.T) {
+	rr := func(exitCode int, results map[api.AbsPath]api.WareID) *api.FormulaRunRecord {
+		return &api.FormulaRunRecord{ExitCode: exitCode, Results: results}
+	}
+	t.Run("identical runs agree", func(t *testing.T) {
+		diverged, exitCodesDiffer := compareRuns([]*api.FormulaRunRecord{
+			rr(0, map[api.AbsPath]api.WareID{"/out": {"tar", "a"}}),
+			rr(0, map[api.AbsPath]api.WareID{"/out": {"tar", "a"}}),
+		})
+		WantEqual(t, len(diverged), 0)
+		WantEqual(t, exitCodesDiffer, false)
+	})
+	t.Run("differing and missing results diverge", func(t *testing.T) {
+		diverged, exitCodesDiffer := compareRuns([]*api.FormulaRunRecord{
+			rr(0, map[api.AbsPath]api.WareID{"/out": {"tar", "a"}, "/same": {"tar", "s"}}),
+			rr(0, map[api.AbsPath]api.WareID{"/out": {"tar", "a"}, "/same": {"tar", "s"}}),
+			rr(0, map[api.AbsPath]api.WareID{"/out": {"tar", "b"}, "/same": {"tar", "s"}, "/extra": {"tar", "x"}}),
+		})
+		WantEqual(t, diverged, []api.AbsPath{"/extra", "/out"})
+		WantEqual(t, exitCodesDiffer, false)
+	})
+	t.Run("differing exit codes are reported", func(t *testing.T) {
+		_, exitCodesDiffer := compareRuns([]*api.FormulaRunRecord{
+			rr(0, nil),
+			rr(1, nil),
+		})
+		WantEqual(t, exitCodesDiffer, true)
+	})
+}
+
+func TestWithDefaultSaveUrls(t *testing.T) {
+	frm := api.Formula{Outputs: map[api.AbsPath]api.FormulaOutputSpec{
+		"/out":  {PackType: "tar"},
+		"/kept": {PackType: "tar"},
+	}}
+	frmCtx := withDefaultSaveUrls(frm, repeatr.FormulaContext{
+		SaveUrls: map[api.AbsPath]api.WarehouseLocation{"/kept": "ca+file://elsewhere"},
+	}, "ca+file://keep/.warehouse")
+	WantEqual(t, frmCtx.SaveUrls, map[api.AbsPath]api.WarehouseLocation{
+		"/out":  "ca+file://keep/.warehouse",
+		"/kept": "ca+file://elsewhere",
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	. "github.com/warpfork/go-errcat"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+)
+
+// Args for host-level executor config, shared by all commands that launch
+//  jobs.  Each flag can also be set by env var, so the operator of a host
+//  can set defaults for every job run there.
+type executorArgs struct {
+	Memory    units.Base2Bytes
+	Cpus      float64
+	CpuShares uint64
+	Pids      int64
+	Rlimits   []string
+	ShmSize   units.Base2Bytes
+
+	OutputLimit     units.Base2Bytes
+	OutputLimitKill bool
+
+	Deterministic bool
+	KeepWorkspace string
+}
+
+func declareExecutorFlags(cmd *kingpin.CmdClause, args *executorArgs) {
+	cmd.Flag("memory", "Memory limit for the job (e.g. '512MB', '4GB'); zero means unlimited").
+		Envar("REPEATR_LIMIT_MEMORY").
+		Default("0").
+		BytesVar(&args.Memory)
+	cmd.Flag("cpus", "Number of cpus the job may use (fractions allowed); zero means unlimited").
+		Envar("REPEATR_LIMIT_CPUS").
+		Default("0").
+		Float64Var(&args.Cpus)
+	cmd.Flag("cpu-shares", "Relative cpu weight of the job versus others").
+		Envar("REPEATR_LIMIT_CPU_SHARES").
+		Default("0").
+		Uint64Var(&args.CpuShares)
+	cmd.Flag("pids-limit", "Max number of processes in the job; zero means unlimited").
+		Envar("REPEATR_LIMIT_PIDS").
+		Default("0").
+		Int64Var(&args.Pids)
+	cmd.Flag("rlimit", "Set an rlimit, as 'TYPE=SOFT[:HARD]' (e.g. 'NOFILE=4096'); may be repeated").
+		Envar("REPEATR_LIMIT_RLIMITS").
+		StringsVar(&args.Rlimits)
+	cmd.Flag("shm-size", "Size of the /dev/shm tmpfs (e.g. '64MB')").
+		Envar("REPEATR_LIMIT_SHM_SIZE").
+		Default("0").
+		BytesVar(&args.ShmSize)
+	cmd.Flag("output-limit", "Max output to capture from the job, stdout and stderr together (e.g. '10MB'); zero means unlimited").
+		Envar("REPEATR_LIMIT_OUTPUT").
+		Default("0").
+		BytesVar(&args.OutputLimit)
+	cmd.Flag("output-limit-kill", "Kill the job if it exceeds the output limit, rather than dropping the rest of its output").
+		Envar("REPEATR_LIMIT_OUTPUT_KILL").
+		BoolVar(&args.OutputLimitKill)
+	cmd.Flag("deterministic", "Pin the job's view of time and hostname (sets SOURCE_DATE_EPOCH, derives the hostname from the formula, and uses a time namespace where supported)").
+		Envar("REPEATR_DETERMINISTIC").
+		BoolVar(&args.Deterministic)
+	cmd.Flag("keep-workspace", "When to keep the job's work dir, for inspection: 'never', 'on-failure', or 'always' (clean up with 'repeatr workspace prune')").
+		Envar("REPEATR_KEEP_WORKSPACE").
+		Default(string(executor.KeepWorkspace_Never)).
+		EnumVar(&args.KeepWorkspace,
+			string(executor.KeepWorkspace_Never), string(executor.KeepWorkspace_OnFailure), string(executor.KeepWorkspace_Always))
+}
+
+func (args executorArgs) config() (cfg executor.Config, err error) {
+	// Not being root means we need user namespaces to do anything.
+	//  (Executors which can't do that will refuse to run.)
+	cfg.Rootless = os.Geteuid() != 0
+	cfg.Deterministic = args.Deterministic
+	cfg.KeepWorkspace = executor.KeepWorkspace(args.KeepWorkspace)
+	cfg.Limits = executor.Limits{
+		Memory:    int64(args.Memory),
+		CpuShares: args.CpuShares,
+		Pids:      args.Pids,
+		ShmSize:   int64(args.ShmSize),
+	}
+	cfg.Output = executor.OutputLimits{
+		MaxBytes: int64(args.OutputLimit),
+		Kill:     args.OutputLimitKill,
+	}
+	if args.OutputLimit < 0 {
+		return cfg, Errorf(repeatr.ErrUsage, "invalid output limit %v: must not be negative", args.OutputLimit)
+	}
+	if args.OutputLimitKill && args.OutputLimit == 0 {
+		return cfg, Errorf(repeatr.ErrUsage, "--output-limit-kill needs an --output-limit")
+	}
+	if args.Cpus < 0 {
+		return cfg, Errorf(repeatr.ErrUsage, "invalid cpus limit %v: must not be negative", args.Cpus)
+	}
+	if args.Cpus > 0 {
+		cfg.Limits.CpuPeriod = 100000
+		cfg.Limits.CpuQuota = int64(args.Cpus * float64(cfg.Limits.CpuPeriod))
+		// The kernel won't take a quota under a millisecond per period.
+		//  (And one that rounds to zero would mean no limit at all.)
+		if cfg.Limits.CpuQuota < 1000 {
+			return cfg, Errorf(repeatr.ErrUsage, "invalid cpus limit %v: must be at least 0.01", args.Cpus)
+		}
+	}
+	for _, s := range args.Rlimits {
+		rl, err := parseRlimit(s)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Limits.Rlimits = append(cfg.Limits.Rlimits, rl)
+	}
+	return cfg, nil
+}
+
+// Parse 'TYPE=SOFT[:HARD]'.  The type may be given with or without
+//  the "RLIMIT_" prefix, in any case.  If hard is absent, it equals soft.
+func parseRlimit(s string) (rl executor.Rlimit, err error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return rl, Errorf(repeatr.ErrUsage, "invalid rlimit %q: must be of the form 'TYPE=SOFT[:HARD]'", s)
+	}
+	rl.Type = strings.ToUpper(parts[0])
+	if !strings.HasPrefix(rl.Type, "RLIMIT_") {
+		rl.Type = "RLIMIT_" + rl.Type
+	}
+	values := strings.SplitN(parts[1], ":", 2)
+	if rl.Soft, err = strconv.ParseUint(values[0], 10, 64); err != nil {
+		return rl, Errorf(repeatr.ErrUsage, "invalid rlimit %q: %s", s, err)
+	}
+	rl.Hard = rl.Soft
+	if len(values) == 2 {
+		if rl.Hard, err = strconv.ParseUint(values[1], 10, 64); err != nil {
+			return rl, Errorf(repeatr.ErrUsage, "invalid rlimit %q: %s", s, err)
+		}
+	}
+	if rl.Soft > rl.Hard {
+		return rl, Errorf(repeatr.ErrUsage, "invalid rlimit %q: soft limit exceeds hard limit", s)
+	}
+	return rl, nil
+}
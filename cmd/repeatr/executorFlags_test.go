@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestParseRlimit(t *testing.T) {
+	for _, tr := range []struct {
+		str  string
+		want executor.Rlimit
+	}{
+		{"NOFILE=4096", executor.Rlimit{"RLIMIT_NOFILE", 4096, 4096}},
+		{"nofile=1024:4096", executor.Rlimit{"RLIMIT_NOFILE", 1024, 4096}},
+		{"RLIMIT_NPROC=10", executor.Rlimit{"RLIMIT_NPROC", 10, 10}},
+	} {
+		rl, err := parseRlimit(tr.str)
+		WantNoError(t, err)
+		WantEqual(t, rl, tr.want)
+	}
+	for _, str := range []string{
+		"NOFILE",
+		"NOFILE=",
+		"NOFILE=-1",
+		"NOFILE=4096:1024",
+	} {
+		_, err := parseRlimit(str)
+		if err == nil {
+			t.Errorf("expected error parsing %q", str)
+		}
+	}
+}
+
+func TestCpusLimit(t *testing.T) {
+	cfg, err := executorArgs{Cpus: 1.5}.config()
+	WantNoError(t, err)
+	WantEqual(t, cfg.Limits.CpuQuota, int64(150000))
+	WantEqual(t, cfg.Limits.CpuPeriod, uint64(100000))
+	for _, cpus := range []float64{-1, 0.001, 1e-6} {
+		_, err := executorArgs{Cpus: cpus}.config()
+		if err == nil {
+			t.Errorf("expected error for cpus %v", cpus)
+		}
+	}
+}
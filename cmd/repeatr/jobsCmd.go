@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"text/tabwriter"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/config"
+	"go.polydawn.net/repeatr/executor/mixins"
+	"go.polydawn.net/rio/fs"
+)
+
+// The workspaces of every executor: where `ps` and `exec` look for jobs.
+func executorWorkspaceDirs() []fs.AbsolutePath {
+	dirs := make([]fs.AbsolutePath, len(executorNames))
+	for i, name := range executorNames {
+		dirs[i] = config.GetRepeatrExecutorPath(name)
+	}
+	return dirs
+}
+
+func listRunningJobs(workspaceDirs []fs.AbsolutePath) ([]mixins.RunningJob, error) {
+	jobs := []mixins.RunningJob{}
+	for _, dir := range workspaceDirs {
+		more, err := mixins.ListRunningJobs(dir)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, more...)
+	}
+	return jobs, nil
+}
+
+/*
+	List the jobs running on this host (as far as we can see: jobs in the
+	workspace of another user's rootless repeatr aren't).
+*/
+func PsCmd(workspaceDirs []fs.AbsolutePath, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	jobs, err := listRunningJobs(workspaceDirs)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case format_Json:
+		return emitJson(stdout, mixins.Atlas_RunningJob, jobs)
+	default:
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "GUID\tSETUPHASH\tEXECUTOR\tSTARTED\tPID\n")
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n",
+				job.Guid,
+				job.SetupHash,
+				job.Executor,
+				job.Started,
+				job.Pid,
+			)
+		}
+		return tw.Flush()
+	}
+}
+
+/*
+	Run a command inside a running job, for debugging: in its namespaces,
+	with its root filesystem and environment, and on our terminal if we're
+	on one.
+
+	The container runtimes (runc, runsc) have an `exec` of their own,
+	which we use; for the other executors, we enter the job's namespaces
+	as nsenter(1) does (by using it).
+
+	BEWARE: with nsenter (the ns and chroot executors), this is a
+	privileged escape hatch.  The command runs as the job's user and
+	group, but nothing else of the job's sandbox is applied: not its
+	policy's capability set, its supplementary groups, its rlimits, or
+	its cgroup.  For a job which runs as root (and isn't rootless), that
+	means the command has all of the host root's capabilities, in the
+	job's filesystem.  Only use it to debug jobs you trust.
+
+	The command's exit code isn't an error of ours: once it's running,
+	it's the user's.
+*/
+func ExecCmd(workspaceDirs []fs.AbsolutePath, guid string, command []string, stdin io.Reader, stdout, stderr io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	jobs, err := listRunningJobs(workspaceDirs)
+	if err != nil {
+		return err
+	}
+	var job *mixins.RunningJob
+	for i := range jobs {
+		if jobs[i].Guid == guid {
+			job = &jobs[i]
+			break
+		}
+	}
+	if job == nil {
+		return Errorf(repeatr.ErrUsage, "no running job %q (see `repeatr ps`)", guid)
+	}
+	if len(command) == 0 {
+		command = []string{"/bin/sh"}
+	}
+
+	var cmd *exec.Cmd
+	if job.Runtime != "" {
+		// runc needs to be asked for a terminal; runsc gives the command
+		//  ours, if stdin is one.
+		args := []string{"--root", job.StateDir, "exec"}
+		if f, ok := stdin.(*os.File); ok && openHostTerminal(f) != nil && job.Executor == "runc" {
+			args = append(args, "--tty")
+		}
+		args = append(args, job.Guid)
+		cmd = exec.Command(job.Runtime, append(args, command...)...)
+	} else {
+		nsenter, err := exec.LookPath("nsenter")
+		if err != nil {
+			return Errorf(repeatr.ErrExecutor, "cannot enter job: %s", err)
+		}
+		cmd = exec.Command(nsenter, nsenterArgs(job.Pid, job.Uid, job.Gid, command)...)
+		cmd.Env = jobEnv(job.Pid)
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil
+		}
+		return Errorf(repeatr.ErrExecutor, "cannot enter job: %s", err)
+	}
+	return nil
+}
+
+// The namespaces nsenter knows how to enter, by their names in `/proc/<pid>/ns/`.
+var nsenterFlags = []struct{ ns, flag string }{
+	{"user", "--user"},
+	{"mnt", "--mount"},
+	{"uts", "--uts"},
+	{"ipc", "--ipc"},
+	{"net", "--net"},
+	{"pid", "--pid"},
+}
+
+/*
+	Args for nsenter, to run a command in the same place as a process.
+
+	Only the namespaces the process doesn't share with us are entered:
+	which ones those are depends on the executor (and its settings; e.g.
+	the chroot executor has a net namespace only if the job doesn't use
+	the host network).  The root and working dir are always the process's.
+	The command runs as uid and gid (as seen inside the user namespace,
+	if it's entered); nsenter would otherwise leave it as us.
+*/
+func nsenterArgs(pid int, uid, gid int, command []string) []string {
+	args := []string{"--target", strconv.Itoa(pid)}
+	for _, x := range nsenterFlags {
+		theirs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, x.ns))
+		if err != nil {
+			continue
+		}
+		ours, err := os.Readlink("/proc/self/ns/" + x.ns)
+		if err != nil || theirs != ours {
+			args = append(args, x.flag)
+		}
+	}
+	args = append(args, "--setuid", strconv.Itoa(uid), "--setgid", strconv.Itoa(gid))
+	args = append(args, "--root", "--wd", "--")
+	return append(args, command...)
+}
+
+// The environment of a process, or nil (meaning ours) if we can't read it.
+func jobEnv(pid int) []string {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil || len(bs) == 0 {
+		return nil
+	}
+	var env []string
+	for _, kv := range bytes.Split(bytes.TrimRight(bs, "\x00"), []byte{0}) {
+		env = append(env, string(kv))
+	}
+	return env
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor/mixins"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+)
+
+func TestPsCmd(t *testing.T) {
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		// A live job (we stand in for it), and one whose process is gone.
+		for _, x := range []struct {
+			guid string
+			pid  int
+		}{
+			{"live", os.Getpid()},
+			{"dead", 0},
+		} {
+			AssertNoError(t, os.Mkdir(tmpDir.String()+"/"+x.guid, 0700))
+			mixins.RegisterJob(osfs.New(tmpDir.Join(fs.MustRelPath(x.guid))), mixins.RunningJob{
+				Guid:      x.guid,
+				SetupHash: "abc",
+				Executor:  "ns",
+				Pid:       x.pid,
+			}, repeatr.Monitor{})
+		}
+		buf := bytes.Buffer{}
+		AssertNoError(t, PsCmd([]fs.AbsolutePath{tmpDir, tmpDir.Join(fs.MustRelPath("nope"))}, format_Ansi, &buf))
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		WantEqual(t, len(lines), 2)
+		WantEqual(t, strings.Fields(lines[0]), []string{"GUID", "SETUPHASH", "EXECUTOR", "STARTED", "PID"})
+		fields := strings.Fields(lines[1])
+		WantEqual(t, fields[0:3], []string{"live", "abc", "ns"})
+		WantEqual(t, fields[4], strconv.Itoa(os.Getpid()))
+
+		err := ExecCmd([]fs.AbsolutePath{tmpDir}, "dead", nil, nil, nil, nil)
+		WantEqual(t, Category(err), repeatr.ErrUsage)
+	})
+}
+
+func TestNsenterArgs(t *testing.T) {
+	// We share all our namespaces with ourselves, so there's nothing to enter.
+	//  The job's user and group are always set.
+	WantEqual(t,
+		nsenterArgs(os.Getpid(), 1000, 100, []string{"ls", "-l"}),
+		[]string{"--target", strconv.Itoa(os.Getpid()), "--setuid", "1000", "--setgid", "100", "--root", "--wd", "--", "ls", "-l"},
+	)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/go-timeless-api/repeatr/fmt"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/repeatr/executor/impl/joblog"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Replay the output of a job from the log dir, by the guid of its run
+	record -- or by the setupHash of its formula, for the latest run of it.
+*/
+func LogsCmd(logDir fs.AbsolutePath, id string, printer repeatrfmt.Printer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	store := joblog.NewStore(logDir)
+	hash, err := store.Lookup(id)
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		return Errorf(repeatr.ErrUsage, "no log found for %q (give a run record guid or formula setupHash)", id)
+	}
+	return store.Replay(hash, func(evt executor.Event_StreamOutput) {
+		printOutput(printer, evt)
+	})
+}
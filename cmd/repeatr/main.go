@@ -5,23 +5,41 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
 
 	. "github.com/warpfork/go-errcat"
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/repeatr/fmt"
 	"go.polydawn.net/repeatr/config"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The first interrupt cancels the context, which executors respond to
+	//  by signalling the job and tearing down gracefully.
+	//  A second interrupt gets the default (fatal) treatment.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		signal.Stop(sigCh)
+		cancel()
+	}()
 	bhv := Main(ctx, os.Args, os.Stdin, os.Stdout, os.Stderr)
 	err := bhv.action()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 	}
 	exitCode := repeatr.ExitCodeForError(err)
+	cancel()
 	os.Exit(exitCode)
 }
 
@@ -60,35 +78,283 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io
 		argsRun := struct {
 			FormulaPath string
 			Executor    string
+			Timeout     time.Duration
+			Provenance  string
+			executorArgs
 		}{}
 		cmdRun.Arg("formula", "Path to formula file.").
 			Required().
 			StringVar(&argsRun.FormulaPath)
 		cmdRun.Flag("executor", "Select an executor system to use").
 			Default("runc").
-			EnumVar(&argsRun.Executor,
-				"runc", "gvisor", "chroot")
+			EnumVar(&argsRun.Executor, executorNames...)
+		cmdRun.Flag("timeout", "Cancel the job if it runs longer than this (e.g. '90s', '2h'); zero means no limit").
+			Default("0").
+			DurationVar(&argsRun.Timeout)
+		cmdRun.Flag("provenance", "Write an in-toto provenance statement for the run to this file").
+			StringVar(&argsRun.Provenance)
+		declareExecutorFlags(cmdRun, &argsRun.executorArgs)
 		bhvs[cmdRun.FullCommand()] = behavior{&argsRun, func() error {
-			memoDir := config.GetRepeatrMemoPath()
+			ctx := ctx
+			if argsRun.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, argsRun.Timeout)
+				defer cancel()
+			}
+			execCfg, err := argsRun.executorArgs.config()
+			if err != nil {
+				return err
+			}
+			layers, err := loadRunLayers()
+			if err != nil {
+				return err
+			}
 			printer := setupPrinter(format(baseArgs.Format), stdout, stderr)
-			return RunCmd(ctx, argsRun.Executor, argsRun.FormulaPath, printer, memoDir)
+			return RunCmd(ctx, argsRun.Executor, execCfg, argsRun.FormulaPath, printer, layers, argsRun.Provenance)
 		}}
 	}
 	{
-		cmdTwerk := app.Command("twerk", "Execute a formula *interactively*.")
+		cmdBatch := app.Command("batch", "Execute a batch of formulas, wiring outputs of some into the inputs of others.")
+		argsBatch := struct {
+			BatchPath   string
+			Executor    string
+			Parallelism int
+			executorArgs
+		}{}
+		cmdBatch.Arg("batch", "Path to batch file.").
+			Required().
+			StringVar(&argsBatch.BatchPath)
+		cmdBatch.Flag("executor", "Select an executor system to use").
+			Default("runc").
+			EnumVar(&argsBatch.Executor, executorNames...)
+		cmdBatch.Flag("parallel", "Maximum number of steps to run at once").
+			Default(strconv.Itoa(runtime.NumCPU())).
+			IntVar(&argsBatch.Parallelism)
+		declareExecutorFlags(cmdBatch, &argsBatch.executorArgs)
+		bhvs[cmdBatch.FullCommand()] = behavior{&argsBatch, func() error {
+			execCfg, err := argsBatch.executorArgs.config()
+			if err != nil {
+				return err
+			}
+			layers, err := loadRunLayers()
+			if err != nil {
+				return err
+			}
+			printer := setupPrinter(format(baseArgs.Format), stdout, stderr)
+			return BatchCmd(ctx, argsBatch.Executor, execCfg, argsBatch.BatchPath, argsBatch.Parallelism, printer, layers)
+		}}
+	}
+	{
+		cmdCheckRepro := app.Command("check-repro", "Execute a formula several times, and check the results are all the same.")
+		argsCheckRepro := struct {
+			FormulaPath   string
+			Executors     []string
+			Runs          int
+			KeepDiverging string
+			executorArgs
+		}{}
+		cmdCheckRepro.Arg("formula", "Path to formula file.").
+			Required().
+			StringVar(&argsCheckRepro.FormulaPath)
+		cmdCheckRepro.Flag("executor", "Select an executor system to use; repeat to cycle runs through several").
+			Default("runc").
+			EnumsVar(&argsCheckRepro.Executors, executorNames...)
+		cmdCheckRepro.Flag("runs", "Number of times to run the formula").
+			Default("2").
+			IntVar(&argsCheckRepro.Runs)
+		cmdCheckRepro.Flag("keep-diverging", "Unpack outputs which differ between runs into this dir, for diffing").
+			StringVar(&argsCheckRepro.KeepDiverging)
+		declareExecutorFlags(cmdCheckRepro, &argsCheckRepro.executorArgs)
+		bhvs[cmdCheckRepro.FullCommand()] = behavior{&argsCheckRepro, func() error {
+			execCfg, err := argsCheckRepro.executorArgs.config()
+			if err != nil {
+				return err
+			}
+			printer := setupPrinter(format(baseArgs.Format), stdout, stderr)
+			return CheckReproCmd(ctx, argsCheckRepro.Executors, execCfg, argsCheckRepro.FormulaPath, argsCheckRepro.Runs, argsCheckRepro.KeepDiverging, printer, format(baseArgs.Format), stdout)
+		}}
+	}
+	{
+		cmdTwerk := app.Command("twerk", "Execute a formula *interactively*.  On a terminal, type '~.' at the start of a line to detach (which cancels the job).")
 		argsTwerk := struct {
 			FormulaPath string
 			Executor    string
+			Commit      bool
+			Outputs     []string
+			Warehouse   string
+			executorArgs
 		}{}
 		cmdTwerk.Arg("formula", "Path to formula file.").
 			Required().
 			StringVar(&argsTwerk.FormulaPath)
 		cmdTwerk.Flag("executor", "Select an executor system to use").
 			Default("runc").
-			EnumVar(&argsTwerk.Executor,
-				"runc", "chroot")
+			EnumVar(&argsTwerk.Executor, executorNames...)
+		cmdTwerk.Flag("commit", "When the session exits, pack its outputs, and print a formula which continues from them").
+			BoolVar(&argsTwerk.Commit)
+		cmdTwerk.Flag("output", "Path to pack on commit, besides the formula's outputs; may be repeated").
+			StringsVar(&argsTwerk.Outputs)
+		cmdTwerk.Flag("warehouse", "Warehouse to save committed wares to, where the formula doesn't give one").
+			StringVar(&argsTwerk.Warehouse)
+		declareExecutorFlags(cmdTwerk, &argsTwerk.executorArgs)
 		bhvs[cmdTwerk.FullCommand()] = behavior{&argsTwerk, func() error {
-			return Twerk(ctx, argsTwerk.Executor, argsTwerk.FormulaPath, stdin, stdout, stderr)
+			execCfg, err := argsTwerk.executorArgs.config()
+			if err != nil {
+				return err
+			}
+			if !argsTwerk.Commit && (len(argsTwerk.Outputs) > 0 || argsTwerk.Warehouse != "") {
+				return Errorf(repeatr.ErrUsage, "--output and --warehouse only make sense with --commit")
+			}
+			commit := twerkCommit{argsTwerk.Commit, argsTwerk.Outputs, api.WarehouseLocation(argsTwerk.Warehouse)}
+			return Twerk(ctx, argsTwerk.Executor, execCfg, argsTwerk.FormulaPath, commit, stdin, stdout, stderr)
+		}}
+	}
+	{
+		cmdLogs := app.Command("logs", "Replay the output of a job (set the log dir with REPEATR_LOGDIR).")
+		argsLogs := struct {
+			ID string
+		}{}
+		cmdLogs.Arg("id", "Guid of the run record, or setupHash of the formula (for its latest run).").
+			Required().
+			StringVar(&argsLogs.ID)
+		bhvs[cmdLogs.FullCommand()] = behavior{&argsLogs, func() error {
+			printer := setupPrinter(format(baseArgs.Format), stdout, stderr)
+			return LogsCmd(config.GetRepeatrLogPath(), argsLogs.ID, printer)
+		}}
+	}
+	{
+		cmdPs := app.Command("ps", "List running jobs.")
+		bhvs[cmdPs.FullCommand()] = behavior{nil, func() error {
+			return PsCmd(executorWorkspaceDirs(), format(baseArgs.Format), stdout)
+		}}
+	}
+	{
+		cmdExec := app.Command("exec", "Run a command inside a running job, for debugging (e.g. `repeatr exec <guid> -- ls -l`).  "+
+			"With the ns and chroot executors, the command runs as the job's user but outside the rest of its sandbox (capabilities, rlimits, cgroup): for a root job, that's host root.")
+		argsExec := struct {
+			Guid    string
+			Command []string
+		}{}
+		cmdExec.Arg("guid", "Guid of the job (see `repeatr ps`).").
+			Required().
+			StringVar(&argsExec.Guid)
+		cmdExec.Arg("command", "Command to run (default: a shell).").
+			StringsVar(&argsExec.Command)
+		bhvs[cmdExec.FullCommand()] = behavior{&argsExec, func() error {
+			return ExecCmd(executorWorkspaceDirs(), argsExec.Guid, argsExec.Command, stdin, stdout, stderr)
+		}}
+	}
+	{
+		cmdWorkspace := app.Command("workspace", "Manage the executors' job work dirs.")
+		{
+			cmdWorkspacePrune := cmdWorkspace.Command("prune", "Remove work dirs kept by --keep-workspace, or left behind by crashed runs.")
+			argsWorkspacePrune := struct {
+				OlderThan time.Duration
+			}{}
+			cmdWorkspacePrune.Flag("older-than", "Only remove work dirs older than this (e.g. '24h')").
+				Default("0").
+				DurationVar(&argsWorkspacePrune.OlderThan)
+			bhvs[cmdWorkspacePrune.FullCommand()] = behavior{&argsWorkspacePrune, func() error {
+				return WorkspacePruneCmd(executorWorkspaceDirs(), argsWorkspacePrune.OlderThan, format(baseArgs.Format), stdout)
+			}}
+		}
+	}
+	{
+		cmdMemo := app.Command("memo", "Inspect and prune the memo dir (set by REPEATR_MEMODIR).")
+		{
+			cmdMemoLs := cmdMemo.Command("ls", "List memoized run records.")
+			bhvs[cmdMemoLs.FullCommand()] = behavior{nil, func() error {
+				return MemoLsCmd(config.GetRepeatrMemoPath(), format(baseArgs.Format), stdout)
+			}}
+		}
+		{
+			cmdMemoShow := cmdMemo.Command("show", "Show the memoized run record for a formula setupHash.")
+			argsMemoShow := struct {
+				SetupHash string
+			}{}
+			cmdMemoShow.Arg("setupHash", "SetupHash of the formula.").
+				Required().
+				StringVar(&argsMemoShow.SetupHash)
+			bhvs[cmdMemoShow.FullCommand()] = behavior{&argsMemoShow, func() error {
+				return MemoShowCmd(config.GetRepeatrMemoPath(), api.FormulaSetupHash(argsMemoShow.SetupHash), format(baseArgs.Format), stdout, stderr)
+			}}
+		}
+		{
+			cmdMemoForget := cmdMemo.Command("forget", "Forget the memoized run record for a formula.")
+			argsMemoForget := struct {
+				SetupHash   string
+				FormulaPath string
+			}{}
+			cmdMemoForget.Arg("setupHash", "SetupHash of the formula.").
+				StringVar(&argsMemoForget.SetupHash)
+			cmdMemoForget.Flag("formula", "Path to formula file (instead of giving its setupHash).").
+				StringVar(&argsMemoForget.FormulaPath)
+			bhvs[cmdMemoForget.FullCommand()] = behavior{&argsMemoForget, func() error {
+				return MemoForgetCmd(config.GetRepeatrMemoPath(), api.FormulaSetupHash(argsMemoForget.SetupHash), argsMemoForget.FormulaPath, format(baseArgs.Format), stdout)
+			}}
+		}
+		{
+			cmdMemoGc := cmdMemo.Command("gc", "Remove old memoized run records.")
+			argsMemoGc := struct {
+				OlderThan  time.Duration
+				MaxEntries int
+			}{}
+			cmdMemoGc.Flag("older-than", "Remove records of runs older than this (e.g. '720h')").
+				Default("0").
+				DurationVar(&argsMemoGc.OlderThan)
+			cmdMemoGc.Flag("max-entries", "Keep at most this many records, removing the oldest").
+				Default("0").
+				IntVar(&argsMemoGc.MaxEntries)
+			bhvs[cmdMemoGc.FullCommand()] = behavior{&argsMemoGc, func() error {
+				return MemoGcCmd(config.GetRepeatrMemoPath(), argsMemoGc.OlderThan, argsMemoGc.MaxEntries, format(baseArgs.Format), stdout)
+			}}
+		}
+		{
+			cmdMemoStats := cmdMemo.Command("stats", "Report memo hit and miss counts.")
+			bhvs[cmdMemoStats.FullCommand()] = behavior{nil, func() error {
+				return MemoStatsCmd(config.GetRepeatrMemoPath(), format(baseArgs.Format), stdout)
+			}}
+		}
+		{
+			cmdMemoServe := cmdMemo.Command("serve", "Serve the memo dir over HTTP, for use as REPEATR_MEMOURL by other machines.  "+
+				"Anyone who can reach it can save memos, so only listen where every client is trusted -- or have clients set REPEATR_TRUSTED_KEYS, so they only use signed memos.")
+			argsMemoServe := struct {
+				Listen string
+			}{}
+			cmdMemoServe.Flag("listen", "Address to listen on.  The default is only reachable from this machine.").
+				Default("127.0.0.1:8041").
+				StringVar(&argsMemoServe.Listen)
+			bhvs[cmdMemoServe.FullCommand()] = behavior{&argsMemoServe, func() error {
+				return MemoServeCmd(ctx, config.GetRepeatrMemoPath(), argsMemoServe.Listen, stderr)
+			}}
+		}
+	}
+	{
+		cmdKeygen := app.Command("keygen", "Generate a key for signing run records (use it by setting REPEATR_SIGNING_KEY).")
+		argsKeygen := struct {
+			KeyPath string
+		}{}
+		cmdKeygen.Arg("keyfile", "Path to write the key to.").
+			Required().
+			StringVar(&argsKeygen.KeyPath)
+		bhvs[cmdKeygen.FullCommand()] = behavior{&argsKeygen, func() error {
+			return KeygenCmd(argsKeygen.KeyPath, stdout)
+		}}
+	}
+	{
+		cmdVerify := app.Command("verify", "Check a run record is signed by a trusted key.")
+		argsVerify := struct {
+			RecordPath      string
+			TrustedKeysPath string
+		}{}
+		cmdVerify.Arg("record", "Path to run record file.").
+			Required().
+			StringVar(&argsVerify.RecordPath)
+		cmdVerify.Flag("trusted-keys", "Path to trusted keys file (default from REPEATR_TRUSTED_KEYS)").
+			Default(config.GetRepeatrTrustedKeysPath()).
+			StringVar(&argsVerify.TrustedKeysPath)
+		bhvs[cmdVerify.FullCommand()] = behavior{&argsVerify, func() error {
+			return VerifyCmd(argsVerify.RecordPath, argsVerify.TrustedKeysPath, format(baseArgs.Format), stdout)
 		}}
 	}
 
@@ -112,9 +378,9 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io
 func setupPrinter(format format, stdout, stderr io.Writer) repeatrfmt.Printer {
 	switch format {
 	case format_Ansi:
-		return repeatrfmt.NewAnsiPrinter(stdout, stderr)
+		return newAnsiStreamPrinter(stdout, stderr)
 	case format_Json:
-		return repeatrfmt.NewJsonPrinter(stdout)
+		return newJsonStreamPrinter(stdout)
 	default:
 		panic("unreachable")
 	}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor/impl/memo"
+	"go.polydawn.net/rio/fs"
+)
+
+// The memo commands only make sense with a memo dir; it's an error not to have one.
+func requireMemoDir(memoDir *fs.AbsolutePath) (fs.AbsolutePath, error) {
+	if memoDir == nil {
+		return fs.AbsolutePath{}, Errorf(repeatr.ErrUsage, "no memo dir configured (set REPEATR_MEMODIR)")
+	}
+	return *memoDir, nil
+}
+
+func MemoLsCmd(memoDir *fs.AbsolutePath, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dir, err := requireMemoDir(memoDir)
+	if err != nil {
+		return err
+	}
+	entries, err := memo.List(dir)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case format_Json:
+		records := make(map[string]*api.FormulaRunRecord, len(entries))
+		for _, entry := range entries {
+			records[string(entry.SetupHash)] = entry.RunRecord
+		}
+		return emitJson(stdout, api.Atlas_FormulaRunRecord, records)
+	default:
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "SETUPHASH\tTIME\tEXIT\tRESULTS\n")
+		for _, entry := range entries {
+			rr := entry.RunRecord
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n",
+				entry.SetupHash,
+				time.Unix(rr.Time, 0).UTC().Format(time.RFC3339),
+				rr.ExitCode,
+				formatResults(rr.Results),
+			)
+		}
+		return tw.Flush()
+	}
+}
+
+func MemoShowCmd(memoDir *fs.AbsolutePath, setupHash api.FormulaSetupHash, format format, stdout, stderr io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dir, err := requireMemoDir(memoDir)
+	if err != nil {
+		return err
+	}
+	rr, err := memo.Load(dir, setupHash)
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		return Errorf(repeatr.ErrUsage, "no memo for setupHash %q", setupHash)
+	}
+	setupPrinter(format, stdout, stderr).PrintResult(repeatr.Event_Result{rr, nil})
+	return nil
+}
+
+/*
+	Forget the memo for a setupHash, or all the memos for the formula in
+	formulaPath (whatever options they were run with; see memo.Keys) if
+	that's given instead.  It's not an error if there was no memo.
+*/
+func MemoForgetCmd(memoDir *fs.AbsolutePath, setupHash api.FormulaSetupHash, formulaPath string, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dir, err := requireMemoDir(memoDir)
+	if err != nil {
+		return err
+	}
+	var keys []api.FormulaSetupHash
+	switch {
+	case setupHash != "" && formulaPath != "":
+		return Errorf(repeatr.ErrUsage, "give either a setupHash or a formula, not both")
+	case formulaPath != "":
+		frmPlus, err := loadFormula(formulaPath)
+		if err != nil {
+			return err
+		}
+		keys, err = memo.Keys(dir, frmPlus.Formula.SetupHash())
+		if err != nil {
+			return err
+		}
+	case setupHash == "":
+		return Errorf(repeatr.ErrUsage, "give either a setupHash or a formula")
+	default:
+		keys = []api.FormulaSetupHash{setupHash}
+	}
+	var forgotten []api.FormulaSetupHash
+	for _, key := range keys {
+		ok, err := memo.Forget(dir, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			forgotten = append(forgotten, key)
+		}
+	}
+	return emitForgotten(stdout, format, forgotten)
+}
+
+func MemoGcCmd(memoDir *fs.AbsolutePath, olderThan time.Duration, maxEntries int, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dir, err := requireMemoDir(memoDir)
+	if err != nil {
+		return err
+	}
+	if olderThan == 0 && maxEntries == 0 {
+		return Errorf(repeatr.ErrUsage, "memo gc needs at least one of --older-than or --max-entries")
+	}
+	removed, err := memo.GC(dir, olderThan, maxEntries, time.Now())
+	if err != nil {
+		return err
+	}
+	return emitForgotten(stdout, format, removed)
+}
+
+func MemoStatsCmd(memoDir *fs.AbsolutePath, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dir, err := requireMemoDir(memoDir)
+	if err != nil {
+		return err
+	}
+	stats, err := memo.LoadStats(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := memo.List(dir)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case format_Json:
+		return emitJson(stdout, atl_memoStats, memoStats{stats.Hits, stats.Misses, len(entries)})
+	default:
+		fmt.Fprintf(stdout, "entries: %d\n", len(entries))
+		fmt.Fprintf(stdout, "hits:    %d\n", stats.Hits)
+		fmt.Fprintf(stdout, "misses:  %d\n", stats.Misses)
+		if total := stats.Hits + stats.Misses; total > 0 {
+			fmt.Fprintf(stdout, "hit rate: %.1f%%\n", float64(stats.Hits)*100/float64(total))
+		}
+		return nil
+	}
+}
+
+/*
+	Serve the memo dir over HTTP until the context is cancelled.
+	Other machines can use it by setting REPEATR_MEMOURL.
+
+	The server takes any well-formed memo PUT to it, and checks only that
+	it's filed under its own setupHash: a client which lies about a run's
+	results can poison the memos of everyone using the server.  So either
+	every client which can reach it must be trusted, or the clients must
+	only use signed memos (REPEATR_TRUSTED_KEYS; see the signing package).
+*/
+func MemoServeCmd(ctx context.Context, memoDir *fs.AbsolutePath, listen string, stderr io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dir, err := requireMemoDir(memoDir)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return Errorf(repeatr.ErrUsage, "cannot listen on %q: %s", listen, err)
+	}
+	srv := &http.Server{Handler: memo.NewHandler(memo.NewDirStore(dir))}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Fprintf(stderr, "serving memos from %s on %s\n", dir, ln.Addr())
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return Errorf(repeatr.ErrLocalCacheProblem, "memo server failed: %s", err)
+	}
+	return nil
+}
+
+type memoStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+var (
+	memoStats_AtlasEntry = atlas.BuildEntry(memoStats{}).StructMap().Autogenerate().Complete()
+	atl_memoStats        = atlas.MustBuild(memoStats_AtlasEntry)
+	atl_hashList         = atlas.MustBuild()
+)
+
+func emitForgotten(stdout io.Writer, format format, setupHashes []api.FormulaSetupHash) error {
+	switch format {
+	case format_Json:
+		strs := make([]string, len(setupHashes))
+		for i, h := range setupHashes {
+			strs[i] = string(h)
+		}
+		return emitJson(stdout, atl_hashList, strs)
+	default:
+		if len(setupHashes) == 0 {
+			fmt.Fprintf(stdout, "no memos removed\n")
+		}
+		for _, h := range setupHashes {
+			fmt.Fprintf(stdout, "forgot %s\n", h)
+		}
+		return nil
+	}
+}
+
+func emitJson(stdout io.Writer, atl atlas.Atlas, obj interface{}) error {
+	enc := json.EncodeOptions{Line: []byte{'\n'}, Indent: []byte{'\t'}}
+	if err := refmt.NewMarshallerAtlased(enc, stdout, atl).Marshal(obj); err != nil {
+		panic(err)
+	}
+	stdout.Write([]byte{'\n'})
+	return nil
+}
+
+// Format a result map as "path=wareID" pairs, sorted by path.
+func formatResults(results map[api.AbsPath]api.WareID) string {
+	pairs := make([]string, 0, len(results))
+	for pth, wareID := range results {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", pth, wareID))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
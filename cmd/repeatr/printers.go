@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/go-timeless-api/repeatr/fmt"
+	"go.polydawn.net/repeatr/executor"
+)
+
+/*
+	A printer which can keep the job's stdout and stderr apart.
+
+	The printers in repeatrfmt only know the timeless api's output event,
+	which has no stream; ours wrap them, and handle the stream-tagged
+	events executors send.  (See printOutput, which works with either.)
+*/
+type streamPrinter interface {
+	repeatrfmt.Printer
+	PrintStreamOutput(executor.Event_StreamOutput)
+}
+
+// Print an output event (tagged with a stream or not), keeping the
+//  stream if the printer can.
+func printOutput(printer repeatrfmt.Printer, evt repeatr.Event) {
+	stream, evt2, _ := executor.OutputEvent(evt)
+	if sp, ok := printer.(streamPrinter); ok {
+		sp.PrintStreamOutput(executor.Event_StreamOutput{evt2, stream})
+		return
+	}
+	printer.PrintOutput(evt2)
+}
+
+/*
+	A printer which can show progress of unpacking inputs and packing
+	outputs.  (Printers which can't just drop it: as log lines, it'd
+	be a lot of them.)
+*/
+type progressPrinter interface {
+	PrintProgress(executor.Event_Progress)
+}
+
+func printProgress(printer repeatrfmt.Printer, evt executor.Event_Progress) {
+	if pp, ok := printer.(progressPrinter); ok {
+		pp.PrintProgress(evt)
+	}
+}
+
+/*
+	A printer which can show the results of all the steps in a batch, by
+	step name.  (Steps which didn't get as far as a run record are left
+	out; their errors have already been logged.)
+*/
+type batchResultPrinter interface {
+	PrintBatchResult(map[string]*api.FormulaRunRecord)
+}
+
+func printBatchResult(printer repeatrfmt.Printer, results map[string]*api.FormulaRunRecord) {
+	if bp, ok := printer.(batchResultPrinter); ok {
+		bp.PrintBatchResult(results)
+	}
+}
+
+// Prints the job's stderr in red, progress as bars on stderr, and the
+//  run's timings and resource usage after its result; otherwise as
+//  repeatrfmt's ansi printer.
+type ansiStreamPrinter struct {
+	repeatrfmt.Printer
+	stdout io.Writer
+	stderr io.Writer
+	bars   *progressBars
+}
+
+func newAnsiStreamPrinter(stdout, stderr io.Writer) ansiStreamPrinter {
+	return ansiStreamPrinter{
+		repeatrfmt.NewAnsiPrinter(stdout, stderr),
+		stdout,
+		stderr,
+		&progressBars{w: stderr, latest: map[string]executor.Event_Progress{}},
+	}
+}
+
+// Everything else printed has to clear the bars out of its way, then
+//  put them back below it.
+func (p ansiStreamPrinter) PrintLog(evt repeatr.Event_Log) {
+	p.bars.clear()
+	p.Printer.PrintLog(evt)
+	p.bars.draw()
+}
+func (p ansiStreamPrinter) PrintOutput(evt repeatr.Event_Output) {
+	p.bars.clear()
+	p.Printer.PrintOutput(evt)
+	p.bars.draw()
+}
+func (p ansiStreamPrinter) PrintResult(evt repeatr.Event_Result) {
+	p.bars.clear()
+	p.Printer.PrintResult(evt)
+	if evt.Record != nil {
+		printRunStats(p.stderr, evt.Record)
+	}
+	p.bars.draw()
+}
+
+// The run record metadata printRunStats shows, by key prefix.
+//  (See mixins.RecordPhaseTime and mixins.RecordRusage, and the runc
+//  executor's cgroup stats.)
+var runStatsPrefixes = []string{"phase.", "rusage.", "cgroup."}
+
+// Metadata values which are counts of bytes.
+var runStatsBytes = map[string]bool{
+	"rusage.maxrss":     true,
+	"cgroup.memory.max": true,
+}
+
+// Print the timings and resource usage in a run record, if it has any,
+//  as a table.
+func printRunStats(w io.Writer, rr *api.FormulaRunRecord) {
+	var keys []string
+	for k := range rr.Metadata {
+		for _, prefix := range runStatsPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, k := range keys {
+		v := rr.Metadata[k]
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && runStatsBytes[k] {
+			v = fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", k, v)
+	}
+	tw.Flush()
+}
+
+// Prints a table of each step's exit code and results, in step order.
+func (p ansiStreamPrinter) PrintBatchResult(results map[string]*api.FormulaRunRecord) {
+	p.bars.clear()
+	defer p.bars.draw()
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(p.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "STEP\tEXIT\tRESULTS\n")
+	for _, name := range names {
+		rr := results[name]
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", name, rr.ExitCode, formatResults(rr.Results))
+	}
+	tw.Flush()
+}
+
+func (p ansiStreamPrinter) PrintStreamOutput(evt executor.Event_StreamOutput) {
+	if evt.Stream == executor.Stream_Stderr {
+		evt.Msg = "\x1b[31m" + evt.Msg + "\x1b[0m"
+	}
+	p.PrintOutput(evt.Event_Output)
+}
+
+func (p ansiStreamPrinter) PrintProgress(evt executor.Event_Progress) {
+	p.bars.update(evt)
+}
+
+// How often the progress bars are redrawn, at most.  (Except when wares
+//  start or finish.)
+const progressRedrawInterval = 100 * time.Millisecond
+
+/*
+	Progress bars for each ware in progress, kept at the bottom of the
+	terminal.  Finished bars are drawn one last time, and left behind as
+	history, above the ones still going.
+
+	Not safe for concurrent use; printers are only used from one goroutine.
+*/
+type progressBars struct {
+	w      io.Writer
+	order  []string                           // Wares in progress (by label), in the order they started.
+	latest map[string]executor.Event_Progress // Last progress of each.
+	drawn  int                                // Lines of bars on screen now.
+	last   time.Time                          // When they were drawn.
+}
+
+func (b *progressBars) update(evt executor.Event_Progress) {
+	label := evt.Msg
+	_, known := b.latest[label]
+	if !known {
+		b.order = append(b.order, label)
+	}
+	b.latest[label] = evt
+	if known && !evt.Done() && time.Since(b.last) < progressRedrawInterval {
+		return
+	}
+	b.clear()
+	b.draw()
+}
+
+func (b *progressBars) clear() {
+	if b.drawn == 0 {
+		return
+	}
+	fmt.Fprintf(b.w, "\x1b[%dA\x1b[J", b.drawn)
+	b.drawn = 0
+}
+
+func (b *progressBars) draw() {
+	var buf bytes.Buffer
+	active := b.order[:0]
+	for _, label := range b.order {
+		if evt := b.latest[label]; evt.Done() {
+			buf.WriteString(renderProgressBar(evt))
+			delete(b.latest, label)
+		} else {
+			active = append(active, label)
+		}
+	}
+	b.order = active
+	for _, label := range b.order {
+		buf.WriteString(renderProgressBar(b.latest[label]))
+	}
+	b.w.Write(buf.Bytes())
+	b.drawn = len(b.order)
+	b.last = time.Now()
+}
+
+func renderProgressBar(evt executor.Event_Progress) string {
+	const width = 30
+	if evt.TotalWork <= 0 {
+		return fmt.Sprintf("%s  [%s]  %d  %s\x1b[K\n", evt.Msg, strings.Repeat("-", width), evt.TotalProg, evt.Desc)
+	}
+	frac := float64(evt.TotalProg) / float64(evt.TotalWork)
+	if frac > 1 {
+		frac = 1
+	}
+	filled := int(frac * width)
+	return fmt.Sprintf("%s  [%s%s]  %3d%%  %s\x1b[K\n", evt.Msg, strings.Repeat("=", filled), strings.Repeat(" ", width-filled), int(frac*100), evt.Desc)
+}
+
+// Prints output events with a "stream" field, and progress records
+//  (at most one per ware per jsonProgressInterval, besides its first
+//  and last); otherwise as repeatrfmt's json printer.
+type jsonStreamPrinter struct {
+	repeatrfmt.Printer
+	stdout       io.Writer
+	lastProgress map[string]time.Time // When we last printed progress for each ware, by label.
+}
+
+func newJsonStreamPrinter(stdout io.Writer) jsonStreamPrinter {
+	return jsonStreamPrinter{repeatrfmt.NewJsonPrinter(stdout), stdout, map[string]time.Time{}}
+}
+
+const jsonProgressInterval = time.Second
+
+type jsonOutputEvent struct {
+	Output jsonOutput
+}
+
+type jsonOutput struct {
+	Time   string
+	Msg    string
+	Stream executor.Stream
+}
+
+type jsonBatchResultEvent struct {
+	BatchResult map[string]*api.FormulaRunRecord
+}
+
+type jsonProgressEvent struct {
+	Progress jsonProgress
+}
+
+type jsonProgress struct {
+	Time     string
+	Msg      string
+	Phase    executor.Phase
+	Path     string
+	Desc     string
+	Progress int
+	Work     int
+}
+
+var atl_jsonOutputEvent = atlas.MustBuild(
+	atlas.BuildEntry(jsonOutputEvent{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(jsonOutput{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(jsonProgressEvent{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(jsonProgress{}).StructMap().Autogenerate().Complete(),
+	atlas.BuildEntry(jsonBatchResultEvent{}).StructMap().Autogenerate().Complete(),
+	api.FormulaRunRecord_AtlasEntry,
+	api.WareID_AtlasEntry,
+)
+
+func (p jsonStreamPrinter) PrintStreamOutput(evt executor.Event_StreamOutput) {
+	line := jsonOutputEvent{jsonOutput{
+		Time:   evt.Time.Format(time.RFC3339Nano),
+		Msg:    evt.Msg,
+		Stream: evt.Stream,
+	}}
+	p.printLine(line)
+}
+
+func (p jsonStreamPrinter) PrintProgress(evt executor.Event_Progress) {
+	last, seen := p.lastProgress[evt.Msg]
+	switch {
+	case evt.Done():
+		delete(p.lastProgress, evt.Msg)
+	case seen && time.Since(last) < jsonProgressInterval:
+		return
+	default:
+		p.lastProgress[evt.Msg] = time.Now()
+	}
+	p.printLine(jsonProgressEvent{jsonProgress{
+		Time:     evt.Time.Format(time.RFC3339Nano),
+		Msg:      evt.Msg,
+		Phase:    evt.Phase,
+		Path:     string(evt.Path),
+		Desc:     evt.Desc,
+		Progress: evt.TotalProg,
+		Work:     evt.TotalWork,
+	}})
+}
+
+// Prints the batch's results as one record, like any other event.
+func (p jsonStreamPrinter) PrintBatchResult(results map[string]*api.FormulaRunRecord) {
+	p.printLine(jsonBatchResultEvent{results})
+}
+
+func (p jsonStreamPrinter) printLine(line interface{}) {
+	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{}, p.stdout, atl_jsonOutputEvent).Marshal(line); err != nil {
+		panic(err)
+	}
+	p.stdout.Write([]byte{'\n'})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestJsonStreamPrinter(t *testing.T) {
+	buf := bytes.Buffer{}
+	printer := jsonStreamPrinter{nil, &buf, map[string]time.Time{}}
+	printOutput(printer, executor.Event_StreamOutput{
+		Event_Output: repeatr.Event_Output{Time: time.Unix(1262304000, 0).UTC(), Msg: "oops\n"},
+		Stream:       executor.Stream_Stderr,
+	})
+	printOutput(printer, repeatr.Event_Output{Time: time.Unix(1262304000, 0).UTC(), Msg: "hi\n"})
+	WantEqual(t, buf.String(), ""+
+		`{"output":{"time":"2010-01-01T00:00:00Z","msg":"oops\n","stream":"stderr"}}`+"\n"+
+		`{"output":{"time":"2010-01-01T00:00:00Z","msg":"hi\n","stream":"stdout"}}`+"\n",
+	)
+}
+
+func TestJsonProgressRateLimit(t *testing.T) {
+	buf := bytes.Buffer{}
+	printer := jsonStreamPrinter{nil, &buf, map[string]time.Time{}}
+	evt := executor.Event_Progress{
+		Event_Log: repeatr.Event_Log{Time: time.Unix(1262304000, 0).UTC(), Msg: "unpack /src"},
+		Phase:     executor.Phase_Unpack,
+		Path:      "/src",
+		TotalWork: 100,
+	}
+	for evt.TotalProg = 0; evt.TotalProg <= 100; evt.TotalProg += 10 {
+		printProgress(printer, evt)
+	}
+	WantEqual(t, buf.String(), ""+
+		`{"progress":{"time":"2010-01-01T00:00:00Z","msg":"unpack /src","phase":"unpack","path":"/src","desc":"","progress":0,"work":100}}`+"\n"+
+		`{"progress":{"time":"2010-01-01T00:00:00Z","msg":"unpack /src","phase":"unpack","path":"/src","desc":"","progress":100,"work":100}}`+"\n",
+	)
+}
+
+func TestPrintRunStats(t *testing.T) {
+	buf := bytes.Buffer{}
+	printRunStats(&buf, &api.FormulaRunRecord{Metadata: map[string]string{
+		"rusage.maxrss": "3145728",
+		"phase.exec":    "1.5s",
+		"signature":     "xyz",
+	}})
+	WantEqual(t, buf.String(), ""+
+		"  phase.exec     1.5s\n"+
+		"  rusage.maxrss  3.0 MiB\n",
+	)
+
+	buf.Reset()
+	printRunStats(&buf, &api.FormulaRunRecord{})
+	WantEqual(t, buf.String(), "")
+}
+
+func TestPrintBatchResult(t *testing.T) {
+	results := map[string]*api.FormulaRunRecord{
+		"b": {ExitCode: 2},
+		"a": {Results: map[api.AbsPath]api.WareID{"/out": {"tar", "xyz"}}},
+	}
+
+	buf := bytes.Buffer{}
+	printBatchResult(ansiStreamPrinter{nil, &buf, nil, &progressBars{w: &bytes.Buffer{}}}, results)
+	WantEqual(t, buf.String(), ""+
+		"STEP  EXIT  RESULTS\n"+
+		"a     0     /out=tar:xyz\n"+
+		"b     2     \n",
+	)
+
+	buf.Reset()
+	printBatchResult(jsonStreamPrinter{nil, &buf, nil}, map[string]*api.FormulaRunRecord{"a": {ExitCode: 2}})
+	WantEqual(t, strings.HasPrefix(buf.String(), `{"batchResult":{"a":{`), true)
+	WantEqual(t, strings.Count(buf.String(), "\n"), 1)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/config"
+	"go.polydawn.net/repeatr/executor/impl/gvisor"
+	"go.polydawn.net/repeatr/executor/impl/runc"
+)
+
+/*
+	The provenance of a run, as an in-toto statement with a SLSA provenance
+	predicate (https://slsa.dev/provenance/v0.2).
+
+	Subjects are the run's results, and materials its inputs, each with
+	the URLs they may be fetched from.  Wares are content-addressed, so
+	their digests come from their hashes (see wareDigest); the ware IDs
+	themselves are listed too, in fields of our own.
+*/
+type provenanceStatement struct {
+	Type          string
+	Subject       []provenanceSubject
+	PredicateType string
+	Predicate     provenancePredicate
+}
+
+type provenanceSubject struct {
+	Name   string
+	Digest map[string]string
+}
+
+type provenancePredicate struct {
+	Builder    provenanceBuilder
+	BuildType  string
+	Invocation provenanceInvocation
+	Metadata   provenanceMetadata
+	Materials  []provenanceMaterial
+}
+
+type provenanceBuilder struct {
+	ID string
+}
+
+type provenanceInvocation struct {
+	Parameters  api.Formula // The formula itself.
+	Environment provenanceEnvironment
+}
+
+type provenanceEnvironment struct {
+	Executor       string
+	RepeatrVersion string
+	Binaries       map[string]string // Binary name -> sha256, for repeatr and any executor plugin.
+	Memoized       bool              // If true, the run record doesn't say what made it; the rest is blank.
+}
+
+type provenanceMetadata struct {
+	BuildInvocationID string
+	BuildStartedOn    string
+	ExitCode          int
+	Results           map[api.AbsPath]api.WareID // The subjects, by ware ID.
+}
+
+type provenanceMaterial struct {
+	URI    string
+	Path   api.AbsPath // Where the input was mounted.
+	WareID api.WareID
+	Digest map[string]string
+}
+
+var (
+	atl_provenance = atlas.MustBuild(
+		atlas.BuildEntry(provenanceStatement{}).StructMap().
+			AddField("Type", atlas.StructMapEntry{SerialName: "_type"}).
+			AddField("Subject", atlas.StructMapEntry{SerialName: "subject"}).
+			AddField("PredicateType", atlas.StructMapEntry{SerialName: "predicateType"}).
+			AddField("Predicate", atlas.StructMapEntry{SerialName: "predicate"}).
+			Complete(),
+		atlas.BuildEntry(provenanceSubject{}).StructMap().
+			AddField("Name", atlas.StructMapEntry{SerialName: "name"}).
+			AddField("Digest", atlas.StructMapEntry{SerialName: "digest"}).
+			Complete(),
+		atlas.BuildEntry(provenancePredicate{}).StructMap().
+			AddField("Builder", atlas.StructMapEntry{SerialName: "builder"}).
+			AddField("BuildType", atlas.StructMapEntry{SerialName: "buildType"}).
+			AddField("Invocation", atlas.StructMapEntry{SerialName: "invocation"}).
+			AddField("Metadata", atlas.StructMapEntry{SerialName: "metadata"}).
+			AddField("Materials", atlas.StructMapEntry{SerialName: "materials"}).
+			Complete(),
+		atlas.BuildEntry(provenanceBuilder{}).StructMap().
+			AddField("ID", atlas.StructMapEntry{SerialName: "id"}).
+			Complete(),
+		atlas.BuildEntry(provenanceInvocation{}).StructMap().
+			AddField("Parameters", atlas.StructMapEntry{SerialName: "parameters"}).
+			AddField("Environment", atlas.StructMapEntry{SerialName: "environment"}).
+			Complete(),
+		atlas.BuildEntry(provenanceEnvironment{}).StructMap().
+			AddField("Executor", atlas.StructMapEntry{SerialName: "executor"}).
+			AddField("RepeatrVersion", atlas.StructMapEntry{SerialName: "repeatrVersion"}).
+			AddField("Binaries", atlas.StructMapEntry{SerialName: "binaries"}).
+			AddField("Memoized", atlas.StructMapEntry{SerialName: "memoized", OmitEmpty: true}).
+			Complete(),
+		atlas.BuildEntry(provenanceMetadata{}).StructMap().
+			AddField("BuildInvocationID", atlas.StructMapEntry{SerialName: "buildInvocationId"}).
+			AddField("BuildStartedOn", atlas.StructMapEntry{SerialName: "buildStartedOn"}).
+			AddField("ExitCode", atlas.StructMapEntry{SerialName: "exitCode"}).
+			AddField("Results", atlas.StructMapEntry{SerialName: "results"}).
+			Complete(),
+		atlas.BuildEntry(provenanceMaterial{}).StructMap().
+			AddField("URI", atlas.StructMapEntry{SerialName: "uri"}).
+			AddField("Path", atlas.StructMapEntry{SerialName: "path"}).
+			AddField("WareID", atlas.StructMapEntry{SerialName: "wareID"}).
+			AddField("Digest", atlas.StructMapEntry{SerialName: "digest"}).
+			Complete(),
+		api.Formula_AtlasEntry,
+		api.FilesetPackFilter_AtlasEntry,
+		api.FormulaAction_AtlasEntry,
+		api.FormulaUserinfo_AtlasEntry,
+		api.FormulaOutputSpec_AtlasEntry,
+		api.WareID_AtlasEntry,
+	)
+)
+
+/*
+	Assemble the provenance of a run from the formula, its context, and
+	the run record.
+
+	The builder is whatever the run record says ran the job (see
+	recordBuilder), which for a memoized record isn't us.  Records made
+	before repeatr kept track say nothing; so we can't either, and the
+	provenance is marked as memoized.
+*/
+func buildProvenance(
+	formula api.Formula,
+	formulaCtx repeatr.FormulaContext,
+	rr *api.FormulaRunRecord,
+) provenanceStatement {
+	env := builderFromRecord(rr)
+	builderID := "https://go.polydawn.net/repeatr/executor/" + env.Executor
+	if env.Memoized {
+		builderID = "https://go.polydawn.net/repeatr/memoized"
+	}
+	stmt := provenanceStatement{
+		Type:          "https://in-toto.io/Statement/v0.1",
+		PredicateType: "https://slsa.dev/provenance/v0.2",
+		Predicate: provenancePredicate{
+			Builder:   provenanceBuilder{builderID},
+			BuildType: "https://go.polydawn.net/repeatr/formula/v1",
+			Invocation: provenanceInvocation{
+				Parameters:  formula,
+				Environment: env,
+			},
+			Metadata: provenanceMetadata{
+				BuildInvocationID: rr.Guid,
+				BuildStartedOn:    time.Unix(rr.Time, 0).UTC().Format(time.RFC3339),
+				ExitCode:          rr.ExitCode,
+				Results:           rr.Results,
+			},
+		},
+	}
+	for _, pth := range sortedPaths(rr.Results) {
+		stmt.Subject = append(stmt.Subject, provenanceSubject{
+			Name:   string(pth),
+			Digest: wareDigest(rr.Results[pth]),
+		})
+	}
+	for _, pth := range sortedPaths(formula.Inputs) {
+		wareID := formula.Inputs[pth]
+		urls := formulaCtx.FetchUrls[pth]
+		if len(urls) == 0 {
+			// Still worth listing (the ware may have been in a local cache); just with no URI.
+			urls = []api.WarehouseLocation{""}
+		}
+		for _, url := range urls {
+			stmt.Predicate.Materials = append(stmt.Predicate.Materials, provenanceMaterial{
+				URI:    string(url),
+				Path:   pth,
+				WareID: wareID,
+				Digest: wareDigest(wareID),
+			})
+		}
+	}
+	return stmt
+}
+
+/*
+	The digest of a ware, as in-toto wants it: hex, keyed by algorithm.
+
+	Git wares are commits, so that's what their hashes are.  Rio's other
+	pack types hash the fileset (not the packed file: the same fileset
+	always has the same hash, however it's packed), with sha384, and
+	base58-encode it; we re-encode it in hex, and name the algorithm for
+	what it is.  Hashes we can't make sense of get no digest.
+*/
+func wareDigest(wareID api.WareID) map[string]string {
+	if wareID.Type == "git" {
+		return map[string]string{"gitCommit": wareID.Hash}
+	}
+	if sum, ok := decodeBase58(wareID.Hash); ok && len(sum) == sha512.Size384 {
+		return map[string]string{"rioFilesetSha384": hex.EncodeToString(sum)}
+	}
+	return map[string]string{}
+}
+
+// Base58, in the bitcoin alphabet (which is rio's).
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func decodeBase58(s string) ([]byte, bool) {
+	n := new(big.Int)
+	for _, c := range []byte(s) {
+		digit := strings.IndexByte(base58Alphabet, c)
+		if digit < 0 {
+			return nil, false
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	// Leading zero bytes are encoded as leading '1's.
+	zeros := 0
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), true
+}
+
+func sortedPaths(wares map[api.AbsPath]api.WareID) []api.AbsPath {
+	pths := make([]api.AbsPath, 0, len(wares))
+	for pth := range wares {
+		pths = append(pths, pth)
+	}
+	sort.Slice(pths, func(i, j int) bool { return pths[i] < pths[j] })
+	return pths
+}
+
+// Run record metadata keys for what ran the job (see recordBuilder).
+const (
+	MetadataKey_BuilderExecutor  = "builder.executor"
+	MetadataKey_BuilderVersion   = "builder.repeatrVersion"
+	MetadataPrefix_BuilderBinary = "builder.binary." // Then the binary's name; the value is its hash.
+)
+
+/*
+	Decorate an executor to record what ran each job in its run record's
+	metadata: the executor, our version, and the hashes of the binaries
+	(see builderBinaries).
+
+	Put it inside signing, so that's signed along with the rest of the
+	record; and inside memoization, so memos say who really ran the job.
+*/
+func recordBuilder(executorName string, runTool repeatr.RunFunc) repeatr.RunFunc {
+	return func(
+		ctx context.Context,
+		formula api.Formula,
+		formulaCtx repeatr.FormulaContext,
+		input repeatr.InputControl,
+		mon repeatr.Monitor,
+	) (*api.FormulaRunRecord, error) {
+		rr, err := runTool(ctx, formula, formulaCtx, input, mon)
+		if rr == nil {
+			return rr, err
+		}
+		if rr.Metadata == nil {
+			rr.Metadata = map[string]string{}
+		}
+		rr.Metadata[MetadataKey_BuilderExecutor] = executorName
+		rr.Metadata[MetadataKey_BuilderVersion] = config.Version
+		for name, hash := range builderBinaries(executorName) {
+			rr.Metadata[MetadataPrefix_BuilderBinary+name] = hash
+		}
+		return rr, err
+	}
+}
+
+// Read back what recordBuilder recorded.
+func builderFromRecord(rr *api.FormulaRunRecord) provenanceEnvironment {
+	executorName, ok := rr.Metadata[MetadataKey_BuilderExecutor]
+	if !ok {
+		return provenanceEnvironment{Memoized: true}
+	}
+	env := provenanceEnvironment{
+		Executor:       executorName,
+		RepeatrVersion: rr.Metadata[MetadataKey_BuilderVersion],
+		Binaries:       map[string]string{},
+	}
+	for k, v := range rr.Metadata {
+		if strings.HasPrefix(k, MetadataPrefix_BuilderBinary) {
+			env.Binaries[strings.TrimPrefix(k, MetadataPrefix_BuilderBinary)] = v
+		}
+	}
+	return env
+}
+
+// Binaries don't change while we run, so each executor's are only hashed
+//  once.  (Batches run many jobs.)
+var builderBinariesCache = struct {
+	sync.Mutex
+	m map[string]map[string]string
+}{m: map[string]map[string]string{}}
+
+/*
+	Hash the binaries which make up the builder: repeatr itself, and
+	the executor's plugin, if it has one.  Binaries we can't find or
+	read are left out; provenance is best-effort about the builder.
+*/
+func builderBinaries(executorName string) map[string]string {
+	builderBinariesCache.Lock()
+	defer builderBinariesCache.Unlock()
+	if binaries, ok := builderBinariesCache.m[executorName]; ok {
+		return binaries
+	}
+	pths := []string{}
+	if self, err := os.Executable(); err == nil {
+		pths = append(pths, self)
+	}
+	var plugin string
+	switch executorName {
+	case "runc":
+		plugin, _ = runc.FindRuncBinary()
+	case "gvisor":
+		plugin, _ = gvisor.FindGvisorBinary()
+	}
+	if plugin != "" {
+		pths = append(pths, plugin)
+	}
+	binaries := map[string]string{}
+	for _, pth := range pths {
+		f, err := os.Open(pth)
+		if err != nil {
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		binaries[filepath.Base(pth)] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	builderBinariesCache.m[executorName] = binaries
+	return binaries
+}
+
+func writeProvenance(pth string, stmt provenanceStatement) error {
+	f, err := os.OpenFile(pth, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return Errorf(repeatr.ErrUsage, "cannot write provenance file: %s", err)
+	}
+	defer f.Close()
+	enc := json.EncodeOptions{Line: []byte{'\n'}, Indent: []byte{'\t'}}
+	if err := refmt.NewMarshallerAtlased(enc, f, atl_provenance).Marshal(stmt); err != nil {
+		return Errorf(repeatr.ErrUsage, "cannot write provenance file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/config"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestBuildProvenance(t *testing.T) {
+	// Real-looking hashes: digests are decoded from them.
+	const (
+		rootHash = "6q7G4hWr283FpTa5Lf8heVqw9t97b5VoMU6AGszuBYAz9EzQdeHVFAou7c4W9vFcQ6"
+		outHash  = "AteQchZcX1WATj4rnwsmDf4Gqhe6To4CWLj4j8Ghdjd3Ab4DJ7Abk2tuBfG96jruT"
+		srcHash  = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+		rootHex  = "9eea95a4d7d42dcbdebb407ed384634c267052f57dd5707bd678f66010bc41c72e00845f31f069e2e722c759fef90467"
+		outHex   = "04a60f03bbdfaf2c976c05981a223b40db74c9eb83a7aa06d2d5ad69ce49f4f5f70e6db195d5d2fc5b03ee9adef54b66"
+	)
+	frm := api.Formula{
+		Inputs: map[api.AbsPath]api.WareID{
+			"/":    {"tar", rootHash},
+			"/src": {"git", srcHash},
+		},
+		Action: api.FormulaAction{Exec: []string{"/bin/true"}},
+	}
+	frmCtx := repeatr.FormulaContext{
+		FetchUrls: map[api.AbsPath][]api.WarehouseLocation{
+			"/": {"ca+https://one.example/", "ca+https://two.example/"},
+		},
+	}
+	rr := &api.FormulaRunRecord{
+		Guid:    "rr1",
+		Time:    1262304000,
+		Results: map[api.AbsPath]api.WareID{"/out": {"tar", outHash}},
+		Metadata: map[string]string{
+			"builder.executor":       "runc",
+			"builder.repeatrVersion": "v1.2.3",
+			"builder.binary.repeatr": "sha256:abc",
+		},
+	}
+	stmt := buildProvenance(frm, frmCtx, rr)
+
+	WantEqual(t, stmt.Subject, []provenanceSubject{
+		{"/out", map[string]string{"rioFilesetSha384": outHex}},
+	})
+	WantEqual(t, stmt.Predicate.Materials, []provenanceMaterial{
+		{"ca+https://one.example/", "/", api.WareID{"tar", rootHash}, map[string]string{"rioFilesetSha384": rootHex}},
+		{"ca+https://two.example/", "/", api.WareID{"tar", rootHash}, map[string]string{"rioFilesetSha384": rootHex}},
+		{"", "/src", api.WareID{"git", srcHash}, map[string]string{"gitCommit": srcHash}},
+	})
+	WantEqual(t, wareDigest(api.WareID{"tar", "notAHash"}), map[string]string{})
+	WantEqual(t, stmt.Predicate.Metadata.BuildStartedOn, "2010-01-01T00:00:00Z")
+
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		pth := tmpDir.String() + "/prov.json"
+		AssertNoError(t, writeProvenance(pth, stmt))
+		content, err := ioutil.ReadFile(pth)
+		AssertNoError(t, err)
+
+		// Every field should have its name from the spec.  (Except in the
+		//  parameters, which are the formula, serialized as any formula is.)
+		var doc map[string]interface{}
+		AssertNoError(t, json.Unmarshal(content, &doc))
+		invocation := doc["predicate"].(map[string]interface{})["invocation"].(map[string]interface{})
+		_, ok := invocation["parameters"].(map[string]interface{})
+		WantEqual(t, ok, true)
+		delete(invocation, "parameters")
+		WantEqual(t, doc, map[string]interface{}{
+			"_type": "https://in-toto.io/Statement/v0.1",
+			"subject": []interface{}{
+				map[string]interface{}{"name": "/out", "digest": map[string]interface{}{"rioFilesetSha384": outHex}},
+			},
+			"predicateType": "https://slsa.dev/provenance/v0.2",
+			"predicate": map[string]interface{}{
+				"builder":   map[string]interface{}{"id": "https://go.polydawn.net/repeatr/executor/runc"},
+				"buildType": "https://go.polydawn.net/repeatr/formula/v1",
+				"invocation": map[string]interface{}{
+					"environment": map[string]interface{}{
+						"executor":       "runc",
+						"repeatrVersion": "v1.2.3",
+						"binaries":       map[string]interface{}{"repeatr": "sha256:abc"},
+					},
+				},
+				"metadata": map[string]interface{}{
+					"buildInvocationId": "rr1",
+					"buildStartedOn":    "2010-01-01T00:00:00Z",
+					"exitCode":          float64(0),
+					"results":           map[string]interface{}{"/out": "tar:" + outHash},
+				},
+				"materials": []interface{}{
+					map[string]interface{}{"uri": "ca+https://one.example/", "path": "/", "wareID": "tar:" + rootHash, "digest": map[string]interface{}{"rioFilesetSha384": rootHex}},
+					map[string]interface{}{"uri": "ca+https://two.example/", "path": "/", "wareID": "tar:" + rootHash, "digest": map[string]interface{}{"rioFilesetSha384": rootHex}},
+					map[string]interface{}{"uri": "", "path": "/src", "wareID": "git:" + srcHash, "digest": map[string]interface{}{"gitCommit": srcHash}},
+				},
+			},
+		})
+	})
+}
+
+func TestRecordBuilder(t *testing.T) {
+	runTool := recordBuilder("ns", func(context.Context, api.Formula, repeatr.FormulaContext, repeatr.InputControl, repeatr.Monitor) (*api.FormulaRunRecord, error) {
+		return &api.FormulaRunRecord{}, nil
+	})
+	rr, err := runTool(context.Background(), api.Formula{}, repeatr.FormulaContext{}, repeatr.InputControl{}, repeatr.Monitor{})
+	AssertNoError(t, err)
+	self, err := os.Executable()
+	AssertNoError(t, err)
+	env := builderFromRecord(rr)
+	WantEqual(t, env.Executor, "ns")
+	WantEqual(t, env.RepeatrVersion, config.Version)
+	WantEqual(t, strings.HasPrefix(env.Binaries[filepath.Base(self)], "sha256:"), true)
+	WantEqual(t, env.Memoized, false)
+
+	t.Run("records which don't say who ran them should be marked memoized", func(t *testing.T) {
+		stmt := buildProvenance(api.Formula{}, repeatr.FormulaContext{}, &api.FormulaRunRecord{})
+		WantEqual(t, stmt.Predicate.Builder.ID, "https://go.polydawn.net/repeatr/memoized")
+		WantEqual(t, stmt.Predicate.Invocation.Environment, provenanceEnvironment{Memoized: true})
+	})
+}
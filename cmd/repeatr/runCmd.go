@@ -9,28 +9,41 @@ import (
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/repeatr/fmt"
-	"go.polydawn.net/repeatr/executor/impl/memo"
-	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/repeatr/executor"
 )
 
 func RunCmd(
 	ctx context.Context,
 	executorName string,
+	execCfg executor.Config,
 	formulaPath string,
 	printer repeatrfmt.Printer,
-	memoDir *fs.AbsolutePath,
+	layers runLayers,
+	provenancePath string,
 ) (err error) {
 	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
 
 	// Load formula.
-	formula, formulaCtx, err := loadFormula(formulaPath)
+	frmPlus, err := loadFormula(formulaPath)
 	if err != nil {
 		return err
 	}
+	execCfg.Job = frmPlus.Options
 
 	// Run!
-	_, err = Run(ctx, executorName, *formula, *formulaCtx, printer, memoDir)
-	return err
+	rr, err := Run(ctx, executorName, execCfg, frmPlus.Formula, frmPlus.Context, printer, layers)
+	if err != nil {
+		return err
+	}
+
+	// Emit provenance, if asked.
+	if provenancePath != "" {
+		stmt := buildProvenance(frmPlus.Formula, frmPlus.Context, rr)
+		if err := writeProvenance(provenancePath, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Run with all the I/O wiring to the terminal.
@@ -39,22 +52,23 @@ func RunCmd(
 func Run(
 	ctx context.Context,
 	executorName string,
+	execCfg executor.Config,
 	formula api.Formula,
 	formulaCtx repeatr.FormulaContext,
 	printer repeatrfmt.Printer,
-	memoDir *fs.AbsolutePath,
+	layers runLayers,
 ) (rr *api.FormulaRunRecord, err error) {
 	// Demux and initialize executor.
-	executor, err := demuxExecutor(executorName)
+	runTool, err := demuxExecutor(executorName, execCfg)
 	if err != nil {
 		return nil, err
 	}
-	// If memodir was given, decorate the executor with memoization.
-	if memoDir != nil {
-		executor, err = memo.NewExecutor(*memoDir, executor)
-		if err != nil {
-			return nil, err
-		}
+	// Decorate the executor: recording what ran the job, for provenance
+	//  (see recordBuilder); then with memoization, signing, etc, as configured.
+	runTool = recordBuilder(executorName, runTool)
+	runTool, err = layers.wrap(runTool, execCfg)
+	if err != nil {
+		return nil, err
 	}
 
 	// Prepare monitor and IO forwarding.
@@ -64,29 +78,26 @@ func Run(
 	monitorWg.Add(1)
 	go func() {
 		defer monitorWg.Done()
-		for {
-			select {
-			case evt, ok := <-evtChan:
-				if !ok {
-					return
-				}
-				switch evt2 := evt.(type) {
-				case repeatr.Event_Log:
-					printer.PrintLog(evt2)
-				case repeatr.Event_Output:
-					printer.PrintOutput(evt2)
-				case repeatr.Event_Result:
-					// pass
-				}
-			case <-ctx.Done():
-				return
+		// Keep draining until the channel is closed (after the executor
+		//  returns), even if the context is cancelled: the executor may
+		//  still be reporting on its teardown.
+		for evt := range evtChan {
+			switch evt2 := evt.(type) {
+			case repeatr.Event_Log:
+				printer.PrintLog(evt2)
+			case repeatr.Event_Output, executor.Event_StreamOutput:
+				printOutput(printer, evt2)
+			case executor.Event_Progress:
+				printProgress(printer, evt2)
+			case repeatr.Event_Result:
+				// pass
 			}
 		}
 	}()
 	inputControl := repeatr.InputControl{}
 
 	// Run!  (And wait for output forwarding worker to finish.)
-	rr, err = executor(
+	rr, err = runTool(
 		ctx,
 		formula,
 		formulaCtx,
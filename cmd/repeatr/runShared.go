@@ -6,32 +6,44 @@ import (
 	"github.com/polydawn/refmt/json"
 	"github.com/polydawn/refmt/obj/atlas"
 	. "github.com/warpfork/go-errcat"
+	"golang.org/x/crypto/ed25519"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/rio/client/exec"
+	"go.polydawn.net/repeatr/config"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/impl/chroot"
 	"go.polydawn.net/repeatr/executor/impl/gvisor"
+	"go.polydawn.net/repeatr/executor/impl/joblog"
+	"go.polydawn.net/repeatr/executor/impl/memo"
+	"go.polydawn.net/repeatr/executor/impl/ns"
 	"go.polydawn.net/repeatr/executor/impl/runc"
-	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/repeatr/executor/impl/signing"
 )
 
 type (
 	// formulaPlus is the concatenation of a formula and its context, and is
 	// useful to serialize both {the thing to do} and {what you need to do it}
 	// for sending to a repeatr process as one complete message.
+	//
+	// The options are per-job settings which the formula API has no place
+	// for yet (see executor.JobOptions); they may be omitted.
 	formulaPlus struct {
 		Formula api.Formula
 		Context repeatr.FormulaContext
+		Options executor.JobOptions
 	}
 )
 
 var (
 	formulaPlus_AtlasEntry = atlas.BuildEntry(formulaPlus{}).StructMap().Autogenerate().Complete()
+	jobOptions_AtlasEntry  = atlas.BuildEntry(executor.JobOptions{}).StructMap().Autogenerate().Complete()
 
 	atl_formulaPlus = atlas.MustBuild(
 		formulaPlus_AtlasEntry,
+		jobOptions_AtlasEntry,
 		api.Formula_AtlasEntry,
 		api.FilesetPackFilter_AtlasEntry,
 		api.FormulaAction_AtlasEntry,
@@ -42,19 +54,97 @@ var (
 	)
 )
 
-func loadFormula(formulaPath string) (*api.Formula, *repeatr.FormulaContext, error) {
+func loadFormula(formulaPath string) (*formulaPlus, error) {
 	f, err := os.Open(formulaPath)
 	if err != nil {
-		return nil, nil, Errorf(repeatr.ErrUsage, "error opening formula file: %s", err)
+		return nil, Errorf(repeatr.ErrUsage, "error opening formula file: %s", err)
 	}
 	var slot formulaPlus
 	if err := json.NewUnmarshallerAtlased(f, atl_formulaPlus).Unmarshal(&slot); err != nil {
-		return nil, nil, Errorf(repeatr.ErrUsage, "formula file does not parse: %s", err)
+		return nil, Errorf(repeatr.ErrUsage, "formula file does not parse: %s", err)
 	}
-	return &slot.Formula, &slot.Context, nil
+	return &slot, nil
 }
 
-func demuxExecutor(executorName string) (repeatr.RunFunc, error) {
+// Optional layers around the executor when running formulas.
+type runLayers struct {
+	logStore    *joblog.Store       // If set, keep job logs (and replay them for memoized runs).
+	memoStore   memo.Store          // If set, memoize.
+	signingKey  ed25519.PrivateKey  // If set, sign run records.
+	trustedKeys signing.TrustedKeys // If set, only memos signed by these keys are used.
+}
+
+// Configure the run layers from the environment (see the config package).
+func loadRunLayers() (layers runLayers, err error) {
+	logStore := joblog.NewStore(config.GetRepeatrLogPath())
+	layers.logStore = &logStore
+	layers.memoStore = memoStore()
+	if pth := config.GetRepeatrSigningKeyPath(); pth != "" {
+		layers.signingKey, err = signing.LoadKeyFile(pth)
+		if err != nil {
+			return layers, err
+		}
+	}
+	if pth := config.GetRepeatrTrustedKeysPath(); pth != "" {
+		layers.trustedKeys, err = signing.LoadTrustedKeys(pth)
+		if err != nil {
+			return layers, err
+		}
+	}
+	return layers, nil
+}
+
+// Pick the memo store for running formulas: a memo server if one is
+//  configured, else the memo dir if one is, else nil (no memoization).
+func memoStore() memo.Store {
+	if url := config.GetRepeatrMemoURL(); url != "" {
+		return memo.NewHttpStore(url, nil)
+	}
+	if memoDir := config.GetRepeatrMemoPath(); memoDir != nil {
+		return memo.NewDirStore(*memoDir)
+	}
+	return nil
+}
+
+// Wrap the executor in the run layers.  Memoization is skipped if the
+//  executor config rules it out (see executor.Config.MemoVariant).
+func (layers runLayers) wrap(runTool repeatr.RunFunc, execCfg executor.Config) (_ repeatr.RunFunc, err error) {
+	var replay func(*api.FormulaRunRecord, repeatr.Monitor) error
+	if layers.logStore != nil {
+		runTool, err = joblog.NewExecutor(*layers.logStore, runTool)
+		if err != nil {
+			return nil, err
+		}
+		replay = layers.logStore.ReplayRecord
+	}
+	if layers.signingKey != nil {
+		runTool, err = signing.NewExecutor(layers.signingKey, runTool)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if variant, ok := execCfg.MemoVariant(); ok && layers.memoStore != nil {
+		var trust func(*api.FormulaRunRecord) error
+		if layers.trustedKeys != nil {
+			trust = func(rr *api.FormulaRunRecord) error {
+				_, err := signing.Verify(rr, layers.trustedKeys)
+				return err
+			}
+		}
+		runTool, err = memo.NewExecutor(layers.memoStore, variant, trust, replay, runTool)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return runTool, nil
+}
+
+// The executors demuxExecutor knows.  This is the one list of them: the
+//  `--executor` flags offer these, and `ps` and `exec` look in each one's
+//  workspace.
+var executorNames = []string{"runc", "gvisor", "ns", "chroot"}
+
+func demuxExecutor(executorName string, execCfg executor.Config) (repeatr.RunFunc, error) {
 	// Pack and unpack tools are always the Rio exec client.
 	var (
 		unpackTool rio.UnpackFunc = rioclient.UnpackFunc
@@ -65,18 +155,27 @@ func demuxExecutor(executorName string) (repeatr.RunFunc, error) {
 	switch executorName {
 	case "chroot":
 		return chroot.NewExecutor(
-			fs.MustAbsolutePath("/var/lib/timeless/repeatr/executor/chroot/"),
+			config.GetRepeatrExecutorPath("chroot"),
 			unpackTool, packTool,
+			execCfg,
 		)
 	case "runc":
 		return runc.NewExecutor(
-			fs.MustAbsolutePath("/var/lib/timeless/repeatr/executor/runc/"),
+			config.GetRepeatrExecutorPath("runc"),
+			unpackTool, packTool,
+			execCfg,
+		)
+	case "ns":
+		return ns.NewExecutor(
+			config.GetRepeatrExecutorPath("ns"),
 			unpackTool, packTool,
+			execCfg,
 		)
 	case "gvisor":
 		return gvisor.NewExecutor(
-			fs.MustAbsolutePath("/var/lib/timeless/repeatr/executor/gvisor/"),
+			config.GetRepeatrExecutorPath("gvisor"),
 			unpackTool, packTool,
+			execCfg,
 		)
 	default:
 		return nil, Errorf(repeatr.ErrUsage, "not a known executor: %q", executorName)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"go.polydawn.net/repeatr/executor"
+)
+
+/*
+	hostTerminal is the user's terminal, when twerk is run on one.
+
+	While a job runs, it's in raw mode: keystrokes (ctrl-C included) go
+	straight through to the job's own terminal, and the job's terminal
+	does the echoing and line discipline.  Restore puts it back.
+*/
+type hostTerminal struct {
+	fd   int
+	orig unix.Termios
+}
+
+// Returns nil if the file isn't a terminal.
+func openHostTerminal(f *os.File) *hostTerminal {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil
+	}
+	return &hostTerminal{fd, *termios}
+}
+
+// Put the terminal in raw mode.  (The same settings as cfmakeraw(3).)
+func (t *hostTerminal) MakeRaw() error {
+	raw := t.orig
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(t.fd, unix.TCSETS, &raw)
+}
+
+func (t *hostTerminal) Restore() {
+	unix.IoctlSetTermios(t.fd, unix.TCSETS, &t.orig)
+}
+
+/*
+	Follow the terminal's size: the current size is sent right away, and
+	again whenever we get SIGWINCH.  Only the latest size is kept, if the
+	receiver falls behind.  Call the returned func to stop.
+*/
+func (t *hostTerminal) WatchSize() (<-chan executor.WindowSize, func()) {
+	sizes := make(chan executor.WindowSize, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	stop := make(chan struct{})
+	send := func() {
+		ws, err := unix.IoctlGetWinsize(t.fd, unix.TIOCGWINSZ)
+		if err != nil {
+			return
+		}
+		size := executor.WindowSize{Rows: ws.Row, Cols: ws.Col}
+		select {
+		case <-sizes: // Stale; replace it.
+		default:
+		}
+		sizes <- size
+	}
+	send()
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				send()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return sizes, func() {
+		signal.Stop(sigs)
+		close(stop)
+	}
+}
+
+/*
+	Picks the escape sequences out of what the user types at twerk: as in
+	ssh, they're recognized right after a newline (or at the very start),
+	and begin with a tilde.
+
+	  - "~." detaches: twerk stops the job and exits.
+	  - "~~" sends a single tilde.
+
+	A tilde followed by anything else is sent as-is.
+*/
+type escapeFilter struct {
+	midLine bool // False at the start of a line.
+	tilde   bool // Saw a tilde at the start of a line; waiting to see what's next.
+}
+
+// Filter a chunk of input.  Returns what should be sent to the job, and
+//  whether the user asked to detach (in which case the rest is dropped).
+func (f *escapeFilter) Filter(bs []byte) (out []byte, detach bool) {
+	out = make([]byte, 0, len(bs))
+	for _, b := range bs {
+		if f.tilde {
+			f.tilde = false
+			switch b {
+			case '.':
+				return out, true
+			case '~':
+				out = append(out, '~')
+				f.midLine = true
+				continue
+			default:
+				out = append(out, '~')
+			}
+		} else if !f.midLine && b == '~' {
+			f.tilde = true
+			continue
+		}
+		out = append(out, b)
+		f.midLine = b != '\r' && b != '\n'
+	}
+	return out, false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	type step struct {
+		in     string
+		out    string
+		detach bool
+	}
+	for _, tr := range []struct {
+		name  string
+		steps []step
+	}{
+		{"plain input passes through", []step{{"ls -l\r", "ls -l\r", false}}},
+		{"tilde mid-line is plain", []step{{"a~.b", "a~.b", false}}},
+		{"tilde-dot at start detaches", []step{{"~.", "", true}}},
+		{"tilde-dot after a newline detaches", []step{{"ls\r~.more", "ls\r", true}}},
+		{"tilde-tilde sends one tilde", []step{{"~~.", "~.", false}}},
+		{"tilde then other sends both", []step{{"~x", "~x", false}}},
+		{"sequence split across reads", []step{{"echo\r~", "echo\r", false}, {".", "", true}}},
+	} {
+		t.Run(tr.name, func(t *testing.T) {
+			f := escapeFilter{}
+			for _, st := range tr.steps {
+				out, detach := f.Filter([]byte(st.in))
+				WantEqual(t, string(out), st.out)
+				WantEqual(t, detach, st.detach)
+			}
+		})
+	}
+}
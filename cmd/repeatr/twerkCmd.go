@@ -4,29 +4,76 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"strings"
 	"sync"
 
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
 	. "github.com/warpfork/go-errcat"
 
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
-	"go.polydawn.net/go-timeless-api/repeatr/fmt"
+	"go.polydawn.net/repeatr/executor"
 )
 
+// Options for keeping what a twerk session built.
+type twerkCommit struct {
+	Enabled   bool
+	Paths     []string              // Paths to pack, besides the formula's outputs.
+	Warehouse api.WarehouseLocation // Where to save them, if the formula context doesn't say.
+}
+
 func Twerk(
 	ctx context.Context,
 	executorName string,
+	execCfg executor.Config,
 	formulaPath string,
+	commit twerkCommit,
 	stdin io.Reader,
 	stdout, stderr io.Writer,
 ) (err error) {
 	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
 
 	// Load formula and build executor.
-	executor, err := demuxExecutor(executorName)
+	frmPlus, err := loadFormula(formulaPath)
 	if err != nil {
 		return err
 	}
-	formula, formulaContext, err := loadFormula(formulaPath)
+	execCfg.Job = frmPlus.Options
+
+	// If committing, the session's outputs are whatever the formula says,
+	//  plus what we were asked for; they're packed when the session ends
+	//  (if it ends by exiting, rather than detaching).
+	frm, frmCtx := frmPlus.Formula, frmPlus.Context
+	if commit.Enabled {
+		if frm, frmCtx, err = commitOutputs(frm, frmCtx, commit); err != nil {
+			return err
+		}
+	}
+
+	// If we're on a terminal, the job gets one of its own, and ours goes in
+	//  raw mode: everything typed goes through to the job (ctrl-C included),
+	//  and the job's terminal follows the size of ours.
+	//  Our own messages need carriage returns while it's raw.
+	newline := "\n"
+	var term *hostTerminal
+	if f, ok := stdin.(*os.File); ok {
+		term = openHostTerminal(f)
+	}
+	if term != nil {
+		if err := term.MakeRaw(); err != nil {
+			return Errorf(repeatr.ErrUsage, "cannot put terminal in raw mode: %s", err)
+		}
+		defer term.Restore()
+		sizes, stopWatching := term.WatchSize()
+		defer stopWatching()
+		execCfg.TerminalSize = sizes
+		newline = "\r\n"
+	}
+
+	runTool, err := demuxExecutor(executorName, execCfg)
 	if err != nil {
 		return err
 	}
@@ -38,30 +85,31 @@ func Twerk(
 	monitorWg.Add(1)
 	go func() {
 		defer monitorWg.Done()
-		for {
-			select {
-			case evt, ok := <-evtChan:
-				if !ok {
-					return
-				}
-				switch evt2 := evt.(type) {
-				case repeatr.Event_Log:
-					fmt.Fprintf(stderr, "log: lvl=%s msg=%s\n", evt2.Level, evt2.Msg)
-				case repeatr.Event_Output:
-					stderr.Write([]byte(evt2.Msg))
-				case repeatr.Event_Result:
-					// pass
-				}
-			case <-ctx.Done():
-				return
+		// Keep draining until the channel is closed (after the executor
+		//  returns), even if the context is cancelled: the executor may
+		//  still be reporting on its teardown.
+		for evt := range evtChan {
+			switch evt2 := evt.(type) {
+			case repeatr.Event_Log:
+				fmt.Fprintf(stderr, "log: lvl=%s msg=%s%s", evt2.Level, evt2.Msg, newline)
+			case repeatr.Event_Output, executor.Event_StreamOutput:
+				_, out, _ := executor.OutputEvent(evt2)
+				stderr.Write([]byte(out.Msg))
+			case repeatr.Event_Result:
+				// pass
 			}
 		}
 	}()
+	// Forward input.  On a terminal, watch for the detach sequence ("~."),
+	//  which cancels the job.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	inputControl := repeatr.InputControl{}
 	if stdin != nil {
 		inputChan := make(chan string)
 		inputControl.Chan = inputChan
 		go func() {
+			escapes := escapeFilter{}
 			buf := [1024]byte{}
 			for {
 				n, err := stdin.Read(buf[:])
@@ -70,31 +118,126 @@ func Twerk(
 						close(inputChan)
 						return
 					}
-					fmt.Fprintf(stderr, "%s\n", err)
+					fmt.Fprintf(stderr, "%s%s", err, newline)
+					return
+				}
+				chunk, detach := buf[0:n], false
+				if term != nil {
+					chunk, detach = escapes.Filter(chunk)
+				}
+				if len(chunk) > 0 {
+					select {
+					case inputChan <- string(chunk):
+					case <-ctx.Done():
+						return
+					}
+				}
+				if detach {
+					fmt.Fprintf(stderr, "%s[detached; cancelling job]%s", newline, newline)
+					cancel()
 					return
 				}
-				inputChan <- string(buf[0:n])
-				// TODO Blocking.  If you want this to "DTRT" for an
-				// interactive terminal, sending those IOCTLs is something
-				// you must have done already.
 			}
 		}()
 	}
 
 	// Run!  (And wait for output forwarding worker to finish.)
-	rr, err := executor(
+	rr, err := runTool(
 		ctx,
-		*formula,
-		*formulaContext,
+		frm,
+		frmCtx,
 		inputControl,
 		monitor,
 	)
 	close(monitor.Chan)
 	monitorWg.Wait()
+	if term != nil {
+		term.Restore() // Before printing the result; it's not made for raw mode.
+	}
 
 	// If a runrecord was returned always try to print it, even if we have
 	//  an error and thus it may be incomplete.
-	repeatrfmt.NewAnsiPrinter(stdout, stderr).PrintResult(repeatr.Event_Result{rr, repeatr.ToError(err)})
+	newAnsiStreamPrinter(stdout, stderr).PrintResult(repeatr.Event_Result{rr, repeatr.ToError(err)})
+	if commit.Enabled && err == nil {
+		// Follow up with a formula that starts where the session left off.
+		for pth := range frm.Outputs {
+			if frmCtx.SaveUrls[pth] == "" {
+				fmt.Fprintf(stderr, "warning: no warehouse to save %s to; its ware was hashed, but not saved (use --warehouse)\n", pth)
+			}
+		}
+		fmt.Fprintf(stderr, "formula to continue from this session:\n")
+		next := continuationFormula(*frmPlus, frmCtx, rr)
+		enc := json.EncodeOptions{Line: []byte{'\n'}, Indent: []byte{'\t'}}
+		if err := refmt.NewMarshallerAtlased(enc, stdout, atl_formulaPlus).Marshal(next); err != nil {
+			panic(err)
+		}
+		stdout.Write([]byte{'\n'})
+	}
 	// Return the executor error.
 	return err
 }
+
+// Add the paths to commit to the formula's outputs (as tars), and
+//  the warehouse to the context, for any output without a save url.
+func commitOutputs(frm api.Formula, frmCtx repeatr.FormulaContext, commit twerkCommit) (api.Formula, repeatr.FormulaContext, error) {
+	outputs := map[api.AbsPath]api.FormulaOutputSpec{}
+	for pth, spec := range frm.Outputs {
+		outputs[pth] = spec
+	}
+	for _, pth := range commit.Paths {
+		if !path.IsAbs(pth) {
+			return frm, frmCtx, Errorf(repeatr.ErrUsage, "output path %q must be absolute", pth)
+		}
+		pth = path.Clean(pth)
+		if _, ok := outputs[api.AbsPath(pth)]; !ok {
+			outputs[api.AbsPath(pth)] = api.FormulaOutputSpec{PackType: "tar"}
+		}
+	}
+	if len(outputs) == 0 {
+		return frm, frmCtx, Errorf(repeatr.ErrUsage, "nothing to commit: give --output paths, or use a formula with outputs")
+	}
+	frm.Outputs = outputs
+	if commit.Warehouse != "" {
+		frmCtx = withDefaultSaveUrls(frm, frmCtx, commit.Warehouse)
+	}
+	return frm, frmCtx, nil
+}
+
+/*
+	Make a formula which picks up where a committed session left off:
+	the original, but with each committed ware as an input at its path.
+
+	Inputs which were at or under a committed path are dropped,
+	since the committed ware already contains whatever they put there.
+	The committed wares are fetched from where they were saved.
+*/
+func continuationFormula(orig formulaPlus, frmCtx repeatr.FormulaContext, rr *api.FormulaRunRecord) formulaPlus {
+	next := orig
+	next.Formula.Inputs = map[api.AbsPath]api.WareID{}
+	next.Context.FetchUrls = map[api.AbsPath][]api.WarehouseLocation{}
+	for pth, wareID := range orig.Formula.Inputs {
+		if !underAny(pth, rr.Results) {
+			next.Formula.Inputs[pth] = wareID
+			if urls, ok := orig.Context.FetchUrls[pth]; ok {
+				next.Context.FetchUrls[pth] = urls
+			}
+		}
+	}
+	for pth, wareID := range rr.Results {
+		next.Formula.Inputs[pth] = wareID
+		if url := frmCtx.SaveUrls[pth]; url != "" {
+			next.Context.FetchUrls[pth] = []api.WarehouseLocation{url}
+		}
+	}
+	return next
+}
+
+// Is the path at or under any of the paths in the map?
+func underAny(pth api.AbsPath, paths map[api.AbsPath]api.WareID) bool {
+	for parent := range paths {
+		if pth == parent || parent == "/" || strings.HasPrefix(string(pth), string(parent)+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestCommitOutputs(t *testing.T) {
+	frm := api.Formula{Outputs: map[api.AbsPath]api.FormulaOutputSpec{
+		"/out": {PackType: "tar"},
+	}}
+	t.Run("paths should be added to the formula's outputs", func(t *testing.T) {
+		frm2, frmCtx, err := commitOutputs(frm, repeatr.FormulaContext{}, twerkCommit{true, []string{"/work/"}, "ca+file:///wh"})
+		AssertNoError(t, err)
+		WantEqual(t, len(frm2.Outputs), 2)
+		WantEqual(t, frm2.Outputs["/work"], api.FormulaOutputSpec{PackType: "tar"})
+		WantEqual(t, frmCtx.SaveUrls["/out"], api.WarehouseLocation("ca+file:///wh"))
+		WantEqual(t, len(frm.Outputs), 1)
+	})
+	t.Run("relative paths should be rejected", func(t *testing.T) {
+		_, _, err := commitOutputs(frm, repeatr.FormulaContext{}, twerkCommit{true, []string{"work"}, ""})
+		WantEqual(t, Category(err), repeatr.ErrUsage)
+	})
+	t.Run("no outputs at all should be rejected", func(t *testing.T) {
+		_, _, err := commitOutputs(api.Formula{}, repeatr.FormulaContext{}, twerkCommit{true, nil, ""})
+		WantEqual(t, Category(err), repeatr.ErrUsage)
+	})
+}
+
+func TestContinuationFormula(t *testing.T) {
+	orig := formulaPlus{
+		Formula: api.Formula{Inputs: map[api.AbsPath]api.WareID{
+			"/":        {"tar", "base"},
+			"/src":     {"git", "src"},
+			"/src/sub": {"tar", "sub"},
+			"/tools":   {"tar", "tools"},
+		}},
+		Context: repeatr.FormulaContext{FetchUrls: map[api.AbsPath][]api.WarehouseLocation{
+			"/tools": {"https://example.com/tools"},
+		}},
+	}
+	rr := &api.FormulaRunRecord{Results: map[api.AbsPath]api.WareID{
+		"/src": {"tar", "built"},
+	}}
+	frmCtx := repeatr.FormulaContext{SaveUrls: map[api.AbsPath]api.WarehouseLocation{
+		"/src": "ca+file:///wh",
+	}}
+	next := continuationFormula(orig, frmCtx, rr)
+	WantEqual(t, next.Formula.Inputs, map[api.AbsPath]api.WareID{
+		"/":      {"tar", "base"},
+		"/src":   {"tar", "built"},
+		"/tools": {"tar", "tools"},
+	})
+	WantEqual(t, next.Context.FetchUrls, map[api.AbsPath][]api.WarehouseLocation{
+		"/src":   {"ca+file:///wh"},
+		"/tools": {"https://example.com/tools"},
+	})
+	WantEqual(t, len(orig.Formula.Inputs), 4)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor/impl/signing"
+)
+
+/*
+	Generate a key for signing run records, and print its public key
+	(which is what goes in other hosts' trusted keys files).
+*/
+func KeygenCmd(keyPath string, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	pub, err := signing.GenerateKeyFile(keyPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\n", pub)
+	return nil
+}
+
+/*
+	Check the run record in a file is signed by a trusted key.
+	The record is plain json, as in a memo dir.
+*/
+func VerifyCmd(recordPath string, trustedKeysPath string, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	if trustedKeysPath == "" {
+		return Errorf(repeatr.ErrUsage, "no trusted keys file given (use --trusted-keys or set REPEATR_TRUSTED_KEYS)")
+	}
+	trusted, err := signing.LoadTrustedKeys(trustedKeysPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(recordPath)
+	if err != nil {
+		return Errorf(repeatr.ErrUsage, "error opening run record file: %s", err)
+	}
+	defer f.Close()
+	rr := &api.FormulaRunRecord{}
+	if err := json.NewUnmarshallerAtlased(f, api.Atlas_FormulaRunRecord).Unmarshal(rr); err != nil {
+		return Errorf(repeatr.ErrUsage, "run record file does not parse: %s", err)
+	}
+	name, err := signing.Verify(rr, trusted)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case format_Json:
+		return emitJson(stdout, atl_verifyResult, verifyResult{rr.Guid, rr.FormulaID, name})
+	default:
+		fmt.Fprintf(stdout, "run record %s (setupHash %s) is signed by trusted key %q\n", rr.Guid, rr.FormulaID, name)
+		return nil
+	}
+}
+
+type verifyResult struct {
+	Guid      string
+	FormulaID api.FormulaSetupHash
+	SignedBy  string
+}
+
+var (
+	verifyResult_AtlasEntry = atlas.BuildEntry(verifyResult{}).StructMap().Autogenerate().Complete()
+	atl_verifyResult        = atlas.MustBuild(verifyResult_AtlasEntry)
+)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor/mixins"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Remove job work dirs which aren't in use: those kept for inspection
+	(see `--keep-workspace`), and those left behind by crashed runs.
+*/
+func WorkspacePruneCmd(workspaceDirs []fs.AbsolutePath, olderThan time.Duration, format format, stdout io.Writer) (err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	pruned := []string{}
+	for _, dir := range workspaceDirs {
+		more, err := mixins.PruneWorkDirs(dir, olderThan)
+		pruned = append(pruned, more...)
+		if err != nil {
+			emitPruned(stdout, format, pruned)
+			return err
+		}
+	}
+	return emitPruned(stdout, format, pruned)
+}
+
+func emitPruned(stdout io.Writer, format format, paths []string) error {
+	switch format {
+	case format_Json:
+		return emitJson(stdout, atl_hashList, paths)
+	default:
+		if len(paths) == 0 {
+			fmt.Fprintf(stdout, "no workspaces removed\n")
+		}
+		for _, pth := range paths {
+			fmt.Fprintf(stdout, "removed %s\n", pth)
+		}
+		return nil
+	}
+}
@@ -7,6 +7,12 @@ import (
 	"go.polydawn.net/rio/fs"
 )
 
+/*
+	The version of repeatr, as stamped in at build time
+	(by `-ldflags "-X go.polydawn.net/repeatr/config.Version=..."`).
+*/
+var Version = "dev"
+
 /*
 	Return the path to a dir that will be used to read memoization of
 	previous runs -- enabling short-circuit returns if they're encountered
@@ -27,3 +33,88 @@ func GetRepeatrMemoPath() *fs.AbsolutePath {
 	memoDir := fs.MustAbsolutePath(pth)
 	return &memoDir
 }
+
+/*
+	Return the URL of a memo server (see `repeatr memo serve`) to use for
+	memoization instead of a local memo dir, so memos can be shared
+	between machines.
+
+	The default value is empty -- no memo server -- and this can be set
+	by the `REPEATR_MEMOURL` environment variable.  If it's set, it takes
+	precedence over `REPEATR_MEMODIR` for running formulas.
+
+	Memos from a server are only as trustworthy as everyone who can save
+	to it: unless that's only trusted machines, set `REPEATR_TRUSTED_KEYS`
+	too, so only memos signed by keys you trust are used.
+*/
+func GetRepeatrMemoURL() string {
+	return os.Getenv("REPEATR_MEMOURL")
+}
+
+/*
+	Return the path to this host's key for signing run records
+	(see `repeatr keygen`).
+
+	The default value is empty -- records aren't signed -- and this can be
+	set by the `REPEATR_SIGNING_KEY` environment variable.
+*/
+func GetRepeatrSigningKeyPath() string {
+	return os.Getenv("REPEATR_SIGNING_KEY")
+}
+
+/*
+	Return the path to a trusted keys file, listing the keys whose signed
+	run records we trust.  If set, memoized run records are only used
+	if they're signed by one of these keys.
+
+	The default value is empty, and this can be set by the
+	`REPEATR_TRUSTED_KEYS` environment variable.
+*/
+func GetRepeatrTrustedKeysPath() string {
+	return os.Getenv("REPEATR_TRUSTED_KEYS")
+}
+
+/*
+	Return the path to the dir an executor should make its workspaces in.
+
+	When running as root, this is under "/var/lib/timeless/repeatr/".
+	Otherwise (in rootless mode), we can't write there, so it's under the
+	user's data dir: `$XDG_DATA_HOME`, or "~/.local/share", as usual.
+*/
+func GetRepeatrExecutorPath(executorName string) fs.AbsolutePath {
+	return dataPath("executor", executorName)
+}
+
+/*
+	Return the path to the dir job logs are kept in (see `repeatr logs`).
+
+	This can be set by the `REPEATR_LOGDIR` environment variable; by default
+	it's beside the executor dirs (see GetRepeatrExecutorPath).
+*/
+func GetRepeatrLogPath() fs.AbsolutePath {
+	if pth := os.Getenv("REPEATR_LOGDIR"); pth != "" {
+		pth, err := filepath.Abs(pth)
+		if err != nil {
+			panic(err)
+		}
+		return fs.MustAbsolutePath(pth)
+	}
+	return dataPath("logs")
+}
+
+// A path in repeatr's data dir: "/var/lib/timeless/repeatr/" when root,
+//  otherwise under the user's data dir.
+func dataPath(parts ...string) fs.AbsolutePath {
+	if os.Geteuid() == 0 {
+		return fs.MustAbsolutePath(filepath.Join(append([]string{"/var/lib/timeless/repeatr"}, parts...)...))
+	}
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		dataDir = filepath.Join(os.Getenv("HOME"), ".local/share")
+	}
+	pth, err := filepath.Abs(filepath.Join(append([]string{dataDir, "timeless/repeatr"}, parts...)...))
+	if err != nil {
+		panic(err)
+	}
+	return fs.MustAbsolutePath(pth)
+}
@@ -58,6 +58,7 @@ func runTestcase(t *testing.T, tc testcase) {
 		actual := strings.Split(stderrBuf.String(), "\n")
 		actual = paveAnsicolors(actual)
 		actual = paveLogtimes(actual)
+		actual = paveRunStats(actual)
 		if os.Getenv("REFRESH_FIXTURES") != "" {
 			expected = actual
 			tc.hunks.PutSection("stderr", []byte(strings.Join(expected, "\n")))
@@ -73,6 +74,7 @@ func TestAll(t *testing.T) {
 	t.Run("group1", func(t *testing.T) {
 		WithTmpdir(func(tmpDir fs.AbsolutePath) {
 			os.Setenv("RIO_BASE", tmpDir.String())
+			os.Setenv("REPEATR_LOGDIR", tmpDir.String()+"/logs")
 			runTestcase(t, loadTestcase("hello-uncached.tcase"))
 			runTestcase(t, loadTestcase("hello-cached.tcase"))
 		})
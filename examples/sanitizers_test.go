@@ -36,5 +36,36 @@ func paveRunrecords(raw []string) (clean []string) {
 	for i := range clean {
 		clean[i] = matcher.ReplaceAllString(clean[i], `"hostname": "znn.xxxxx.yyy"`)
 	}
+	// Timings and usage vary run to run, and so does the job log's hash
+	//  (the log has timestamps); the builder's version and binaries vary
+	//  build to build.
+	matcher = regexp.MustCompile(`"((?:phase|rusage|builder\.binary)\.[a-zA-Z.-]+|log\.sha256|builder\.repeatrVersion)": "[^"]*"`)
+	for i := range clean {
+		clean[i] = matcher.ReplaceAllString(clean[i], `"$1": "xxx"`)
+	}
+	// Cgroup stats only appear if the job lived long enough to be sampled;
+	//  drop them entirely.
+	matcher = regexp.MustCompile(`"cgroup\.[a-z.]+": `)
+	kept := clean[:0]
+	for _, line := range clean {
+		if !matcher.MatchString(line) {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// The table of run stats after the run record (see printRunStats): values
+//  vary, and so do the column widths, with them.  Cgroup stats only appear
+//  if the job lived long enough to be sampled; drop them entirely.
+func paveRunStats(raw []string) (clean []string) {
+	matcher := regexp.MustCompile(`^(\s+)((?:phase|rusage)\.[a-z.]+)\s+\S.*$`)
+	cgroupMatcher := regexp.MustCompile(`^\s+cgroup\.[a-z.]+\s`)
+	for _, line := range raw {
+		if cgroupMatcher.MatchString(line) {
+			continue
+		}
+		clean = append(clean, matcher.ReplaceAllString(line, "$1$2  xxx"))
+	}
 	return
 }
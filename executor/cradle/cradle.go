@@ -8,6 +8,7 @@ import (
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fsOp"
 )
@@ -93,18 +94,22 @@ func FormulaDefaults(frm api.Formula) api.Formula {
 }
 func ptrint(i int) *int { return &i }
 
-func TidyFilesystem(frm api.Formula, chrootFs fs.FS) error {
+// Make the cwd, homedir, and tmp ready for use, and write /etc files
+// describing the user and host (see writeEtcFiles).
+// Dirprops gives the ownership for the dirs we make usable: typically
+// from DirpropsForUserinfo, but a rootless executor will need something else.
+func TidyFilesystem(frm api.Formula, chrootFs fs.FS, dirprops fs.Metadata, hostname string, opts executor.JobOptions) error {
 	switch frm.Action.Cradle {
 	case "disable":
 		return nil
 	default:
 	}
 	// Foist usable bits onto cwd and parents.
-	if err := fsOp.MkdirUsable(chrootFs, fs.MustAbsolutePath(string(frm.Action.Cwd)).CoerceRelative(), DirpropsForUserinfo(*frm.Action.Userinfo)); err != nil {
+	if err := fsOp.MkdirUsable(chrootFs, fs.MustAbsolutePath(string(frm.Action.Cwd)).CoerceRelative(), dirprops); err != nil {
 		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (cwd): %s", err)
 	}
 	// Foist usable bits onto homedir and parents.
-	if err := fsOp.MkdirUsable(chrootFs, fs.MustAbsolutePath(string(frm.Action.Userinfo.Homedir)).CoerceRelative(), DirpropsForUserinfo(*frm.Action.Userinfo)); err != nil {
+	if err := fsOp.MkdirUsable(chrootFs, fs.MustAbsolutePath(string(frm.Action.Userinfo.Homedir)).CoerceRelative(), dirprops); err != nil {
 		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (homedir): %s", err)
 	}
 	// Force standard tempdir bits onto /tmp.
@@ -117,13 +122,16 @@ func TidyFilesystem(frm api.Formula, chrootFs fs.FS) error {
 	if err := chrootFs.Chmod(tmpPath, 01777); err != nil {
 		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (tmp): %s", err)
 	}
-	return nil
+	// Make the user and hostname known in /etc.
+	return writeEtcFiles(frm, chrootFs, hostname, opts)
 }
 
-func DirpropsForUserinfo(userinfo api.FormulaUserinfo) fs.Metadata {
+// The props for dirs we make for the user: owned by them, and with
+// the permissions their umask would give.
+func DirpropsForUserinfo(userinfo api.FormulaUserinfo, umask uint32) fs.Metadata {
 	return fs.Metadata{
 		Type:  fs.Type_Dir,
-		Perms: 0755,
+		Perms: fs.Perms(0777 &^ umask),
 		Uid:   uint32(*userinfo.Uid),
 		Gid:   uint32(*userinfo.Gid),
 		Mtime: time.Unix(api.DefaultTime, 0),
@@ -0,0 +1,80 @@
+package cradle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/repeatr/executor"
+)
+
+/*
+	Apply deterministic mode to a formula, if the config asks for it.
+
+	Deterministic mode takes away the common sources of variation which
+	aren't the formula's business, so that the usual build tools produce
+	bit-identical outputs without every formula pinning these by hand:
+
+	  - SOURCE_DATE_EPOCH is set to the standard mtime (unless the formula
+	    sets it itself), as honored by most tools which embed timestamps
+	    (https://reproducible-builds.org/specs/source-date-epoch/);
+	  - the hostname is derived from the formula's setupHash, rather than
+	    the job ID (see Hostname);
+	  - executors which can start the job in a time namespace do so, with
+	    the monotonic and boottime clocks offset to start from zero
+	    (see ClockOffsets).  The realtime clock can't be namespaced;
+	    SOURCE_DATE_EPOCH is the best we can do for that.
+
+	Executors apply this via mixins.InitJob, after the run record is
+	initialized, so the setupHash is that of the formula as given.
+*/
+func ApplyDeterminism(frm api.Formula, config executor.Config) api.Formula {
+	if !config.Deterministic {
+		return frm
+	}
+	if _, exists := frm.Action.Env["SOURCE_DATE_EPOCH"]; exists {
+		return frm
+	}
+	env := make(map[string]string, len(frm.Action.Env)+1)
+	for k, v := range frm.Action.Env {
+		env[k] = v
+	}
+	env["SOURCE_DATE_EPOCH"] = strconv.FormatInt(api.DefaultTime, 10)
+	frm.Action.Env = env
+	return frm
+}
+
+// The hostname for deterministic mode: a digest of the setupHash, so it's
+//  stable across runs of the same formula, and always a valid hostname.
+func deterministicHostname(setupHash api.FormulaSetupHash) string {
+	sum := sha256.Sum256([]byte(setupHash))
+	return "job-" + hex.EncodeToString(sum[:6])
+}
+
+/*
+	ClockOffsets returns the offsets for a time namespace which make the
+	monotonic and boottime clocks start from zero, as for deterministic mode.
+	(More precisely, from the fraction of a second they're past the whole
+	second now; offsets are in whole seconds, to keep it simple.)
+
+	Returns false if the kernel doesn't support time namespaces.
+*/
+func ClockOffsets() (monotonic, boottime int64, ok bool) {
+	if _, err := os.Stat("/proc/self/ns/time"); err != nil {
+		return 0, 0, false
+	}
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, 0, false
+	}
+	monotonic = -ts.Sec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return 0, 0, false
+	}
+	boottime = -ts.Sec
+	return monotonic, boottime, true
+}
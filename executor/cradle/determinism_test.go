@@ -0,0 +1,34 @@
+package cradle
+
+import (
+	"testing"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestDeterminism(t *testing.T) {
+	frm := api.Formula{Action: api.FormulaAction{Env: map[string]string{"FOO": "bar"}}}
+	rr := &api.FormulaRunRecord{Guid: "guid1", FormulaID: "setupHash1"}
+	t.Run("off by default", func(t *testing.T) {
+		WantEqual(t, ApplyDeterminism(frm, executor.Config{}).Action.Env, map[string]string{"FOO": "bar"})
+		WantEqual(t, Hostname(frm.Action, rr, executor.Config{}), "guid1")
+	})
+	t.Run("sets SOURCE_DATE_EPOCH without mutating the formula", func(t *testing.T) {
+		got := ApplyDeterminism(frm, executor.Config{Deterministic: true})
+		WantEqual(t, got.Action.Env, map[string]string{"FOO": "bar", "SOURCE_DATE_EPOCH": "1262304000"})
+		WantEqual(t, frm.Action.Env, map[string]string{"FOO": "bar"})
+	})
+	t.Run("keeps a SOURCE_DATE_EPOCH the formula sets", func(t *testing.T) {
+		frm := api.Formula{Action: api.FormulaAction{Env: map[string]string{"SOURCE_DATE_EPOCH": "1"}}}
+		WantEqual(t, ApplyDeterminism(frm, executor.Config{Deterministic: true}).Action.Env, map[string]string{"SOURCE_DATE_EPOCH": "1"})
+	})
+	t.Run("hostname derives from setupHash", func(t *testing.T) {
+		cfg := executor.Config{Deterministic: true}
+		hostname := Hostname(frm.Action, rr, cfg)
+		WantEqual(t, len(hostname), len("job-")+12)
+		WantEqual(t, Hostname(frm.Action, &api.FormulaRunRecord{Guid: "guid2", FormulaID: "setupHash1"}, cfg), hostname)
+		WantEqual(t, Hostname(api.FormulaAction{Hostname: "given"}, rr, cfg), "given")
+	})
+}
@@ -0,0 +1,250 @@
+package cradle
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fsOp"
+)
+
+// The hostname a job sees: as the formula asks; or else, in deterministic
+//  mode, one derived from the formula's setupHash; or else the job ID.
+func Hostname(action api.FormulaAction, rr *api.FormulaRunRecord, config executor.Config) string {
+	if action.Hostname != "" {
+		return action.Hostname
+	}
+	if config.Deterministic {
+		return deterministicHostname(rr.FormulaID)
+	}
+	return rr.Guid
+}
+
+/*
+	Write the /etc files which make the job's userinfo and hostname real:
+	we upsert the user into /etc/passwd, and their group (and membership of
+	any supplementary groups) into /etc/group, and write a minimal /etc/hosts.
+	If the job shares the host network, it gets a copy of the host's
+	/etc/resolv.conf as well (otherwise there's no DNS to be had, and we
+	leave it alone).
+
+	Edits are idempotent, and every file we touch gets the standard mtime,
+	so the results are as deterministic as the inputs.
+*/
+func writeEtcFiles(frm api.Formula, chrootFs fs.FS, hostname string, opts executor.JobOptions) error {
+	etcPath := fs.MustRelPath("etc")
+	if stat, err := chrootFs.LStat(etcPath); err == nil && stat.Type != fs.Type_Dir {
+		// Don't follow a symlink out of the rootfs!
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (etc): /etc is a %s, must be dir", stat.Type)
+	}
+	defer fsOp.RepairMtime(chrootFs, etcPath)()
+	if err := fsOp.MkdirAll(chrootFs, etcPath, 0755); err != nil {
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (etc): %s", err)
+	}
+
+	userinfo := *frm.Action.Userinfo
+	if err := editEtcFile(chrootFs, "passwd", func(content []byte) []byte {
+		return upsertPasswd(content, userinfo)
+	}); err != nil {
+		return err
+	}
+	if err := editEtcFile(chrootFs, "group", func(content []byte) []byte {
+		content = upsertGroup(content, *userinfo.Gid, userinfo.Username, "")
+		for _, gid := range opts.Groups {
+			content = upsertGroup(content, gid, "", userinfo.Username)
+		}
+		return content
+	}); err != nil {
+		return err
+	}
+	if err := editEtcFile(chrootFs, "hosts", func([]byte) []byte {
+		return templateHosts(hostname)
+	}); err != nil {
+		return err
+	}
+	if opts.Network == executor.Network_Host {
+		hostResolv, err := ioutil.ReadFile("/etc/resolv.conf")
+		if err != nil && !os.IsNotExist(err) {
+			return Errorf(repeatr.ErrExecutor, "failed building cradle fs (resolv.conf): %s", err)
+		}
+		if err := editEtcFile(chrootFs, "resolv.conf", func([]byte) []byte {
+			return hostResolv
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read a file in /etc (if it exists), rewrite it with the edit func,
+//  and reset its mtime.  Refuses to touch anything but a regular file.
+func editEtcFile(chrootFs fs.FS, name string, edit func([]byte) []byte) error {
+	pth := fs.MustRelPath("etc/" + name)
+	var content []byte
+	stat, err := chrootFs.LStat(pth)
+	switch {
+	case err == nil && stat.Type != fs.Type_File:
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): /etc/%s is a %s, must be file", name, name, stat.Type)
+	case err == nil:
+		f, err := chrootFs.OpenFile(pth, fs.O_RDONLY, 0)
+		if err != nil {
+			return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): %s", name, err)
+		}
+		content, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): %s", name, err)
+		}
+	case fs.IsNotExist(err):
+		// Fine; we'll make it.
+	default:
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): %s", name, err)
+	}
+	f, err := chrootFs.OpenFile(pth, fs.O_WRONLY|fs.O_CREATE|fs.O_TRUNC, 0644)
+	if err != nil {
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): %s", name, err)
+	}
+	_, err = f.Write(edit(content))
+	f.Close()
+	if err != nil {
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): %s", name, err)
+	}
+	mtime := time.Unix(api.DefaultTime, 0)
+	if err := chrootFs.SetTimesNano(pth, mtime, mtime); err != nil {
+		return Errorf(repeatr.ErrJobInvalid, "failed building cradle fs (%s): %s", name, err)
+	}
+	return nil
+}
+
+/*
+	Upsert the user into the content of an /etc/passwd file.
+
+	An existing entry with the same uid is replaced (in place, so the file
+	order is stable); failing that, one with the same name.  We keep the
+	comment (GECOS) field and login shell of the entry we replace, if any;
+	otherwise they're empty and "/bin/sh".
+
+	Other users' entries are never dropped.  If someone else has the name,
+	ahead of the entry we replace, ours is moved up to just before theirs,
+	so lookups by name find us first.
+*/
+func upsertPasswd(content []byte, userinfo api.FormulaUserinfo) []byte {
+	uid := strconv.Itoa(*userinfo.Uid)
+	lines := splitLines(content)
+	uidAt, nameAt := -1, -1
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 {
+			continue
+		}
+		if fields[2] == uid && uidAt < 0 {
+			uidAt = i
+		}
+		if fields[0] == userinfo.Username && nameAt < 0 {
+			nameAt = i
+		}
+	}
+	at := uidAt
+	if at < 0 {
+		at = nameAt
+	}
+	gecos, shell := "", "/bin/sh"
+	if at >= 0 {
+		fields := strings.Split(lines[at], ":")
+		gecos = fields[4]
+		if fields[6] != "" {
+			shell = fields[6]
+		}
+	}
+	entry := fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", userinfo.Username, *userinfo.Uid, *userinfo.Gid, gecos, userinfo.Homedir, shell)
+	switch {
+	case at < 0:
+		lines = append(lines, entry)
+	case nameAt >= 0 && nameAt < at:
+		moved := make([]string, 0, len(lines))
+		moved = append(moved, lines[:nameAt]...)
+		moved = append(moved, entry)
+		moved = append(moved, lines[nameAt:at]...)
+		lines = append(moved, lines[at+1:]...)
+	default:
+		lines[at] = entry
+	}
+	return joinLines(lines)
+}
+
+/*
+	Make sure the content of an /etc/group file has a group with the gid;
+	and, if member is given, that they're a member of it.
+
+	An existing group with the gid is kept, name and all.  Otherwise a group
+	is added, named as suggested, unless that name is already taken, in which
+	case it's named for its number instead.
+*/
+func upsertGroup(content []byte, gid int, name string, member string) []byte {
+	gidStr := strconv.Itoa(gid)
+	lines := splitLines(content)
+	nameTaken := false
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) != 4 {
+			continue
+		}
+		if fields[2] == gidStr {
+			if member != "" && !containsString(strings.Split(fields[3], ","), member) {
+				if fields[3] != "" {
+					fields[3] += ","
+				}
+				fields[3] += member
+				lines[i] = strings.Join(fields, ":")
+			}
+			return joinLines(lines)
+		}
+		if fields[0] == name {
+			nameTaken = true
+		}
+	}
+	if name == "" || nameTaken {
+		name = "g" + gidStr
+	}
+	return joinLines(append(lines, fmt.Sprintf("%s:x:%d:%s", name, gid, member)))
+}
+
+func templateHosts(hostname string) []byte {
+	return []byte("" +
+		"127.0.0.1\tlocalhost\n" +
+		"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+		"127.0.1.1\t" + hostname + "\n",
+	)
+}
+
+// Split content into lines, dropping a trailing newline (but not blank lines otherwise).
+func splitLines(content []byte) []string {
+	content = bytes.TrimSuffix(content, []byte{'\n'})
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(string(content), "\n")
+}
+
+func joinLines(lines []string) []byte {
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
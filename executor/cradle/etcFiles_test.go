@@ -0,0 +1,89 @@
+package cradle
+
+import (
+	"testing"
+
+	"go.polydawn.net/go-timeless-api"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestUpsertPasswd(t *testing.T) {
+	reuser := api.FormulaUserinfo{Uid: ptrint(1000), Gid: ptrint(1000), Username: "reuser", Homedir: "/home/reuser"}
+	root := api.FormulaUserinfo{Uid: ptrint(0), Gid: ptrint(0), Username: "root", Homedir: "/root"}
+	for _, tr := range []struct {
+		title    string
+		content  string
+		userinfo api.FormulaUserinfo
+		want     string
+	}{
+		{"empty file",
+			"",
+			reuser,
+			"reuser:x:1000:1000::/home/reuser:/bin/sh\n"},
+		{"append",
+			"root:x:0:0:root:/root:/bin/bash\n",
+			reuser,
+			"root:x:0:0:root:/root:/bin/bash\nreuser:x:1000:1000::/home/reuser:/bin/sh\n"},
+		{"replace in place, keeping comment and shell",
+			"root:x:0:0:root:/home/other:/bin/bash\ndaemon:x:1:1::/:/bin/false\n",
+			root,
+			"root:x:0:0:root:/root:/bin/bash\ndaemon:x:1:1::/:/bin/false\n"},
+		{"replace by name, if no uid matches",
+			"daemon:x:1:1::/:/bin/false\nreuser:x:1001:1001:Re User:/x:/bin/bash\n",
+			reuser,
+			"daemon:x:1:1::/:/bin/false\nreuser:x:1000:1000:Re User:/home/reuser:/bin/bash\n"},
+		{"replace by uid, keeping the user with the name after it",
+			"ubuntu:x:1000:1000::/home/ubuntu:/bin/bash\nreuser:x:1001:1001::/x:/bin/sh\n",
+			reuser,
+			"reuser:x:1000:1000::/home/reuser:/bin/bash\nreuser:x:1001:1001::/x:/bin/sh\n"},
+		{"replace by uid, moving ahead of the user with the name",
+			"root:x:0:0:root:/root:/bin/bash\nreuser:x:1001:1001:Re User:/x:/bin/sh\ndaemon:x:1:1::/:/bin/false\nubuntu:x:1000:1000:Ubuntu:/home/ubuntu:/bin/bash\nnobody:x:65534:65534::/:/bin/false\n",
+			reuser,
+			"root:x:0:0:root:/root:/bin/bash\nreuser:x:1000:1000:Ubuntu:/home/reuser:/bin/bash\nreuser:x:1001:1001:Re User:/x:/bin/sh\ndaemon:x:1:1::/:/bin/false\nnobody:x:65534:65534::/:/bin/false\n"},
+	} {
+		t.Run(tr.title, func(t *testing.T) {
+			got := upsertPasswd([]byte(tr.content), tr.userinfo)
+			WantEqual(t, string(got), tr.want)
+			// And again: should be idempotent.
+			WantEqual(t, string(upsertPasswd(got, tr.userinfo)), tr.want)
+		})
+	}
+}
+
+func TestUpsertGroup(t *testing.T) {
+	for _, tr := range []struct {
+		title   string
+		content string
+		gid     int
+		name    string
+		member  string
+		want    string
+	}{
+		{"append",
+			"root:x:0:\n",
+			1000, "reuser", "",
+			"root:x:0:\nreuser:x:1000:\n"},
+		{"existing gid kept",
+			"root:x:0:\nusers:x:1000:\n",
+			1000, "reuser", "",
+			"root:x:0:\nusers:x:1000:\n"},
+		{"name taken",
+			"reuser:x:5:\n",
+			1000, "reuser", "",
+			"reuser:x:5:\ng1000:x:1000:\n"},
+		{"add member",
+			"audio:x:29:alice\n",
+			29, "", "reuser",
+			"audio:x:29:alice,reuser\n"},
+		{"add group with member",
+			"",
+			29, "", "reuser",
+			"g29:x:29:reuser\n"},
+	} {
+		t.Run(tr.title, func(t *testing.T) {
+			got := upsertGroup([]byte(tr.content), tr.gid, tr.name, tr.member)
+			WantEqual(t, string(got), tr.want)
+			WantEqual(t, string(upsertGroup(got, tr.gid, tr.name, tr.member)), tr.want)
+		})
+	}
+}
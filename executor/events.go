@@ -0,0 +1,73 @@
+package executor
+
+import (
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+/*
+	Event_StreamOutput is output from a job, tagged with the stream it was
+	written to.  Executors send these on the monitor channel in place of
+	a plain `repeatr.Event_Output`.
+
+	The timeless api has no field for the stream (yet), so we embed its
+	event: this is still a `repeatr.Event`, and consumers which don't care
+	about streams can unwrap it.
+*/
+type Event_StreamOutput struct {
+	repeatr.Event_Output
+	Stream Stream
+}
+
+type Stream string
+
+const (
+	Stream_Stdout Stream = "stdout" // Also used for everything when the job has a tty, since then the streams are one.
+	Stream_Stderr Stream = "stderr"
+)
+
+// Reduce any output event to its stream and plain event.
+//  Untagged output is counted as stdout.
+//  Returns false if the event isn't output at all.
+func OutputEvent(evt repeatr.Event) (Stream, repeatr.Event_Output, bool) {
+	switch evt2 := evt.(type) {
+	case Event_StreamOutput:
+		return evt2.Stream, evt2.Event_Output, true
+	case repeatr.Event_Output:
+		return Stream_Stdout, evt2, true
+	default:
+		return "", repeatr.Event_Output{}, false
+	}
+}
+
+/*
+	Event_Progress reports how far along moving a ware into or out of the
+	job's filesystem is: unpacking an input, or packing an output.
+	(See mixins.ForwardRioUnpackLogs and mixins.ForwardRioPackLogs,
+	which relay these from rio.)
+
+	As with Event_StreamOutput, the timeless api has no such event, so we
+	embed one it does have: a log event.  Its message names the ware
+	(e.g. "unpack /src"), and is the same for every event about that ware;
+	its detail has the numbers.
+*/
+type Event_Progress struct {
+	repeatr.Event_Log
+	Phase     Phase       // Whether the ware is being unpacked or packed.
+	Path      api.AbsPath // Where the ware is in the job's filesystem.
+	Desc      string      // What rio is doing at the moment (e.g. fetching, or hashing).
+	TotalProg int         // Progress so far, out of TotalWork...
+	TotalWork int         // ... or zero, if rio doesn't know how much there is.
+}
+
+type Phase string
+
+const (
+	Phase_Unpack Phase = "unpack"
+	Phase_Pack   Phase = "pack"
+)
+
+// Returns true if the event says the work is complete.
+func (evt Event_Progress) Done() bool {
+	return evt.TotalWork > 0 && evt.TotalProg >= evt.TotalWork
+}
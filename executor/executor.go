@@ -1,5 +1,202 @@
 package executor
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
 type Interface interface {
 	// todo placeholder
 }
+
+/*
+	Config holds settings for an executor which are chosen by whoever
+	operates the host, rather than declared by the formula.
+
+	The zero value is valid, and means no special treatment.
+	Executors which can't honor some setting should refuse it
+	(with an `ErrUsage`) rather than silently ignore it.
+*/
+type Config struct {
+	Limits        Limits       // Resource constraints to apply to each job.
+	Output        OutputLimits // How much of each job's output to capture.
+	Rootless      bool         // If true, we're not root: jobs must run in a user namespace, mapped onto our subordinate ids.
+	Deterministic bool         // If true, pin the job's view of the clock and host identity.  (See cradle.ApplyDeterminism.)
+	Job           JobOptions   // Per-job options.  (The exception to the rule: see JobOptions.)
+
+	// When to keep a job's work dir after it's done.  (See KeepWorkspace.)
+	KeepWorkspace KeepWorkspace
+
+	// For interactive jobs: the size of the user's terminal, as it changes.
+	//  (Another exception: like JobOptions, it's here for lack of another path.)
+	//  Optional; the first size should be sent right away.
+	TerminalSize <-chan WindowSize
+}
+
+// WindowSize is the size of a terminal, in characters.
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+/*
+	JobOptions are settings which *are* declared alongside a formula, but
+	which the formula API has no place for (yet).  They're carried in
+	the executor config because that's the only path we have to the executor.
+
+	Like the rest of the config, these are not part of the formula's
+	setup hash; memos of a job are keyed on them separately (see
+	Config.MemoVariant).
+*/
+type JobOptions struct {
+	Network NetworkMode // What network the job can see.  Defaults to none.
+	Groups  []int       // Supplementary gids for the job's user.
+	Umask   string      // In octal (e.g. "027").  Defaults to "022".
+}
+
+/*
+	MemoVariant describes the settings which change what a job can see or
+	do, and so could change its results: memos of the job are keyed on
+	them as well as on the formula's setupHash, so that a run with other
+	settings isn't mistaken for the same run.
+
+	The variant is empty for the defaults, so memos of plain runs are kept
+	under the plain setupHash.  If ok is false, runs with these settings
+	shouldn't be memoized at all: the host network is outside the formula's
+	control, so there's no telling whether a second run would match.
+*/
+func (cfg Config) MemoVariant() (variant string, ok bool) {
+	var parts []string
+	switch cfg.Job.Network {
+	case Network_Host:
+		return "", false
+	case Network_Loopback:
+		parts = append(parts, "network="+string(cfg.Job.Network))
+	}
+	if len(cfg.Job.Groups) > 0 {
+		groups := append([]int{}, cfg.Job.Groups...)
+		sort.Ints(groups) // They're a set.
+		strs := make([]string, len(groups))
+		for i, gid := range groups {
+			strs[i] = strconv.Itoa(gid)
+		}
+		parts = append(parts, "groups="+strings.Join(strs, ","))
+	}
+	if umask, err := cfg.Job.ParseUmask(); err != nil || umask != 022 {
+		parts = append(parts, "umask="+cfg.Job.Umask) // An invalid one is refused by the executor anyway.
+	}
+	if cfg.Deterministic {
+		parts = append(parts, "deterministic")
+	}
+	if cfg.Rootless {
+		// Everything the job sees is owned by its own user, so it can
+		//  see (and do) different things than it would run as root.
+		parts = append(parts, "rootless")
+	}
+	return strings.Join(parts, ";"), true
+}
+
+// Parse the umask option, applying the default.
+func (o JobOptions) ParseUmask() (uint32, error) {
+	if o.Umask == "" {
+		return 022, nil
+	}
+	umask, err := strconv.ParseUint(o.Umask, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, Errorf(repeatr.ErrUsage, "invalid umask %q: must be octal, no more than 0777", o.Umask)
+	}
+	return uint32(umask), nil
+}
+
+/*
+	NetworkMode selects what network a job can reach.
+
+	"none" is the default: the job gets a fresh network namespace, with
+	nothing that routes off the box.  (Whether loopback is up is up to the
+	executor; runc and gvisor always bring it up, others don't.)
+	"loopback" is the same, but guarantees a working loopback interface.
+	"host" shares the host's network, and requires an elevated policy.
+*/
+type NetworkMode string
+
+const (
+	Network_None     NetworkMode = "none"
+	Network_Loopback NetworkMode = "loopback"
+	Network_Host     NetworkMode = "host"
+)
+
+/*
+	Limits describes the resource constraints to apply to a job.
+
+	Zero values mean "unlimited" -- or more precisely, the executor's
+	usual defaults.
+*/
+type Limits struct {
+	Memory    int64    // Max memory (and swap) usage, in bytes.
+	CpuQuota  int64    // Microseconds of cpu time allowed per CpuPeriod.
+	CpuPeriod uint64   // Microseconds; if zero but CpuQuota is set, 100ms is used.
+	CpuShares uint64   // Relative weight versus other jobs.
+	Pids      int64    // Max number of processes (and threads).
+	Rlimits   []Rlimit // Additional rlimits (these override defaults of the same type).
+	ShmSize   int64    // Size of the /dev/shm tmpfs, in bytes.
+}
+
+/*
+	OutputLimits bounds the output captured from a job (stdout and stderr
+	together).  Unlike Limits, these are enforced by repeatr itself, so
+	every executor supports them.  (See mixins.OutputForwarder.)
+*/
+type OutputLimits struct {
+	MaxBytes int64 // Max bytes of output to capture; zero means unlimited.
+	Kill     bool  // If true, exceeding MaxBytes kills the job; otherwise the rest of its output is dropped.
+}
+
+/*
+	KeepWorkspace says when a job's work dir is kept after the job is done,
+	for post-mortem inspection.
+
+	"never" is the default: the work dir is removed.  "on-failure" keeps it
+	if the job fails (exits non-zero, or doesn't get that far), and "always"
+	keeps every one.  A kept work dir has the assembled chroot, with the
+	input mounts detached, and whatever else the executor keeps there
+	(e.g. runc's config.json and log).
+*/
+type KeepWorkspace string
+
+const (
+	KeepWorkspace_Never     KeepWorkspace = "never"
+	KeepWorkspace_OnFailure KeepWorkspace = "on-failure"
+	KeepWorkspace_Always    KeepWorkspace = "always"
+)
+
+type Rlimit struct {
+	Type string // Name of the limit, as in setrlimit(2) -- e.g. "RLIMIT_NOFILE".
+	Soft uint64
+	Hard uint64
+}
+
+// Returns true if no limits are set at all.
+func (l Limits) IsZero() bool {
+	return l.Memory == 0 &&
+		l.CpuQuota == 0 &&
+		l.CpuPeriod == 0 &&
+		l.CpuShares == 0 &&
+		l.Pids == 0 &&
+		len(l.Rlimits) == 0 &&
+		l.ShmSize == 0
+}
+
+// Returns true if any limits are set which need cgroups to enforce.
+//  (Rlimits and the shm size can be applied without.)
+func (l Limits) NeedsCgroups() bool {
+	return l.Memory != 0 ||
+		l.CpuQuota != 0 ||
+		l.CpuPeriod != 0 ||
+		l.CpuShares != 0 ||
+		l.Pids != 0
+}
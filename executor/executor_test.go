@@ -0,0 +1,34 @@
+package executor
+
+import (
+	"testing"
+
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestMemoVariant(t *testing.T) {
+	for _, tr := range []struct {
+		name    string
+		cfg     Config
+		variant string
+		ok      bool
+	}{
+		{"defaults", Config{}, "", true},
+		{"no network is the default", Config{Job: JobOptions{Network: Network_None}}, "", true},
+		{"loopback", Config{Job: JobOptions{Network: Network_Loopback}}, "network=loopback", true},
+		{"host network", Config{Job: JobOptions{Network: Network_Host}}, "", false},
+		{"groups, in any order", Config{Job: JobOptions{Groups: []int{44, 29}}}, "groups=29,44", true},
+		{"umask", Config{Job: JobOptions{Umask: "027"}}, "umask=027", true},
+		{"the default umask is the default", Config{Job: JobOptions{Umask: "0022"}}, "", true},
+		{"deterministic", Config{Deterministic: true}, "deterministic", true},
+		{"rootless", Config{Rootless: true}, "rootless", true},
+		{"all of them", Config{Deterministic: true, Rootless: true, Job: JobOptions{Network: Network_Loopback, Groups: []int{29}, Umask: "077"}}, "network=loopback;groups=29;umask=077;deterministic;rootless", true},
+		{"limits don't matter", Config{Limits: Limits{Memory: 1 << 20}}, "", true},
+	} {
+		t.Run(tr.name, func(t *testing.T) {
+			variant, ok := tr.cfg.MemoVariant()
+			WantEqual(t, variant, tr.variant)
+			WantEqual(t, ok, tr.ok)
+		})
+	}
+}
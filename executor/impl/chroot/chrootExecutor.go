@@ -11,8 +11,10 @@ import (
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/cradle"
 	"go.polydawn.net/repeatr/executor/mixins"
+	"go.polydawn.net/repeatr/executor/policy"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/stitch"
@@ -22,13 +24,40 @@ type Executor struct {
 	workspaceFs   fs.FS             // A working dir per execution will be made in here.
 	assemblerTool *stitch.Assembler // Contains: unpackTool, caching cfg, and placer tools.
 	packTool      rio.PackFunc
+	config        executor.Config // Host settings.  (Few are supported.)
 }
 
 func NewExecutor(
 	workDir fs.AbsolutePath,
 	unpackTool rio.UnpackFunc,
 	packTool rio.PackFunc,
+	config executor.Config,
 ) (repeatr.RunFunc, error) {
+	// Chroot has no cgroups or other machinery for enforcing limits.
+	//  Refuse rather than quietly running the job unconstrained.
+	if !config.Limits.IsZero() {
+		return nil, Errorf(repeatr.ErrUsage, "the chroot executor does not support resource limits")
+	}
+	// Nor does it have any namespaces: so it can't pretend to be root, either.
+	if config.Rootless {
+		return nil, Errorf(repeatr.ErrUsage, "the chroot executor does not support rootless mode (try the runc or ns executors)")
+	}
+	// We can give a job an empty network namespace, but have no init
+	//  process of our own to configure one.
+	if config.Job.Network == executor.Network_Loopback {
+		return nil, Errorf(repeatr.ErrUsage, "the chroot executor does not support network mode %q (only none or host)", config.Job.Network)
+	}
+	// Nor can it set the hostname the job sees, which deterministic mode needs.
+	if config.Deterministic {
+		return nil, Errorf(repeatr.ErrUsage, "the chroot executor does not support deterministic mode (try the runc or ns executors)")
+	}
+	// Nor a umask: the job would inherit ours, which is process-wide, and
+	//  other jobs (and the rest of repeatr) are creating files meanwhile.
+	if umask, err := config.Job.ParseUmask(); err != nil {
+		return nil, err
+	} else if umask != 022 {
+		return nil, Errorf(repeatr.ErrUsage, "the chroot executor does not support setting the umask (try the runc or ns executors)")
+	}
 	asm, err := stitch.NewAssembler(unpackTool)
 	if err != nil {
 		return nil, repeatr.ReboxRioError(err)
@@ -37,6 +66,7 @@ func NewExecutor(
 		osfs.New(workDir),
 		asm,
 		packTool,
+		config,
 	}.Run, nil
 }
 
@@ -52,12 +82,12 @@ func (cfg Executor) Run(
 	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
 
 	// Workspace setup and params defaulting.
-	formula = cradle.FormulaDefaults(formula) // Initialize formula default values.
-	rr := api.FormulaRunRecord{}              // Start filling out record keeping!
-	mixins.InitRunRecord(&rr, formula)        // Includes picking a random guid for the job, which we use in all temp files.
+	formula = cradle.FormulaDefaults(formula)          // Initialize formula default values.
+	rr := api.FormulaRunRecord{}                       // Start filling out record keeping!
+	formula = mixins.InitJob(&rr, formula, cfg.config) // Includes picking a random guid for the job, which we use in all temp files.
 
 	// Make work dirs. Including whole workspace dir and parents, if necessary.
-	_, chrootFs, err := mixins.MakeWorkDirs(cfg.workspaceFs, rr)
+	jobFs, chrootFs, err := mixins.MakeWorkDirs(cfg.workspaceFs, rr)
 	if err != nil {
 		return nil, err
 	}
@@ -65,19 +95,25 @@ func (cfg Executor) Run(
 	// Use standard filesystem setup/teardown, handing it our 'run' thunk
 	//  to invoke while it's living.
 	rr.Results, err = mixins.WithFilesystem(ctx,
-		chrootFs, cfg.assemblerTool, cfg.packTool,
-		formula, formulaCtx, mon,
+		jobFs, chrootFs, cfg.assemblerTool, cfg.packTool,
+		formula, formulaCtx, mon, &rr, cfg.config,
 		func(chrootFs fs.FS) (err error) {
-			rr.ExitCode, err = run(ctx, formula.Action, chrootFs, input, mon)
+			rr.ExitCode, err = run(ctx, &rr, formula.Action, cfg.config.Job, cfg.config.Output, cfg.config.TerminalSize, jobFs, chrootFs, input, mon)
 			return
 		},
 	)
+	mixins.RecordCancellation(&rr, err)
 	return &rr, err
 }
 
 func run(
 	ctx context.Context,
+	rr *api.FormulaRunRecord, // for the job ID, and recording resource usage.
 	action api.FormulaAction,
+	opts executor.JobOptions,
+	output executor.OutputLimits,
+	terminalSize <-chan executor.WindowSize,
+	jobFs fs.FS, // a spot for other tmp/job-lifetime files.
 	chrootFs fs.FS,
 	input repeatr.InputControl,
 	mon repeatr.Monitor,
@@ -87,36 +123,72 @@ func run(
 		return -1, err
 	}
 
+	if err := policy.CheckNetwork(opts.Network, action.Policy); err != nil {
+		return -1, err
+	}
+
 	// Configure the container.
 	cmdName := action.Exec[0]
 	cmd := exec.Command(cmdName, action.Exec[1:]...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Chroot: chrootFs.BasePath().String(),
+		Chroot:  chrootFs.BasePath().String(),
+		Setpgid: true, // So we can signal everything the job spawns.
 		Credential: &syscall.Credential{
-			Uid: uint32(*action.Userinfo.Uid),
-			Gid: uint32(*action.Userinfo.Gid),
+			Uid:    uint32(*action.Userinfo.Uid),
+			Gid:    uint32(*action.Userinfo.Gid),
+			Groups: make([]uint32, len(opts.Groups)), // Always non-nil: nil means "inherit ours"!
 		},
 	}
+	for i, gid := range opts.Groups {
+		cmd.SysProcAttr.Credential.Groups[i] = uint32(gid)
+	}
+	if opts.Network != executor.Network_Host {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
 	cmd.Dir = string(action.Cwd)
 	cmd.Env = envToSlice(action.Env)
 
-	// Wire I/O.
-	if input.Chan != nil {
-		pipe, _ := cmd.StdinPipe()
-		mixins.RunInputWriteForwarder(ctx, pipe, input.Chan)
+	// Wire I/O.  (See mixins.JobIO for how: a terminal if interactive,
+	//  and otherwise pipes.)
+	out := mixins.NewOutputForwarder(ctx, mon, output)
+	defer out.Close()
+	jobIO, err := mixins.AttachIO(ctx, cmd, input, terminalSize, out)
+	if err != nil {
+		return -1, err
 	}
-	proxy := mixins.NewOutputEventWriter(ctx, mon.Chan)
-	cmd.Stdout = proxy
-	cmd.Stderr = proxy
 
 	// Invoke!
-	return runCmd(cmd)
-}
-
-func runCmd(cmd *exec.Cmd) (int, error) {
 	if err := cmd.Start(); err != nil {
+		jobIO.Abort()
 		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", err)
 	}
+	jobIO.Started()
+	// List the job, for `repeatr ps` and `repeatr exec`.
+	defer mixins.RegisterJob(jobFs, mixins.RunningJob{
+		Guid:      rr.Guid,
+		SetupHash: rr.FormulaID,
+		Executor:  "chroot",
+		Pid:       cmd.Process.Pid,
+		Uid:       *action.Userinfo.Uid,
+		Gid:       *action.Userinfo.Gid,
+	}, mon)()
+	awaitCancel := mixins.SignalOnCancel(out.Context(), mon, func(sig syscall.Signal) error {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	})
+	exitCode, err := cmdWait(cmd)
+	jobIO.Wait()
+	mixins.RecordRusage(rr, cmd.ProcessState)
+	out.Record(rr)
+	if awaitCancel() {
+		if err := out.LimitErr(); err != nil {
+			return -1, err
+		}
+		return -1, Errorf(repeatr.ErrCancelled, "job cancelled: %s", ctx.Err())
+	}
+	return exitCode, err
+}
+
+func cmdWait(cmd *exec.Cmd) (int, error) {
 	err := cmd.Wait()
 	if err == nil {
 		return 0, nil
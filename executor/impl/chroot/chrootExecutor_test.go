@@ -4,8 +4,12 @@ import (
 	"os"
 	"testing"
 
+	"github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/rio/client/exec"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/tests"
 	. "go.polydawn.net/repeatr/testutil"
 	"go.polydawn.net/rio/fs"
@@ -33,6 +37,7 @@ func TestChrootExecutor(t *testing.T) {
 			osfs.New(tmpDir.Join(fs.MustRelPath("ws"))),
 			asm,
 			packTool,
+			executor.Config{},
 		}
 
 		tests.CheckHelloWorldTxt(t, exe.Run)
@@ -43,5 +48,18 @@ func TestChrootExecutor(t *testing.T) {
 		tests.CheckUserinfoDefault(t, exe.Run)
 		tests.CheckAdvancedUserinfo(t, exe.Run)
 		tests.CheckRootyUserinfo(t, exe.Run)
+		tests.CheckNetworkNone(t, exe.Run)
+		tests.CheckEtcFiles(t, exe.Run)
+		tests.CheckOutputStreams(t, exe.Run)
+		tests.CheckInteractive(t, exe.Run)
+		{
+			exe := exe
+			exe.config.Job = executor.JobOptions{Groups: tests.GroupsAndUmaskOptions.Groups}
+			tests.CheckGroups(t, exe.Run)
+		}
+		t.Run("setting the umask should be refused", func(t *testing.T) {
+			_, err := NewExecutor(tmpDir.Join(fs.MustRelPath("ws")), unpackTool, packTool, executor.Config{Job: tests.GroupsAndUmaskOptions})
+			WantEqual(t, errcat.Category(err), repeatr.ErrUsage)
+		})
 	})
 }
@@ -1,6 +1,7 @@
 package gvisor
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"github.com/polydawn/refmt"
@@ -9,21 +10,23 @@ import (
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/policy"
 )
 
-func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string, tty bool) (interface{}, error) {
+func templateRuncConfig(hostname string, action api.FormulaAction, rootPath string, tty bool, config executor.Config) (interface{}, error) {
+	limits, opts := config.Limits, config.Job
+	umask, err := opts.ParseUmask()
+	if err != nil {
+		return nil, err
+	}
 	caps, err := policy.GetCapsForPolicy(action.Policy)
 	if err != nil {
 		return nil, err
 	}
 	capsStrs := policy.CapsToStrings(caps)
-	hostname := action.Hostname
-	if hostname == "" {
-		hostname = string(jobID)
-	}
 
-	return map[string]interface{}{
+	cfg := map[string]interface{}{
 		"ociVersion": "1.0.0-rc5",
 		"platform": map[string]interface{}{
 			"os":   "linux",
@@ -34,7 +37,8 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 			"user": map[string]interface{}{
 				"uid":            *action.Userinfo.Uid,
 				"gid":            *action.Userinfo.Gid,
-				"additionalGids": nil,
+				"additionalGids": opts.Groups,
+				"umask":          umask,
 			},
 			"args": action.Exec,
 			"env": func() (env []string) {
@@ -58,7 +62,82 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 			"readonly": false,
 		},
 		"hostname": hostname,
-	}, nil
+	}
+
+	// Limits are only mentioned when configured: runsc is pickier than runc
+	//  about which parts of the spec it's willing to accept.
+	if len(limits.Rlimits) > 0 {
+		cfg["process"].(map[string]interface{})["rlimits"] = templateRlimits(limits)
+	}
+	if resources := templateResources(limits); len(resources) > 0 {
+		cfg["linux"] = map[string]interface{}{
+			"resources": resources,
+		}
+	}
+	if limits.ShmSize > 0 {
+		cfg["mounts"] = []interface{}{
+			map[string]interface{}{
+				"destination": "/dev/shm",
+				"type":        "tmpfs",
+				"source":      "shm",
+				"options": []string{
+					"nosuid",
+					"noexec",
+					"nodev",
+					"mode=1777",
+					fmt.Sprintf("size=%dk", limits.ShmSize/1024),
+				},
+			},
+		}
+	}
+	// No time namespace in deterministic mode: the sentry keeps its own
+	//  clocks, and runsc doesn't take time offsets.
+	return cfg, nil
+}
+
+func templateRlimits(limits executor.Limits) []interface{} {
+	result := make([]interface{}, len(limits.Rlimits))
+	for i, rl := range limits.Rlimits {
+		result[i] = map[string]interface{}{
+			"type": rl.Type,
+			"hard": rl.Hard,
+			"soft": rl.Soft,
+		}
+	}
+	return result
+}
+
+// The "linux.resources" section.  runsc applies these to the cgroup
+//  of the whole sandbox.
+func templateResources(limits executor.Limits) map[string]interface{} {
+	resources := map[string]interface{}{}
+	if limits.Memory > 0 {
+		resources["memory"] = map[string]interface{}{
+			"limit": limits.Memory,
+			"swap":  limits.Memory,
+		}
+	}
+	cpu := map[string]interface{}{}
+	if limits.CpuQuota > 0 {
+		period := limits.CpuPeriod
+		if period == 0 {
+			period = 100000
+		}
+		cpu["quota"] = limits.CpuQuota
+		cpu["period"] = period
+	}
+	if limits.CpuShares > 0 {
+		cpu["shares"] = limits.CpuShares
+	}
+	if len(cpu) > 0 {
+		resources["cpu"] = cpu
+	}
+	if limits.Pids > 0 {
+		resources["pids"] = map[string]interface{}{
+			"limit": limits.Pids,
+		}
+	}
+	return resources
 }
 
 func writeConfigToFile(path string, runcCfg interface{}) error {
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"syscall"
 
 	. "github.com/warpfork/go-errcat"
@@ -13,8 +14,10 @@ import (
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/cradle"
 	"go.polydawn.net/repeatr/executor/mixins"
+	"go.polydawn.net/repeatr/executor/policy"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/stitch"
@@ -25,18 +28,23 @@ type Executor struct {
 	cmdPath       string            // Absolute path to runsc binary.
 	assemblerTool *stitch.Assembler // Contains: unpackTool, caching cfg, and placer tools.
 	packTool      rio.PackFunc
+	config        executor.Config // Host settings, such as resource limits.
 }
 
 func NewExecutor(
 	workDir fs.AbsolutePath,
 	unpackTool rio.UnpackFunc,
 	packTool rio.PackFunc,
+	config executor.Config,
 ) (repeatr.RunFunc, error) {
+	if config.Rootless {
+		return nil, Errorf(repeatr.ErrUsage, "the gvisor executor does not support rootless mode (try the runc or ns executors)")
+	}
 	asm, err := stitch.NewAssembler(unpackTool)
 	if err != nil {
 		return nil, repeatr.ReboxRioError(err)
 	}
-	cmdPath, err := findGvisorBinary()
+	cmdPath, err := FindGvisorBinary()
 	if err != nil {
 		return nil, err
 	}
@@ -45,12 +53,13 @@ func NewExecutor(
 		cmdPath,
 		asm,
 		packTool,
+		config,
 	}.Run, nil
 }
 
 // Look for the runc plugin binary -- we expect it to be in a path relative
 //   to our self, OR we'll take a hint from the REPEATR_PLUGINS_PATH env var.
-func findGvisorBinary() (string, error) {
+func FindGvisorBinary() (string, error) {
 	pluginsPath := os.Getenv("REPEATR_PLUGINS_PATH")
 	if pluginsPath == "" {
 		selfPath, err := os.Executable()
@@ -79,9 +88,9 @@ func (cfg Executor) Run(
 	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
 
 	// Workspace setup and params defaulting.
-	formula = cradle.FormulaDefaults(formula) // Initialize formula default values.
-	rr := api.FormulaRunRecord{}              // Start filling out record keeping!
-	mixins.InitRunRecord(&rr, formula)        // Includes picking a random guid for the job, which we use in all temp files.
+	formula = cradle.FormulaDefaults(formula)          // Initialize formula default values.
+	rr := api.FormulaRunRecord{}                       // Start filling out record keeping!
+	formula = mixins.InitJob(&rr, formula, cfg.config) // Includes picking a random guid for the job, which we use in all temp files.
 
 	// Make work dirs. Including whole workspace dir and parents, if necessary.
 	jobFs, chrootFs, err := mixins.MakeWorkDirs(cfg.workspaceFs, rr)
@@ -92,30 +101,37 @@ func (cfg Executor) Run(
 	// Use standard filesystem setup/teardown, handing it our 'run' thunk
 	//  to invoke while it's living.
 	rr.Results, err = mixins.WithFilesystem(ctx,
-		chrootFs, cfg.assemblerTool, cfg.packTool,
-		formula, formulaCtx, mon,
+		jobFs, chrootFs, cfg.assemblerTool, cfg.packTool,
+		formula, formulaCtx, mon, &rr, cfg.config,
 		func(chrootFs fs.FS) (err error) {
-			rr.ExitCode, err = cfg.run(ctx, rr.Guid, formula.Action, jobFs, chrootFs, input, mon)
+			rr.ExitCode, err = cfg.run(ctx, &rr, formula.Action, jobFs, chrootFs, input, mon)
 			return
 		},
 	)
+	mixins.RecordCancellation(&rr, err)
 	return &rr, err
 }
 
 func (cfg Executor) run(
 	ctx context.Context,
-	jobID string,
+	rr *api.FormulaRunRecord, // for the job ID, and recording resource usage.
 	action api.FormulaAction,
 	jobFs fs.FS, // a spot for other tmp/job-lifetime files.
 	chrootFs fs.FS,
 	input repeatr.InputControl,
 	mon repeatr.Monitor,
 ) (int, error) {
+	jobID := rr.Guid
+
 	// Check that action commands appear to be executable on this filesystem.
 	if err := mixins.CheckFSReadyForExec(action, chrootFs); err != nil {
 		return -1, err
 	}
 
+	if err := policy.CheckNetwork(cfg.config.Job.Network, action.Policy); err != nil {
+		return -1, err
+	}
+
 	// Configure the container.
 	//  For runc, this means we have to actually *write config to disk*.
 	//  We'll pass that path as an arg again shortly.
@@ -123,7 +139,7 @@ func (cfg Executor) run(
 	if input.Chan != nil {
 		useTty = true
 	}
-	runcCfg, err := templateRuncConfig(jobID, action, chrootFs.BasePath().String(), useTty)
+	runcCfg, err := templateRuncConfig(cradle.Hostname(action, rr, cfg.config), action, chrootFs.BasePath().String(), useTty, cfg.config)
 	if err != nil {
 		return -1, err
 	}
@@ -137,39 +153,90 @@ func (cfg Executor) run(
 	runcLogPathStr := jobFs.BasePath().String() + "/log"
 
 	// Start templating commands.
-	cmd := exec.Command(cfg.cmdPath,
-		"--root", jobFs.BasePath().String()+"/tmp",
+	//  Network isolation is a runsc flag, rather than part of the config.
+	//  (Its "none" mode still has loopback.)
+	args := []string{
+		"--root", jobFs.BasePath().String() + "/tmp",
 		"--debug",
 		"--log", runcLogPathStr,
 		"--log-format", "json",
+	}
+	if cfg.config.Job.Network != executor.Network_Host {
+		args = append(args, "--network", "none")
+	}
+	args = append(args,
 		"run",
 		"--bundle", jobFs.BasePath().String(),
 		jobID,
 	)
+	cmd := exec.Command(cfg.cmdPath, args...)
 
-	// Wire I/O.
-	if input.Chan != nil {
-		// Dire hack: reach all the way out to the system stdin handle.
-		// We need this for TTY reasons.
-		// Future work: do our own PTY management, giving us room for handling
-		//  custom escape sequences, isolating this code better, etc.
-		cmd.Stdin = os.Stdin
+	// Wire I/O.  (See mixins.JobIO for how: a terminal if interactive,
+	//  and otherwise pipes.)
+	out := mixins.NewOutputForwarder(ctx, mon, cfg.config.Output)
+	defer out.Close()
+	jobIO, err := mixins.AttachIO(ctx, cmd, input, cfg.config.TerminalSize, out)
+	if err != nil {
+		return -1, err
 	}
-	proxy := mixins.NewOutputEventWriter(ctx, mon.Chan)
-	cmd.Stdout = proxy // TODO probably more here
-	cmd.Stderr = proxy // TODO probably more here
 
 	// Launch runc process.
 	if err := cmd.Start(); err != nil {
+		jobIO.Abort()
 		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", err)
 	}
+	jobIO.Started()
+
+	// List the job, for `repeatr ps` and `repeatr exec`.
+	defer mixins.RegisterJob(jobFs, mixins.RunningJob{
+		Guid:      jobID,
+		SetupHash: rr.FormulaID,
+		Executor:  "gvisor",
+		Pid:       cmd.Process.Pid,
+		Runtime:   cfg.cmdPath,
+		StateDir:  jobFs.BasePath().String() + "/tmp",
+		Uid:       *action.Userinfo.Uid,
+		Gid:       *action.Userinfo.Gid,
+	}, mon)()
+
+	// Relay cancellation to the container.
+	//  We ask runsc to deliver signals, since it knows where the container's
+	//  init process is; if even that fails, we go after runsc itself.
+	awaitCancel := mixins.SignalOnCancel(out.Context(), mon, func(sig syscall.Signal) error {
+		if err := cfg.stateCmd(jobFs, "kill", jobID, strconv.Itoa(int(sig))).Run(); err != nil {
+			cmd.Process.Signal(sig)
+			return err
+		}
+		return nil
+	})
 
 	// Watch logs; we have additional output handling to do.
 	// TODO
 
 	// Await command completion; return its exit code.
 	//  (If we get this far, the code from the 'real' work proc is all that's left.)
-	return cmdWait(cmd)
+	exitCode, err := cmdWait(cmd)
+	jobIO.Wait()
+	mixins.RecordRusage(rr, cmd.ProcessState)
+	out.Record(rr)
+	if awaitCancel() {
+		// A container killed out from under runsc may leave its state behind;
+		//  force cleanup, so nothing is left holding the filesystem busy.
+		cfg.stateCmd(jobFs, "delete", "--force", jobID).Run()
+		if err := out.LimitErr(); err != nil {
+			return -1, err
+		}
+		return -1, Errorf(repeatr.ErrCancelled, "job cancelled: %s", ctx.Err())
+	}
+	return exitCode, err
+}
+
+// Template a command for one of the runsc subcommands which operate on
+//  an existing container (kill, delete, etc), using the job's state dir.
+func (cfg Executor) stateCmd(jobFs fs.FS, args ...string) *exec.Cmd {
+	return exec.Command(cfg.cmdPath,
+		append([]string{"--root", jobFs.BasePath().String() + "/tmp"}, args...)...,
+	)
 }
 
 // copypasta glue for get-the-real-exitcode-plz
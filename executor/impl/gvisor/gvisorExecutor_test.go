@@ -6,6 +6,7 @@ import (
 
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/rio/client/exec"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/tests"
 	. "go.polydawn.net/repeatr/testutil"
 	"go.polydawn.net/rio/fs"
@@ -29,6 +30,7 @@ func TestGvisorExecutor(t *testing.T) {
 			tmpDir.Join(fs.MustRelPath("ws")),
 			unpackTool,
 			packTool,
+			executor.Config{},
 		)
 		AssertNoError(t, err)
 
@@ -40,5 +42,19 @@ func TestGvisorExecutor(t *testing.T) {
 		tests.CheckUserinfoDefault(t, runTool)
 		tests.CheckAdvancedUserinfo(t, runTool)
 		tests.CheckRootyUserinfo(t, runTool)
+		tests.CheckNetworkNone(t, runTool)
+		tests.CheckEtcFiles(t, runTool)
+		tests.CheckOutputStreams(t, runTool)
+		tests.CheckInteractive(t, runTool)
+		{
+			runTool, err := NewExecutor(
+				tmpDir.Join(fs.MustRelPath("ws")),
+				unpackTool,
+				packTool,
+				executor.Config{Job: tests.GroupsAndUmaskOptions},
+			)
+			AssertNoError(t, err)
+			tests.CheckGroupsAndUmask(t, runTool)
+		}
 	})
 }
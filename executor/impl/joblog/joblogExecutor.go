@@ -0,0 +1,122 @@
+package joblog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+)
+
+/*
+	Executor decorates another executor, teeing the job's output into a log
+	in the store, and recording the log's hash in the run record metadata
+	(under MetadataKey_Log).
+
+	Put it inside any signing, so the hash is signed along with the rest
+	of the record; and inside memoization, so memos carry it.
+
+	Failing to keep the log is only worth a warning: the job still runs.
+*/
+type Executor struct {
+	store    Store
+	delegate repeatr.RunFunc
+}
+
+func NewExecutor(
+	store Store,
+	delegate repeatr.RunFunc,
+) (repeatr.RunFunc, error) {
+	return Executor{
+		store, delegate,
+	}.Run, nil
+}
+
+var _ repeatr.RunFunc = Executor{}.Run
+
+func (cfg Executor) Run(
+	ctx context.Context,
+	formula api.Formula,
+	formulaCtx repeatr.FormulaContext,
+	input repeatr.InputControl,
+	mon repeatr.Monitor,
+) (_ *api.FormulaRunRecord, err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+
+	w, err := cfg.store.NewWriter()
+	if err != nil {
+		warn(mon, "job log will not be kept", err)
+		return cfg.delegate(ctx, formula, formulaCtx, input, mon)
+	}
+	defer w.Abort()
+
+	// Interpose on the monitor: everything is forwarded as-is,
+	//  and output is written to the log as well.
+	//  A write error stops the logging, but not the forwarding.
+	tee := make(chan repeatr.Event)
+	var writeErr error
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for evt := range tee {
+			if stream, out, ok := executor.OutputEvent(evt); ok && writeErr == nil {
+				writeErr = w.Write(executor.Event_StreamOutput{out, stream})
+			}
+			mon.Send(evt)
+		}
+	}()
+	rr, err := cfg.delegate(ctx, formula, formulaCtx, input, repeatr.Monitor{Chan: tee})
+	close(tee)
+	wg.Wait()
+
+	// Keep the log only if there's a record to attach it to.
+	if rr == nil {
+		return rr, err
+	}
+	if writeErr != nil {
+		warn(mon, "job log could not be kept", writeErr)
+		return rr, err
+	}
+	hash, commitErr := w.Commit(rr)
+	if hash != "" {
+		if rr.Metadata == nil {
+			rr.Metadata = map[string]string{}
+		}
+		rr.Metadata[MetadataKey_Log] = hash
+	}
+	if commitErr != nil {
+		warn(mon, "job log could not be kept", commitErr)
+	}
+	return rr, err
+}
+
+/*
+	Replay the log of a run, by the hash in its record, as output events.
+	Does nothing if the record has no log.  Returns ErrLocalCacheProblem
+	if it has one we don't (e.g., a memo from another host).
+*/
+func (s Store) ReplayRecord(rr *api.FormulaRunRecord, mon repeatr.Monitor) error {
+	hash, ok := rr.Metadata[MetadataKey_Log]
+	if !ok {
+		return nil
+	}
+	return s.Replay(hash, func(evt executor.Event_StreamOutput) {
+		mon.Send(evt)
+	})
+}
+
+func warn(mon repeatr.Monitor, msg string, err error) {
+	mon.Send(repeatr.Event_Log{
+		Time:  time.Now(),
+		Level: repeatr.LogWarn,
+		Msg:   msg,
+		Detail: [][2]string{
+			{"err", err.Error()},
+		},
+	})
+}
@@ -0,0 +1,63 @@
+package joblog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestJoblogExecutor(t *testing.T) {
+	frm := api.Formula{Action: api.FormulaAction{Exec: []string{"/bin/true"}}}
+	delegate := func(_ context.Context, frm api.Formula, _ repeatr.FormulaContext, _ repeatr.InputControl, mon repeatr.Monitor) (*api.FormulaRunRecord, error) {
+		mon.Send(executor.Event_StreamOutput{repeatr.Event_Output{time.Now(), "out\n"}, executor.Stream_Stdout})
+		mon.Send(executor.Event_StreamOutput{repeatr.Event_Output{time.Now(), "err\n"}, executor.Stream_Stderr})
+		mon.Send(repeatr.Event_Output{time.Now(), "plain\n"})
+		return &api.FormulaRunRecord{Guid: "guid1", FormulaID: frm.SetupHash()}, nil
+	}
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		store := NewStore(tmpDir)
+		runTool, err := NewExecutor(store, delegate)
+		AssertNoError(t, err)
+
+		evtCh := make(chan repeatr.Event, 10)
+		rr, err := runTool(context.Background(), frm, repeatr.FormulaContext{}, repeatr.InputControl{}, repeatr.Monitor{Chan: evtCh})
+		AssertNoError(t, err)
+		WantEqual(t, len(evtCh), 3)
+		hash := rr.Metadata[MetadataKey_Log]
+		WantEqual(t, len(hash), 64)
+
+		t.Run("logs should be found by guid and setupHash", func(t *testing.T) {
+			found, err := store.Lookup("guid1")
+			AssertNoError(t, err)
+			WantEqual(t, found, hash)
+			found, err = store.Lookup(string(frm.SetupHash()))
+			AssertNoError(t, err)
+			WantEqual(t, found, hash)
+			found, err = store.Lookup("nope")
+			AssertNoError(t, err)
+			WantEqual(t, found, "")
+		})
+		t.Run("replay should give back the output with streams", func(t *testing.T) {
+			var got []executor.Event_StreamOutput
+			AssertNoError(t, store.Replay(hash, func(evt executor.Event_StreamOutput) {
+				got = append(got, evt)
+			}))
+			WantEqual(t, len(got), 3)
+			WantEqual(t, got[0].Msg, "out\n")
+			WantEqual(t, got[0].Stream, executor.Stream_Stdout)
+			WantEqual(t, got[1].Msg, "err\n")
+			WantEqual(t, got[1].Stream, executor.Stream_Stderr)
+			WantEqual(t, got[2].Msg, "plain\n")
+			WantEqual(t, got[2].Stream, executor.Stream_Stdout)
+		})
+		t.Run("records without a log replay nothing", func(t *testing.T) {
+			AssertNoError(t, store.ReplayRecord(&api.FormulaRunRecord{}, repeatr.Monitor{}))
+		})
+	})
+}
@@ -0,0 +1,222 @@
+package joblog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/rio/fs"
+)
+
+// The run record metadata key the hash of the job's log is recorded under.
+const MetadataKey_Log = "log.sha256"
+
+/*
+	Store keeps job logs in a local directory, content-addressed:
+
+	  - `<dir>/sha256/<hash[0:3]>/<hash[3:6]>/<hash>` is a log,
+	    one json entry per line;
+	  - `<dir>/guid/<guid>` and `<dir>/setupHash/<setupHash>` hold the hash
+	    of the log of a job, by its run record guid, and of the latest job
+	    of a formula.
+
+	The directory can be shared by concurrent repeatr processes.
+*/
+type Store struct {
+	dir fs.AbsolutePath
+}
+
+func NewStore(dir fs.AbsolutePath) Store {
+	return Store{dir}
+}
+
+// One line of a log.
+type Entry struct {
+	Time   string // RFC3339, to the nanosecond.
+	Stream executor.Stream
+	Msg    string
+}
+
+var atl_entry = atlas.MustBuild(
+	atlas.BuildEntry(Entry{}).StructMap().Autogenerate().Complete(),
+)
+
+func (s Store) blobPath(hash string) string {
+	if len(hash) < 6 {
+		return filepath.Join(s.dir.String(), "sha256", hash)
+	}
+	return filepath.Join(s.dir.String(), "sha256", hash[0:3], hash[3:6], hash)
+}
+
+/*
+	Writer accumulates a log.  It's a tempfile in the store until Commit,
+	which moves it into place under its hash.
+*/
+type Writer struct {
+	store Store
+	f     *os.File
+	h     hash.Hash
+	w     io.Writer // Both the file and the hash.
+	enc   refmt.Marshaller
+}
+
+func (s Store) NewWriter() (*Writer, error) {
+	if err := os.MkdirAll(s.dir.String(), 0755); err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "could not start job log: %s", err)
+	}
+	f, err := ioutil.TempFile(s.dir.String(), ".tmp.log.")
+	if err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "could not start job log: %s", err)
+	}
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	return &Writer{s, f, h, w, refmt.NewMarshallerAtlased(json.EncodeOptions{}, w, atl_entry)}, nil
+}
+
+func (w *Writer) Write(evt executor.Event_StreamOutput) error {
+	if err := w.enc.Marshal(Entry{evt.Time.Format(time.RFC3339Nano), evt.Stream, evt.Msg}); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not write job log: %s", err)
+	}
+	if _, err := w.w.Write([]byte{'\n'}); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not write job log: %s", err)
+	}
+	return nil
+}
+
+// Move the log into place, and index it by the run record's guid and
+//  setupHash.  Returns the log's hash.
+func (w *Writer) Commit(rr *api.FormulaRunRecord) (string, error) {
+	defer w.Abort()
+	if err := w.f.Chmod(0644); err != nil {
+		return "", Errorf(repeatr.ErrLocalCacheProblem, "could not save job log: %s", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return "", Errorf(repeatr.ErrLocalCacheProblem, "could not save job log: %s", err)
+	}
+	hash := hex.EncodeToString(w.h.Sum(nil))
+	pth := w.store.blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return "", Errorf(repeatr.ErrLocalCacheProblem, "could not save job log: %s", err)
+	}
+	if err := os.Rename(w.f.Name(), pth); err != nil {
+		return "", Errorf(repeatr.ErrLocalCacheProblem, "could not save job log: %s", err)
+	}
+	if err := w.store.index("guid", rr.Guid, hash); err != nil {
+		return hash, err
+	}
+	return hash, w.store.index("setupHash", string(rr.FormulaID), hash)
+}
+
+// Discard the log, if it hasn't been committed.  Safe to call twice.
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name()) // no-op if we made it to the rename.
+}
+
+// Point an index entry at a hash.  (Atomically, in case of concurrent runs
+//  of the same formula: one of them wins.)
+func (s Store) index(kind, id, hash string) error {
+	if !validID(id) {
+		return nil
+	}
+	dir := filepath.Join(s.dir.String(), kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not index job log: %s", err)
+	}
+	f, err := ioutil.TempFile(dir, ".tmp.")
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not index job log: %s", err)
+	}
+	defer os.Remove(f.Name()) // no-op if we made it to the rename.
+	_, err = f.WriteString(hash + "\n")
+	f.Close()
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not index job log: %s", err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, id)); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not index job log: %s", err)
+	}
+	return nil
+}
+
+/*
+	Find the hash of a job's log, by the guid of its run record, or else
+	the setupHash of its formula (which finds the latest run's).
+	Returns empty string if there's none.
+*/
+func (s Store) Lookup(id string) (string, error) {
+	if !validID(id) {
+		return "", Errorf(repeatr.ErrUsage, "invalid job id %q", id)
+	}
+	for _, kind := range []string{"guid", "setupHash"} {
+		bs, err := ioutil.ReadFile(filepath.Join(s.dir.String(), kind, id))
+		switch {
+		case err == nil:
+			return strings.TrimSpace(string(bs)), nil
+		case os.IsNotExist(err):
+			continue
+		default:
+			return "", Errorf(repeatr.ErrLocalCacheProblem, "could not read job log index: %s", err)
+		}
+	}
+	return "", nil
+}
+
+// Guids and setupHashes are plain base58, but we're taking them from users:
+//  make sure they can't wander out of the index dir.
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/\\") && !strings.HasPrefix(id, ".")
+}
+
+/*
+	Read back the log with the given hash, calling fn with each entry
+	as an output event.  Returns ErrLocalCacheProblem if there's no such log.
+*/
+func (s Store) Replay(hash string, fn func(executor.Event_StreamOutput)) error {
+	if !validID(hash) {
+		return Errorf(repeatr.ErrLocalCacheProblem, "invalid job log hash %q", hash)
+	}
+	f, err := os.Open(s.blobPath(hash))
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not read job log: %s", err)
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return Errorf(repeatr.ErrLocalCacheProblem, "could not read job log: %s", err)
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := refmt.UnmarshalAtlased(json.DecodeOptions{}, line, &entry, atl_entry); err != nil {
+			return Errorf(repeatr.ErrLocalCacheProblem, "could not read job log: %s", err)
+		}
+		evt := executor.Event_StreamOutput{Stream: entry.Stream}
+		evt.Time, _ = time.Parse(time.RFC3339Nano, entry.Time)
+		evt.Msg = entry.Msg
+		fn(evt)
+	}
+}
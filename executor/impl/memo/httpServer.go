@@ -0,0 +1,98 @@
+package memo
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+// Records bigger than this are refused.  Real ones are a few KB at most.
+const maxRecordSize = 1 << 20
+
+/*
+	Make an http.Handler which serves a Store to HttpStore clients.
+
+	Saved records must be for the setupHash they're saved under
+	(the runRecord's FormulaID), or a variant of it (see memoKey);
+	we don't take the client's word for it.
+*/
+func NewHandler(store Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/memo/", func(w http.ResponseWriter, req *http.Request) {
+		setupHash := api.FormulaSetupHash(strings.TrimPrefix(req.URL.Path, "/memo/"))
+		if !isValidSetupHash(setupHash) {
+			http.Error(w, "invalid setupHash", http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "GET", "HEAD":
+			serveLoad(w, req, store, setupHash)
+		case "PUT":
+			serveSave(w, req, store, setupHash)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func serveLoad(w http.ResponseWriter, req *http.Request, store Store, setupHash api.FormulaSetupHash) {
+	rr, err := store.Load(req.Context(), setupHash)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	if rr == nil {
+		http.Error(w, "no memo", http.StatusNotFound)
+		return
+	}
+	var buf bytes.Buffer
+	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{}, &buf, api.Atlas_FormulaRunRecord).Marshal(rr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+func serveSave(w http.ResponseWriter, req *http.Request, store Store, setupHash api.FormulaSetupHash) {
+	rr := &api.FormulaRunRecord{}
+	body := http.MaxBytesReader(w, req.Body, maxRecordSize)
+	if err := refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, body, api.Atlas_FormulaRunRecord).Unmarshal(rr); err != nil {
+		http.Error(w, "record does not parse: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rr.FormulaID != setupHash && !strings.HasPrefix(string(setupHash), string(rr.FormulaID)+".") {
+		http.Error(w, "record is for setupHash "+string(rr.FormulaID)+", not "+string(setupHash), http.StatusBadRequest)
+		return
+	}
+	if err := store.Save(req.Context(), setupHash, rr); err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func httpStatusForError(err error) int {
+	switch errcat.Category(err) {
+	case repeatr.ErrUsage:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// SetupHashes name files in a DirStore and are parts of URLs;
+//  make sure they can't name anything but a memo.
+func isValidSetupHash(setupHash api.FormulaSetupHash) bool {
+	h := string(setupHash)
+	return h != "" && !strings.ContainsAny(h, "/\\?#%") && isMemoName(h)
+}
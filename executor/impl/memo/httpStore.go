@@ -0,0 +1,119 @@
+package memo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+/*
+	HttpStore keeps memos on a remote memo server (see NewHandler), so
+	they can be shared between machines.
+
+	Memos are at `<baseUrl>/memo/<setupHash>`: GET to load (404 if none),
+	PUT to save.  There's no remote locking, so identical formulas on
+	different machines may run at the same time; the last to finish wins.
+*/
+type HttpStore struct {
+	baseUrl string
+	client  *http.Client
+}
+
+// How long a request to the memo server may take, with the default client.
+//  A memo server which doesn't answer shouldn't hold up a run for long:
+//  it's only a shortcut.
+const httpStoreTimeout = 30 * time.Second
+
+// Make an HttpStore for a memo server.  If client is nil, a client with
+//  a timeout of httpStoreTimeout is used.
+func NewHttpStore(baseUrl string, client *http.Client) HttpStore {
+	if client == nil {
+		client = &http.Client{Timeout: httpStoreTimeout}
+	}
+	return HttpStore{strings.TrimSuffix(baseUrl, "/"), client}
+}
+
+func (s HttpStore) memoUrl(setupHash api.FormulaSetupHash) string {
+	return s.baseUrl + "/memo/" + string(setupHash)
+}
+
+func (s HttpStore) Load(ctx context.Context, setupHash api.FormulaSetupHash) (*api.FormulaRunRecord, error) {
+	if !isValidSetupHash(setupHash) {
+		return nil, Errorf(repeatr.ErrUsage, "invalid setupHash %q", setupHash)
+	}
+	req, err := http.NewRequest("GET", s.memoUrl(setupHash), nil)
+	if err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "error reading memo server: %s", err)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "error reading memo server: %s", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Carry on.
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "error reading memo server: %s", httpError(resp))
+	}
+	rr := &api.FormulaRunRecord{}
+	if err := refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, resp.Body, api.Atlas_FormulaRunRecord).Unmarshal(rr); err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "error parsing memo for setupHash %q from memo server: %s", setupHash, err)
+	}
+	return rr, nil
+}
+
+func (s HttpStore) Save(ctx context.Context, setupHash api.FormulaSetupHash, rr *api.FormulaRunRecord) error {
+	if !isValidSetupHash(setupHash) {
+		return Errorf(repeatr.ErrUsage, "invalid setupHash %q", setupHash)
+	}
+	var buf bytes.Buffer
+	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{}, &buf, api.Atlas_FormulaRunRecord).Marshal(rr); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
+	req, err := http.NewRequest("PUT", s.memoUrl(setupHash), &buf)
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", httpError(resp))
+	}
+	return nil
+}
+
+// No remote locking; returns immediately.
+func (s HttpStore) Lock(context.Context, api.FormulaSetupHash, repeatr.Monitor) (func(), error) {
+	return func() {}, nil
+}
+
+// The memo server doesn't keep stats; ignored.
+func (s HttpStore) RecordStat(context.Context, bool) error {
+	return nil
+}
+
+// Describe an unexpected response: the status, and the start of the body
+//  (the server's error message, hopefully).
+func httpError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,62 @@
+package memo
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestHttpStore(t *testing.T) {
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		srv := httptest.NewServer(NewHandler(NewDirStore(tmpDir)))
+		defer srv.Close()
+		store := NewHttpStore(srv.URL, nil)
+		ctx := context.Background()
+
+		t.Run("missing memos should be nil nil", func(t *testing.T) {
+			rr, err := store.Load(ctx, "abcdef0123456789")
+			AssertNoError(t, err)
+			WantEqual(t, rr == nil, true)
+		})
+		t.Run("saved memos should load, from either side", func(t *testing.T) {
+			AssertNoError(t, store.Save(ctx, "abcdef0123456789", &api.FormulaRunRecord{Guid: "rr1", FormulaID: "abcdef0123456789"}))
+			rr, err := store.Load(ctx, "abcdef0123456789")
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "rr1")
+			rr, err = Load(tmpDir, "abcdef0123456789")
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "rr1")
+		})
+		t.Run("the server should refuse records for other setupHashes", func(t *testing.T) {
+			err := store.Save(ctx, "bbcdef0123456789", &api.FormulaRunRecord{Guid: "rr2", FormulaID: "abcdef0123456789"})
+			WantEqual(t, errcat.Category(err), repeatr.ErrLocalCacheProblem)
+			rr, err := Load(tmpDir, "bbcdef0123456789")
+			AssertNoError(t, err)
+			WantEqual(t, rr == nil, true)
+		})
+		t.Run("the server should take records for variants of their setupHash", func(t *testing.T) {
+			AssertNoError(t, store.Save(ctx, "abcdef0123456789.0011", &api.FormulaRunRecord{Guid: "rr3", FormulaID: "abcdef0123456789"}))
+			err := store.Save(ctx, "abcdef0123456789x.0011", &api.FormulaRunRecord{Guid: "rr3", FormulaID: "abcdef0123456789"})
+			WantEqual(t, errcat.Category(err), repeatr.ErrLocalCacheProblem)
+		})
+		t.Run("requests should give up when the context is cancelled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := store.Load(ctx, "abcdef0123456789")
+			WantEqual(t, errcat.Category(err), repeatr.ErrLocalCacheProblem)
+		})
+		t.Run("setupHashes which aren't memo names should be refused", func(t *testing.T) {
+			_, err := store.Load(ctx, "..")
+			WantEqual(t, errcat.Category(err), repeatr.ErrUsage)
+			_, err = store.Load(ctx, "stats")
+			WantEqual(t, errcat.Category(err), repeatr.ErrUsage)
+		})
+	})
+}
@@ -0,0 +1,296 @@
+package memo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/rio/fs"
+)
+
+// Tools for inspecting and pruning a memo dir.
+//  These work on the same layout the memo executor reads and writes.
+
+type Entry struct {
+	SetupHash api.FormulaSetupHash
+	RunRecord *api.FormulaRunRecord
+}
+
+/*
+	Load the memo for a setupHash, if there is one.
+	Returns nil nil if not.
+*/
+func Load(memoDir fs.AbsolutePath, setupHash api.FormulaSetupHash) (*api.FormulaRunRecord, error) {
+	if !isValidSetupHash(setupHash) {
+		return nil, Errorf(repeatr.ErrUsage, "invalid setupHash %q", setupHash)
+	}
+	return loadMemo(setupHash, memoDir)
+}
+
+/*
+	List all the memos in the memo dir, sorted by setupHash.
+
+	Any memos still in the old flat layout are migrated first.
+*/
+func List(memoDir fs.AbsolutePath) ([]Entry, error) {
+	if err := MigrateFlat(memoDir); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	err := filepath.Walk(memoDir.String(), func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && pth == memoDir.String() {
+				return filepath.SkipDir // No memo dir yet is the same as an empty one.
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(memoDir.String(), pth)
+		depth := strings.Count(rel, "/")
+		switch {
+		case info.IsDir() && depth < 2:
+			return nil
+		case info.IsDir():
+			return filepath.SkipDir
+		case depth != 2 || !isMemoName(info.Name()):
+			return nil
+		}
+		setupHash := api.FormulaSetupHash(info.Name())
+		rr, err := loadMemo(setupHash, memoDir)
+		if err != nil {
+			return err
+		}
+		if rr != nil { // may have been forgotten concurrently.
+			entries = append(entries, Entry{setupHash, rr})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "error listing memodir: %s", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].SetupHash < entries[j].SetupHash })
+	return entries, nil
+}
+
+/*
+	List the keys of all the memos for a setupHash: its own, and those of
+	its variants (see memoKey), sorted.
+*/
+func Keys(memoDir fs.AbsolutePath, setupHash api.FormulaSetupHash) ([]api.FormulaSetupHash, error) {
+	if !isValidSetupHash(setupHash) {
+		return nil, Errorf(repeatr.ErrUsage, "invalid setupHash %q", setupHash)
+	}
+	if err := migrateFlatMemo(setupHash, memoDir); err != nil {
+		return nil, err
+	}
+	pth := memoPath(setupHash, memoDir).String()
+	variants, _ := filepath.Glob(pth + ".*") // Only errors on bad patterns.
+	var keys []api.FormulaSetupHash
+	for _, p := range append([]string{pth}, variants...) {
+		if !isMemoName(filepath.Base(p)) {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			keys = append(keys, api.FormulaSetupHash(filepath.Base(p)))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
+
+/*
+	Remove the memo for a setupHash, and its lock file (unless a run of
+	the formula is holding the lock right now).
+	Returns false if there was no memo.
+*/
+func Forget(memoDir fs.AbsolutePath, setupHash api.FormulaSetupHash) (bool, error) {
+	if !isValidSetupHash(setupHash) {
+		return false, Errorf(repeatr.ErrUsage, "invalid setupHash %q", setupHash)
+	}
+	if err := migrateFlatMemo(setupHash, memoDir); err != nil {
+		return false, err
+	}
+	pth := memoPath(setupHash, memoDir).String()
+	if err := removeIdleLock(pth + ".lock"); err != nil {
+		return false, err
+	}
+	err := os.Remove(pth)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, Errorf(repeatr.ErrLocalCacheProblem, "could not forget memo: %s", err)
+	}
+}
+
+/*
+	Prune the memo dir: remove memos whose run is older than olderThan
+	(if it's nonzero), and then the oldest memos beyond maxEntries
+	(if it's nonzero).  Returns the setupHashes of the memos removed.
+
+	Stale tempfiles left by interrupted writes are cleaned up as well,
+	as are the lock files of runs which died.
+*/
+func GC(memoDir fs.AbsolutePath, olderThan time.Duration, maxEntries int, now time.Time) ([]api.FormulaSetupHash, error) {
+	entries, err := List(memoDir)
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first; setupHash breaks ties, so it's deterministic.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].RunRecord.Time < entries[j].RunRecord.Time })
+	var doomed []api.FormulaSetupHash
+	for i, entry := range entries {
+		tooOld := olderThan > 0 && time.Unix(entry.RunRecord.Time, 0).Before(now.Add(-olderThan))
+		tooMany := maxEntries > 0 && len(entries)-i > maxEntries
+		if tooOld || tooMany {
+			doomed = append(doomed, entry.SetupHash)
+		}
+	}
+	var removed []api.FormulaSetupHash
+	for _, setupHash := range doomed {
+		ok, err := Forget(memoDir, setupHash)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, setupHash)
+		}
+	}
+	locks, _ := filepath.Glob(memoDir.String() + "/*/*/*.lock")
+	for _, lock := range locks {
+		if err := removeIdleLock(lock); err != nil {
+			return removed, err
+		}
+	}
+	tmps, _ := filepath.Glob(memoDir.String() + "/*/*/.tmp.memo.*")
+	for _, tmp := range tmps {
+		if info, err := os.Stat(tmp); err == nil && info.ModTime().Before(now.Add(-time.Hour)) {
+			os.Remove(tmp)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	return removed, nil
+}
+
+/*
+	Move every memo in the old flat layout (`memoDir/<setupHash>`) into
+	the sharded layout.  (The memo executor also does this lazily, one
+	setupHash at a time, as it looks them up.)
+*/
+func MigrateFlat(memoDir fs.AbsolutePath) error {
+	fis, err := ioutil.ReadDir(memoDir.String())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return Errorf(repeatr.ErrLocalCacheProblem, "error reading memodir: %s", err)
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !isMemoName(fi.Name()) || len(fi.Name()) < 6 {
+			continue
+		}
+		if err := migrateFlatMemo(api.FormulaSetupHash(fi.Name()), memoDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether a filename in the memo dir is a memo (and not a lock, tempfile, or the stats).
+func isMemoName(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".lock") && name != statsFilename
+}
+
+/*
+	Counters of how often the memo executor found a memo (hits),
+	and how often it had to run the formula (misses).
+*/
+type Stats struct {
+	Hits   int64
+	Misses int64
+}
+
+var (
+	Stats_AtlasEntry = atlas.BuildEntry(Stats{}).StructMap().Autogenerate().Complete()
+	atl_stats        = atlas.MustBuild(Stats_AtlasEntry)
+)
+
+const statsFilename = "stats"
+
+func statsPath(memoDir fs.AbsolutePath) string {
+	return memoDir.Join(fs.MustRelPath(statsFilename)).String()
+}
+
+/*
+	Load the memo dir's hit/miss counters.
+	A memo dir with no stats yet has all zeros.
+*/
+func LoadStats(memoDir fs.AbsolutePath) (Stats, error) {
+	var stats Stats
+	f, err := os.Open(statsPath(memoDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, Errorf(repeatr.ErrLocalCacheProblem, "error reading memo stats: %s", err)
+	}
+	defer f.Close()
+	if err := refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, f, atl_stats).Unmarshal(&stats); err != nil {
+		return stats, Errorf(repeatr.ErrLocalCacheProblem, "error parsing memo stats: %s", err)
+	}
+	return stats, nil
+}
+
+/*
+	Count a hit or miss.  Concurrent runs serialize on a flock of the
+	stats file, and the new counts are renamed into place.
+*/
+func recordStat(memoDir fs.AbsolutePath, hit bool) error {
+	if err := os.MkdirAll(memoDir.String(), 0755); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not record memo stats: %s", err)
+	}
+	lock, err := os.OpenFile(statsPath(memoDir)+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not record memo stats: %s", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not record memo stats: %s", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	stats, err := LoadStats(memoDir)
+	if err != nil {
+		return err
+	}
+	if hit {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	f, err := ioutil.TempFile(memoDir.String(), ".tmp.stats.")
+	if err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not record memo stats: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{}, f, atl_stats).Marshal(stats); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not record memo stats: %s", err)
+	}
+	if err := os.Rename(f.Name(), statsPath(memoDir)); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not record memo stats: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package memo
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestMemoGC(t *testing.T) {
+	now := time.Unix(100000, 0)
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		for h, age := range map[api.FormulaSetupHash]time.Duration{
+			"aaaaaa1": 3 * time.Hour,
+			"bbbbbb2": 2 * time.Hour,
+			"cccccc3": 1 * time.Hour,
+		} {
+			AssertNoError(t, saveMemo(h, tmpDir, &api.FormulaRunRecord{Time: now.Add(-age).Unix()}))
+		}
+		removed, err := GC(tmpDir, 150*time.Minute, 0, now)
+		AssertNoError(t, err)
+		WantEqual(t, removed, []api.FormulaSetupHash{"aaaaaa1"})
+		removed, err = GC(tmpDir, 0, 1, now)
+		AssertNoError(t, err)
+		WantEqual(t, removed, []api.FormulaSetupHash{"bbbbbb2"})
+		entries, err := List(tmpDir)
+		AssertNoError(t, err)
+		AssertEqual(t, len(entries), 1)
+		WantEqual(t, entries[0].SetupHash, api.FormulaSetupHash("cccccc3"))
+	})
+}
+
+func TestMemoStats(t *testing.T) {
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		AssertNoError(t, recordStat(tmpDir, true))
+		AssertNoError(t, recordStat(tmpDir, false))
+		AssertNoError(t, recordStat(tmpDir, true))
+		stats, err := LoadStats(tmpDir)
+		AssertNoError(t, err)
+		WantEqual(t, stats, Stats{Hits: 2, Misses: 1})
+		// The stats file shouldn't look like a memo.
+		entries, err := List(tmpDir)
+		AssertNoError(t, err)
+		WantEqual(t, len(entries), 0)
+	})
+}
+
+func TestMemoLockFiles(t *testing.T) {
+	exists := func(pth string) bool {
+		_, err := os.Stat(pth)
+		return err == nil
+	}
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		lockPth := memoPath("aaaaaa1", tmpDir).String() + ".lock"
+
+		unlock, err := lockMemo(context.Background(), "aaaaaa1", tmpDir, repeatr.Monitor{})
+		AssertNoError(t, err)
+		WantEqual(t, exists(lockPth), true)
+		unlock()
+		WantEqual(t, exists(lockPth), false)
+
+		// A held lock survives forgetting the memo; an idle one doesn't.
+		AssertNoError(t, saveMemo("aaaaaa1", tmpDir, &api.FormulaRunRecord{}))
+		unlock, err = lockMemo(context.Background(), "aaaaaa1", tmpDir, repeatr.Monitor{})
+		AssertNoError(t, err)
+		_, err = Forget(tmpDir, "aaaaaa1")
+		AssertNoError(t, err)
+		WantEqual(t, exists(lockPth), true)
+		unlock()
+		f, err := os.Create(lockPth) // As if left by a process which died.
+		AssertNoError(t, err)
+		f.Close()
+		_, err = Forget(tmpDir, "aaaaaa1")
+		AssertNoError(t, err)
+		WantEqual(t, exists(lockPth), false)
+
+		// GC sweeps up idle locks even without a memo beside them.
+		f, err = os.Create(lockPth)
+		AssertNoError(t, err)
+		f.Close()
+		_, err = GC(tmpDir, time.Hour, 0, time.Now())
+		AssertNoError(t, err)
+		WantEqual(t, exists(lockPth), false)
+	})
+}
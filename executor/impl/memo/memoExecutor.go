@@ -2,29 +2,49 @@ package memo
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	. "github.com/warpfork/go-errcat"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
-	"go.polydawn.net/rio/fs"
 )
 
 type Executor struct {
-	memoDir  fs.AbsolutePath
+	store    Store
+	variant  string                                             // Keyed on besides the setupHash.  (See executor.Config.MemoVariant.)
+	trust    func(*api.FormulaRunRecord) error                  // Optional.  If set, memos it errors on are ignored.
+	replay   func(*api.FormulaRunRecord, repeatr.Monitor) error // Optional.  If set, called to replay a memo's output.
 	delegate repeatr.RunFunc
 }
 
 func NewExecutor(
-	memoDir fs.AbsolutePath,
+	store Store,
+	variant string,
+	trust func(*api.FormulaRunRecord) error,
+	replay func(*api.FormulaRunRecord, repeatr.Monitor) error,
 	delegate repeatr.RunFunc,
 ) (repeatr.RunFunc, error) {
 	return Executor{
-		memoDir, delegate,
+		store, variant, trust, replay, delegate,
 	}.Run, nil
 }
 
+/*
+	The key a memo is kept under in the store: the formula's setupHash,
+	and if there's a variant, a hash of it after a dot.  So all the memos
+	for one formula are kept side by side (see Keys).
+*/
+func memoKey(setupHash api.FormulaSetupHash, variant string) api.FormulaSetupHash {
+	if variant == "" {
+		return setupHash
+	}
+	sum := sha256.Sum256([]byte(variant))
+	return api.FormulaSetupHash(string(setupHash) + "." + hex.EncodeToString(sum[:8]))
+}
+
 var _ repeatr.RunFunc = Executor{}.Run
 
 func (cfg Executor) Run(
@@ -38,28 +58,40 @@ func (cfg Executor) Run(
 
 	// Consider possibility of early return of memoization data.
 	//  If a memo dir is set and it contains a relevant record, we just echo it.
-	rr, err := loadMemo(formula.SetupHash(), cfg.memoDir)
+	setupHash := formula.SetupHash()
+	key := memoKey(setupHash, cfg.variant)
+	rr, err := cfg.loadMemo(ctx, key, setupHash, mon)
 	if err != nil {
 		return nil, err
 	}
 	if rr != nil {
-		mon.Send(repeatr.Event_Log{
-			Time:  time.Now(),
-			Level: repeatr.LogInfo,
-			Msg:   "memoized runRecord found for formula setupHash; eliding run",
-			Detail: [][2]string{
-				{"setupHash", string(formula.SetupHash())},
-			},
-		})
+		cfg.echoMemo(ctx, setupHash, rr, mon)
+		return rr, nil
+	}
+
+	// Lock, so that identical formulas don't run in parallel: whoever's
+	//  second waits, and then most likely gets the first one's memo.
+	unlock, err := cfg.store.Lock(ctx, key, mon)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	rr, err = cfg.loadMemo(ctx, key, setupHash, mon)
+	if err != nil {
+		return nil, err
+	}
+	if rr != nil {
+		cfg.echoMemo(ctx, setupHash, rr, mon)
 		return rr, nil
 	}
 
 	// If no shortcut: delegate to the real executor to do work!
+	cfg.recordStat(ctx, false, mon)
 	rr, err = cfg.delegate(ctx, formula, formulaCtx, input, mon)
 
 	// Save memo for next time (unless there was an executor error).
 	if err == nil {
-		if err := saveMemo(formula.SetupHash(), cfg.memoDir, rr); err != nil {
+		if err := cfg.store.Save(ctx, key, rr); err != nil {
 			mon.Send(repeatr.Event_Log{
 				Time:  time.Now(),
 				Level: repeatr.LogWarn,
@@ -73,3 +105,79 @@ func (cfg Executor) Run(
 
 	return rr, err
 }
+
+// Load a memo from the store, and check it's really for the setupHash
+//  (a store may be shared, or remote), and trustworthy if we're picky.
+//  Records that aren't are ignored.
+func (cfg Executor) loadMemo(ctx context.Context, key, setupHash api.FormulaSetupHash, mon repeatr.Monitor) (*api.FormulaRunRecord, error) {
+	rr, err := cfg.store.Load(ctx, key)
+	if err != nil || rr == nil {
+		return nil, err
+	}
+	if rr.FormulaID != setupHash {
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   "memoized runRecord is for a different formula; ignoring it",
+			Detail: [][2]string{
+				{"setupHash", string(setupHash)},
+				{"formulaID", string(rr.FormulaID)},
+			},
+		})
+		return nil, nil
+	}
+	if cfg.trust != nil {
+		if err := cfg.trust(rr); err != nil {
+			mon.Send(repeatr.Event_Log{
+				Time:  time.Now(),
+				Level: repeatr.LogWarn,
+				Msg:   "memoized runRecord is not trusted; ignoring it",
+				Detail: [][2]string{
+					{"setupHash", string(setupHash)},
+					{"err", err.Error()},
+				},
+			})
+			return nil, nil
+		}
+	}
+	return rr, nil
+}
+
+func (cfg Executor) echoMemo(ctx context.Context, setupHash api.FormulaSetupHash, rr *api.FormulaRunRecord, mon repeatr.Monitor) {
+	cfg.recordStat(ctx, true, mon)
+	mon.Send(repeatr.Event_Log{
+		Time:  time.Now(),
+		Level: repeatr.LogInfo,
+		Msg:   "memoized runRecord found for formula setupHash; eliding run",
+		Detail: [][2]string{
+			{"setupHash", string(setupHash)},
+		},
+	})
+	if cfg.replay == nil {
+		return
+	}
+	if err := cfg.replay(rr, mon); err != nil {
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   "output of memoized run is not available to replay",
+			Detail: [][2]string{
+				{"err", err.Error()},
+			},
+		})
+	}
+}
+
+// Count a hit or miss in the memo dir's stats.  Failing to is only worth a warning.
+func (cfg Executor) recordStat(ctx context.Context, hit bool, mon repeatr.Monitor) {
+	if err := cfg.store.RecordStat(ctx, hit); err != nil {
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   "recording memo stats failed",
+			Detail: [][2]string{
+				{"err", err.Error()},
+			},
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package memo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestMemoExecutor(t *testing.T) {
+	frm := api.Formula{Action: api.FormulaAction{Exec: []string{"/bin/true"}}}
+	runs := 0
+	delegate := func(_ context.Context, frm api.Formula, _ repeatr.FormulaContext, _ repeatr.InputControl, _ repeatr.Monitor) (*api.FormulaRunRecord, error) {
+		runs++
+		return &api.FormulaRunRecord{Guid: "fresh", FormulaID: frm.SetupHash()}, nil
+	}
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		store := NewDirStore(tmpDir)
+		runTool, err := NewExecutor(store, "", nil, nil, delegate)
+		AssertNoError(t, err)
+
+		t.Run("memos for the wrong formula should be ignored", func(t *testing.T) {
+			AssertNoError(t, store.Save(context.Background(), frm.SetupHash(), &api.FormulaRunRecord{Guid: "bogus", FormulaID: "something-else"}))
+			rr, err := runTool(context.Background(), frm, repeatr.FormulaContext{}, repeatr.InputControl{}, repeatr.Monitor{})
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "fresh")
+			WantEqual(t, runs, 1)
+		})
+		t.Run("the second run should be memoized", func(t *testing.T) {
+			rr, err := runTool(context.Background(), frm, repeatr.FormulaContext{}, repeatr.InputControl{}, repeatr.Monitor{})
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "fresh")
+			WantEqual(t, runs, 1)
+			stats, err := LoadStats(tmpDir)
+			AssertNoError(t, err)
+			WantEqual(t, stats, Stats{Hits: 1, Misses: 1})
+		})
+		t.Run("untrusted memos should be ignored", func(t *testing.T) {
+			runTool, err := NewExecutor(store, "", func(*api.FormulaRunRecord) error {
+				return fmt.Errorf("nope")
+			}, nil, delegate)
+			AssertNoError(t, err)
+			rr, err := runTool(context.Background(), frm, repeatr.FormulaContext{}, repeatr.InputControl{}, repeatr.Monitor{})
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "fresh")
+			WantEqual(t, runs, 2)
+		})
+		t.Run("variants should be memoized apart", func(t *testing.T) {
+			runTool, err := NewExecutor(store, "network=loopback", nil, nil, delegate)
+			AssertNoError(t, err)
+			for i := 0; i < 2; i++ {
+				rr, err := runTool(context.Background(), frm, repeatr.FormulaContext{}, repeatr.InputControl{}, repeatr.Monitor{})
+				AssertNoError(t, err)
+				WantEqual(t, rr.FormulaID, frm.SetupHash())
+			}
+			WantEqual(t, runs, 3)
+			keys, err := Keys(tmpDir, frm.SetupHash())
+			AssertNoError(t, err)
+			WantEqual(t, keys, []api.FormulaSetupHash{frm.SetupHash(), memoKey(frm.SetupHash(), "network=loopback")})
+		})
+	})
+}
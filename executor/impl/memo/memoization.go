@@ -1,7 +1,12 @@
 package memo
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/polydawn/refmt"
 	"github.com/polydawn/refmt/json"
@@ -16,8 +21,14 @@ import (
 	Attempt to load a memoized runRecord.
 
 	If it doesn't exist (or memoDir is zero entirely), returns nil nil.
+
+	Memos from the old flat layout (`memoDir/<setupHash>`) are still found,
+	and are moved into the sharded layout as they are.
 */
 func loadMemo(setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath) (rr *api.FormulaRunRecord, err error) {
+	if err := migrateFlatMemo(setupHash, memoDir); err != nil {
+		return nil, err
+	}
 	// Try to open file.
 	f, err := os.Open(memoPath(setupHash, memoDir).String())
 	if err != nil {
@@ -37,21 +48,179 @@ func loadMemo(setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath) (rr *api.
 	return rr, nil
 }
 
+/*
+	Save a memoized runRecord.
+
+	The record is written to a tempfile in the same dir and then renamed
+	into place, so concurrent readers see either the whole record or none.
+*/
 func saveMemo(setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath, rr *api.FormulaRunRecord) error {
-	// Open file.
-	f, err := os.OpenFile(memoPath(setupHash, memoDir).String(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	pth := memoPath(setupHash, memoDir).String()
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
+	// Open tempfile.
+	f, err := ioutil.TempFile(filepath.Dir(pth), ".tmp.memo.")
 	if err != nil {
 		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
 	}
+	defer os.Remove(f.Name()) // no-op if we made it to the rename.
 	defer f.Close()
+	if err := f.Chmod(0644); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
 	// Write.
 	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{}, f, api.Atlas_FormulaRunRecord).Marshal(rr); err != nil {
 		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
 	}
+	if err := f.Sync(); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
+	// Move into place.
+	if err := os.Rename(f.Name(), pth); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not save memo: %s", err)
+	}
 	return nil
 }
 
+/*
+	Take an exclusive lock on the memo for a setupHash, blocking until we
+	get it or the context is cancelled.
+
+	Holding the lock means no one else is running the same formula with
+	the same memodir; so once we have it, it's worth checking for a memo
+	again, since the previous holder will usually just have saved one.
+
+	The lock is a flock on a file beside the memo, and so is released
+	if we die.  Whoever holds the lock removes the file when they're done
+	with it (and so a lock is only ours if the file we locked is still
+	the one at the path: see tryLockFile).  Files left by processes which
+	died are cleaned up by Forget and GC.
+*/
+func lockMemo(ctx context.Context, setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath, mon repeatr.Monitor) (unlock func(), err error) {
+	pth := memoPath(setupHash, memoDir).String() + ".lock"
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "could not lock memo: %s", err)
+	}
+	for waited := false; ; waited = true {
+		unlock, err := tryLockFile(pth, true)
+		if err != nil {
+			return nil, err
+		}
+		if unlock != nil {
+			return unlock, nil
+		}
+		if !waited {
+			mon.Send(repeatr.Event_Log{
+				Time:  time.Now(),
+				Level: repeatr.LogInfo,
+				Msg:   "another run of this formula setupHash is in progress; waiting for its memo",
+				Detail: [][2]string{
+					{"setupHash", string(setupHash)},
+				},
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return nil, Errorf(repeatr.ErrCancelled, "cancelled while waiting for memo lock")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+/*
+	Try once to take the lock on a lock file (creating it, if create is
+	set).  Returns nil unlock if someone else has it, or if there's no
+	file and create isn't set.  Unlocking removes the file.
+
+	Since lock files are removed while locked, having the flock isn't
+	enough: if the file was removed while we waited, we've locked a file
+	no one else will ever look at.  So we check the one at the path is
+	still ours, and if not, count it as someone else's turn.
+*/
+func tryLockFile(pth string, create bool) (unlock func(), err error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(pth, flags, 0644)
+	if err != nil {
+		if os.IsNotExist(err) && !create {
+			return nil, nil
+		}
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "could not lock memo: %s", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "could not lock memo: %s", err)
+	}
+	ours, err1 := f.Stat()
+	current, err2 := os.Stat(pth)
+	if err1 != nil || err2 != nil || !os.SameFile(ours, current) {
+		f.Close()
+		return nil, nil
+	}
+	return func() {
+		os.Remove(pth)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Remove a lock file, if no one holds the lock.  (If someone does,
+//  they'll remove it themselves.)
+func removeIdleLock(pth string) error {
+	unlock, err := tryLockFile(pth, false)
+	if unlock != nil {
+		unlock()
+	}
+	return err
+}
+
+/*
+	Returns the path for the memo for a setupHash.
+
+	Memos are sharded like rio's warehouses and caches ("threesplits"):
+	`memoDir/abc/def/abcdef...`, so no one dir gets unreasonably large.
+*/
 func memoPath(setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath) fs.AbsolutePath {
-	// REVIEW should probably use the threesplits too I guess?  unclear how far this needs to scale.
+	h := string(setupHash)
+	if len(h) < 6 {
+		// Not a real hash; there's nothing to shard on.
+		return memoDir.Join(fs.MustRelPath(h))
+	}
+	return memoDir.Join(fs.MustRelPath(h[0:3] + "/" + h[3:6] + "/" + h))
+}
+
+// Returns the path a memo would have had before sharding.
+func flatMemoPath(setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath) fs.AbsolutePath {
 	return memoDir.Join(fs.MustRelPath(string(setupHash)))
 }
+
+// If there's a memo for the setupHash in the old flat layout, move it
+//  to its sharded path.  If there's already one there, the old one is dropped.
+func migrateFlatMemo(setupHash api.FormulaSetupHash, memoDir fs.AbsolutePath) error {
+	oldPth := flatMemoPath(setupHash, memoDir).String()
+	newPth := memoPath(setupHash, memoDir).String()
+	if oldPth == newPth {
+		return nil
+	}
+	stat, err := os.Lstat(oldPth)
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil // Nothing to migrate.
+	}
+	if err := os.MkdirAll(filepath.Dir(newPth), 0755); err != nil {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not migrate memo: %s", err)
+	}
+	if _, err := os.Stat(newPth); err == nil {
+		os.Remove(oldPth)
+		return nil
+	}
+	if err := os.Rename(oldPth, newPth); err != nil && !os.IsNotExist(err) {
+		return Errorf(repeatr.ErrLocalCacheProblem, "could not migrate memo: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package memo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestMemoStorage(t *testing.T) {
+	setupHash := api.FormulaSetupHash("abcdef0123456789")
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		t.Run("memos should be sharded", func(t *testing.T) {
+			WantEqual(t, memoPath(setupHash, tmpDir).String(), tmpDir.String()+"/abc/def/abcdef0123456789")
+		})
+		t.Run("missing memos should be nil nil", func(t *testing.T) {
+			rr, err := loadMemo(setupHash, tmpDir)
+			AssertNoError(t, err)
+			WantEqual(t, rr == nil, true)
+		})
+		t.Run("saved memos should load", func(t *testing.T) {
+			AssertNoError(t, saveMemo(setupHash, tmpDir, &api.FormulaRunRecord{Guid: "rr1", ExitCode: 4}))
+			rr, err := loadMemo(setupHash, tmpDir)
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "rr1")
+			WantEqual(t, rr.ExitCode, 4)
+			// No tempfiles should be left lying around.
+			fis, err := ioutil.ReadDir(tmpDir.String() + "/abc/def")
+			AssertNoError(t, err)
+			WantEqual(t, len(fis), 1)
+		})
+	})
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		t.Run("flat memos should be migrated", func(t *testing.T) {
+			AssertNoError(t, saveMemo(setupHash, tmpDir, &api.FormulaRunRecord{Guid: "rr1"}))
+			AssertNoError(t, os.Rename(memoPath(setupHash, tmpDir).String(), flatMemoPath(setupHash, tmpDir).String()))
+			rr, err := loadMemo(setupHash, tmpDir)
+			AssertNoError(t, err)
+			WantEqual(t, rr.Guid, "rr1")
+			_, err = os.Stat(flatMemoPath(setupHash, tmpDir).String())
+			WantEqual(t, os.IsNotExist(err), true)
+		})
+	})
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		t.Run("memo locks should be exclusive", func(t *testing.T) {
+			unlock, err := lockMemo(context.Background(), setupHash, tmpDir, repeatr.Monitor{})
+			AssertNoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = lockMemo(ctx, setupHash, tmpDir, repeatr.Monitor{})
+			WantEqual(t, errcat.Category(err), repeatr.ErrCancelled)
+			unlock()
+			unlock, err = lockMemo(ctx, setupHash, tmpDir, repeatr.Monitor{})
+			AssertNoError(t, err)
+			unlock()
+		})
+	})
+}
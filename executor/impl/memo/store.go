@@ -0,0 +1,68 @@
+package memo
+
+import (
+	"context"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Store is where memoized runRecords are kept.
+
+	The memo executor doesn't trust a store to return the record it asked
+	for: records are checked against the formula's setupHash before use.
+	So a store can be shared, remote, etc.
+
+	Every method takes a context, since a remote store may be slow or
+	gone: they should give up once it's cancelled.
+*/
+type Store interface {
+	// Load the memo for a setupHash.  Returns nil nil if there is none.
+	Load(ctx context.Context, setupHash api.FormulaSetupHash) (*api.FormulaRunRecord, error)
+
+	// Save a memo.  It should become visible to Load all at once, or not at all.
+	Save(ctx context.Context, setupHash api.FormulaSetupHash, rr *api.FormulaRunRecord) error
+
+	// Lock the memo for a setupHash, blocking until we have it (or the
+	//  context is cancelled), so that identical formulas don't run at once.
+	//  Stores which can't lock may return immediately.
+	Lock(ctx context.Context, setupHash api.FormulaSetupHash, mon repeatr.Monitor) (unlock func(), err error)
+
+	// Count a hit or a miss.  Stores which don't keep stats may ignore it.
+	RecordStat(ctx context.Context, hit bool) error
+}
+
+var (
+	_ Store = DirStore{}
+	_ Store = HttpStore{}
+)
+
+/*
+	DirStore keeps memos in a local directory (see memoPath for the layout).
+	The directory can be shared by concurrent repeatr processes.
+*/
+type DirStore struct {
+	memoDir fs.AbsolutePath
+}
+
+func NewDirStore(memoDir fs.AbsolutePath) DirStore {
+	return DirStore{memoDir}
+}
+
+func (s DirStore) Load(_ context.Context, setupHash api.FormulaSetupHash) (*api.FormulaRunRecord, error) {
+	return loadMemo(setupHash, s.memoDir)
+}
+
+func (s DirStore) Save(_ context.Context, setupHash api.FormulaSetupHash, rr *api.FormulaRunRecord) error {
+	return saveMemo(setupHash, s.memoDir, rr)
+}
+
+func (s DirStore) Lock(ctx context.Context, setupHash api.FormulaSetupHash, mon repeatr.Monitor) (func(), error) {
+	return lockMemo(ctx, setupHash, s.memoDir, mon)
+}
+
+func (s DirStore) RecordStat(_ context.Context, hit bool) error {
+	return recordStat(s.memoDir, hit)
+}
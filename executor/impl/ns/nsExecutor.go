@@ -0,0 +1,336 @@
+package ns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/repeatr/executor/cradle"
+	"go.polydawn.net/repeatr/executor/mixins"
+	"go.polydawn.net/repeatr/executor/policy"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/stitch"
+)
+
+/*
+	The ns executor sets up linux namespaces itself, with no plugin binaries.
+
+	The job is launched by re-executing our own binary as a small init shim
+	(see nsInit.go), in fresh pid, mount, uts, ipc, and net namespaces --
+	and, in rootless mode, a user namespace, mapped onto our subordinate ids.
+	(The net namespace is skipped if the job asks for the host network.)
+	The shim sets up the container's mounts, hostname, and credentials,
+	then starts the job's command, and stays on as its init (pid 1).
+
+	There are no cgroups involved, so only those limits which can be enforced
+	by plain rlimits are supported.
+*/
+type Executor struct {
+	workspaceFs   fs.FS             // A working dir per execution will be made in here.
+	assemblerTool *stitch.Assembler // Contains: unpackTool, caching cfg, and placer tools.
+	packTool      rio.PackFunc
+	config        executor.Config // Host settings.  (Only rlimits and shm size are supported.)
+}
+
+func NewExecutor(
+	workDir fs.AbsolutePath,
+	unpackTool rio.UnpackFunc,
+	packTool rio.PackFunc,
+	config executor.Config,
+) (repeatr.RunFunc, error) {
+	// We have no cgroups, so refuse the limits which would need them,
+	//  rather than quietly running the job unconstrained.
+	if config.Limits.NeedsCgroups() {
+		return nil, Errorf(repeatr.ErrUsage, "the ns executor does not support memory, cpu, or pids limits")
+	}
+	asm, err := stitch.NewAssembler(unpackTool)
+	if err != nil {
+		return nil, repeatr.ReboxRioError(err)
+	}
+	return Executor{
+		osfs.New(workDir),
+		asm,
+		packTool,
+		config,
+	}.Run, nil
+}
+
+var _ repeatr.RunFunc = Executor{}.Run
+
+func (cfg Executor) Run(
+	ctx context.Context,
+	formula api.Formula,
+	formulaCtx repeatr.FormulaContext,
+	input repeatr.InputControl,
+	mon repeatr.Monitor,
+) (_ *api.FormulaRunRecord, err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+
+	// Workspace setup and params defaulting.
+	formula = cradle.FormulaDefaults(formula)          // Initialize formula default values.
+	rr := api.FormulaRunRecord{}                       // Start filling out record keeping!
+	formula = mixins.InitJob(&rr, formula, cfg.config) // Includes picking a random guid for the job, which we use in all temp files.
+
+	// Make work dirs. Including whole workspace dir and parents, if necessary.
+	jobFs, chrootFs, err := mixins.MakeWorkDirs(cfg.workspaceFs, rr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use standard filesystem setup/teardown, handing it our 'run' thunk
+	//  to invoke while it's living.
+	rr.Results, err = mixins.WithFilesystem(ctx,
+		jobFs, chrootFs, cfg.assemblerTool, cfg.packTool,
+		formula, formulaCtx, mon, &rr, cfg.config,
+		func(chrootFs fs.FS) (err error) {
+			rr.ExitCode, err = cfg.run(ctx, &rr, formula.Action, jobFs, chrootFs, input, mon)
+			return
+		},
+	)
+	mixins.RecordCancellation(&rr, err)
+	return &rr, err
+}
+
+func (cfg Executor) run(
+	ctx context.Context,
+	rr *api.FormulaRunRecord, // for the job ID, and recording resource usage.
+	action api.FormulaAction,
+	jobFs fs.FS, // a spot for other tmp/job-lifetime files.
+	chrootFs fs.FS,
+	input repeatr.InputControl,
+	mon repeatr.Monitor,
+) (int, error) {
+	// Check that action commands appear to be executable on this filesystem.
+	if err := mixins.CheckFSReadyForExec(action, chrootFs); err != nil {
+		return -1, err
+	}
+
+	// Configure the container.
+	//  This is the message we'll send to our init shim.
+	caps, err := policy.GetCapsForPolicy(action.Policy)
+	if err != nil {
+		return -1, err
+	}
+	if err := policy.CheckNetwork(cfg.config.Job.Network, action.Policy); err != nil {
+		return -1, err
+	}
+	umask, err := cfg.config.Job.ParseUmask()
+	if err != nil {
+		return -1, err
+	}
+	var idmaps executor.IdMappings
+	if cfg.config.Rootless {
+		if err := policy.CheckRootless(action.Policy); err != nil {
+			return -1, err
+		}
+		idmaps, err = executor.RootlessIdMappings(*action.Userinfo.Uid, *action.Userinfo.Gid)
+		if err != nil {
+			return -1, err
+		}
+	}
+	initCfg := initConfig{
+		Root:     chrootFs.BasePath().String(),
+		Hostname: cradle.Hostname(action, rr, cfg.config),
+		Cwd:      string(action.Cwd),
+		Exec:     action.Exec,
+		Env:      envToSlice(action.Env),
+		Uid:      uint32(*action.Userinfo.Uid),
+		Gid:      uint32(*action.Userinfo.Gid),
+		Groups:   cfg.config.Job.Groups,
+		Umask:    int(umask),
+		Caps:     caps,
+		Rlimits:  cfg.config.Limits.Rlimits,
+		ShmSize:  cfg.config.Limits.ShmSize,
+		Rootless: cfg.config.Rootless,
+		Loopback: cfg.config.Job.Network == executor.Network_Loopback,
+	}
+	if cfg.config.Deterministic {
+		if monotonic, boottime, ok := cradle.ClockOffsets(); ok {
+			initCfg.ClockOffsets = &clockOffsets{monotonic, boottime}
+		}
+	}
+
+	// Pipes for talking to the init shim: one to send it config,
+	//  and one it reports setup errors on.  The shim closes the latter
+	//  once the job has started, so if it reaches EOF without a message,
+	//  the job launched.
+	cfgR, cfgW, err := os.Pipe()
+	if err != nil {
+		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", err)
+	}
+	defer cfgR.Close()
+	defer cfgW.Close()
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", err)
+	}
+	defer errR.Close()
+	defer errW.Close()
+
+	// Template the command: ourselves, again, as the init shim.
+	//  It gets the job's environment rather than ours: it stays running
+	//  in the container as pid 1, with its environment in /proc/1/environ.
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{initArg0},
+		Env:        initCfg.Env,
+		ExtraFiles: []*os.File{cfgR, errW}, // These become fds 3 and 4.
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWPID |
+				syscall.CLONE_NEWNS |
+				syscall.CLONE_NEWUTS |
+				syscall.CLONE_NEWIPC,
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+	if cfg.config.Job.Network != executor.Network_Host {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if cfg.config.Rootless {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	}
+
+	// Wire I/O.  (See mixins.JobIO for how: a terminal if interactive,
+	//  and otherwise pipes.)
+	out := mixins.NewOutputForwarder(ctx, mon, cfg.config.Output)
+	defer out.Close()
+	jobIO, err := mixins.AttachIO(ctx, cmd, input, cfg.config.TerminalSize, out)
+	if err != nil {
+		return -1, err
+	}
+
+	// Invoke!  Then send the shim its config, and wait to hear how setup went.
+	//  (If rootless, we have to give it id mappings first; the shim won't
+	//  do anything until it's read its config, so there's no race.)
+	if err := cmd.Start(); err != nil {
+		jobIO.Abort()
+		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", err)
+	}
+	jobIO.Started()
+	defer jobIO.Wait() // For the early returns.
+	cfgR.Close()
+	errW.Close()
+	if cfg.config.Rootless {
+		if err := writeIdMappings(cmd.Process.Pid, idmaps); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return -1, err
+		}
+	}
+	// List the job, for `repeatr ps` and `repeatr exec`.
+	defer mixins.RegisterJob(jobFs, mixins.RunningJob{
+		Guid:      rr.Guid,
+		SetupHash: rr.FormulaID,
+		Executor:  "ns",
+		Pid:       cmd.Process.Pid,
+		Uid:       *action.Userinfo.Uid,
+		Gid:       *action.Userinfo.Gid,
+	}, mon)()
+	awaitCancel := mixins.SignalOnCancel(out.Context(), mon, func(sig syscall.Signal) error {
+		// The init shim forwards signals to the job; SIGKILL kills the
+		//  shim, and with it, everything in the job's pid namespace.
+		return cmd.Process.Signal(sig)
+	})
+	if err := json.NewEncoder(cfgW).Encode(initCfg); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		awaitCancel()
+		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: cannot configure init: %s", err)
+	}
+	cfgW.Close()
+	setupErr, _ := ioutil.ReadAll(errR)
+
+	// Await command completion; return its exit code.
+	exitCode, err := cmdWait(cmd)
+	jobIO.Wait()
+	mixins.RecordRusage(rr, cmd.ProcessState)
+	out.Record(rr)
+	if awaitCancel() {
+		if err := out.LimitErr(); err != nil {
+			return -1, err
+		}
+		return -1, Errorf(repeatr.ErrCancelled, "job cancelled: %s", ctx.Err())
+	}
+	if len(setupErr) > 0 {
+		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", setupErr)
+	}
+	return exitCode, err
+}
+
+/*
+	Set up the user namespace of the given process.
+
+	We need the setuid newuidmap and newgidmap helpers for this:
+	an unprivileged process may only map its own ids by itself, and we
+	map whole subordinate id ranges.
+*/
+func writeIdMappings(pid int, idmaps executor.IdMappings) error {
+	for _, x := range []struct {
+		tool     string
+		mappings []executor.IdMapping
+	}{
+		{"newuidmap", idmaps.Uids},
+		{"newgidmap", idmaps.Gids},
+	} {
+		args := []string{strconv.Itoa(pid)}
+		for _, m := range x.mappings {
+			args = append(args,
+				strconv.FormatUint(uint64(m.ContainerID), 10),
+				strconv.FormatUint(uint64(m.HostID), 10),
+				strconv.FormatUint(uint64(m.Size), 10),
+			)
+		}
+		if out, err := exec.Command(x.tool, args...).CombinedOutput(); err != nil {
+			return Errorf(repeatr.ErrExecutor, "rootless mode: %s failed: %s (%s)", x.tool, err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+func cmdWait(cmd *exec.Cmd) (int, error) {
+	err := cmd.Wait()
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok { // This is basically an "if stdlib isn't what we thought it is" error, so panic-worthy.
+		panic(fmt.Errorf("unknown exit reason: %T %s", err, err))
+	}
+	waitStatus, ok := exitErr.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok { // This is basically a "if stdlib[...]" or OS portability issue, so also panic-able.
+		panic(fmt.Errorf("unknown process state implementation %T", exitErr.ProcessState.Sys()))
+	}
+	if waitStatus.Exited() {
+		return waitStatus.ExitStatus(), nil
+	} else if waitStatus.Signaled() {
+		// In bash, when a processs ends from a signal, the $? variable is set to 128+SIG.
+		// We follow that same convention here.
+		// So, a process terminated by ctrl-C returns 130.  A script that died to kill-9 returns 137.
+		return int(waitStatus.Signal()) + 128, nil
+	} else {
+		return -1, Errorf(repeatr.ErrExecutor, "unknown process wait status (%#v)", waitStatus)
+	}
+}
+
+func envToSlice(env map[string]string) []string {
+	rv := make([]string, len(env))
+	i := 0
+	for k, v := range env {
+		rv[i] = k + "=" + v
+		i++
+	}
+	return rv
+}
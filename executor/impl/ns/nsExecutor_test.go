@@ -0,0 +1,78 @@
+package ns
+
+import (
+	"os"
+	"testing"
+
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/rio/client/exec"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/repeatr/executor/tests"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestNsExecutor(t *testing.T) {
+	// Without root, we can still test rootless mode, if this host has
+	//  subordinate ids for us.
+	cfg := executor.Config{}
+	if os.Getuid() != 0 {
+		if _, err := executor.RootlessIdMappings(1000, 1000); err != nil {
+			t.Skipf("the ns executor requires root privs, or subordinate ids for rootless mode (%s)", err)
+		}
+		cfg.Rootless = true
+	}
+
+	var (
+		unpackTool rio.UnpackFunc = rioclient.UnpackFunc
+		packTool   rio.PackFunc   = rioclient.PackFunc
+	)
+
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		// Setup assembler and executor.  Both are reusable.
+		//  Use env to communicate our test tempdir down to Rio.
+		os.Setenv("RIO_BASE", tmpDir.String()+"/rio")
+		runTool, err := NewExecutor(
+			tmpDir.Join(fs.MustRelPath("ws")),
+			unpackTool,
+			packTool,
+			cfg,
+		)
+		AssertNoError(t, err)
+
+		tests.CheckHelloWorldTxt(t, runTool)
+		if cfg.Rootless {
+			// Lossless output isn't possible rootless: everything we unpacked is owned by us.
+			tests.CheckRootlessRefusesSysad(t, runTool)
+			tests.CheckRootlessRefusesKeptOwnership(t, runTool)
+		} else {
+			tests.CheckRoundtripRootfs(t, runTool)
+		}
+		tests.CheckReportingExitCodes(t, runTool)
+		tests.CheckSettingCwd(t, runTool)
+		tests.CheckErrorFromUnfetchableWares(t, runTool)
+		tests.CheckUserinfoDefault(t, runTool)
+		tests.CheckAdvancedUserinfo(t, runTool)
+		tests.CheckRootyUserinfo(t, runTool)
+		tests.CheckNetworkNone(t, runTool)
+		tests.CheckEtcFiles(t, runTool)
+		tests.CheckOutputStreams(t, runTool)
+		tests.CheckInteractive(t, runTool)
+		{
+			// The checks of options which need a config of their own
+			//  can share one.
+			cfg := cfg
+			cfg.Job = tests.GroupsAndUmaskOptions
+			cfg.Deterministic = true
+			runTool, err := NewExecutor(
+				tmpDir.Join(fs.MustRelPath("ws")),
+				unpackTool,
+				packTool,
+				cfg,
+			)
+			AssertNoError(t, err)
+			tests.CheckGroupsAndUmask(t, runTool)
+			tests.CheckDeterministicMode(t, runTool)
+		}
+	})
+}
@@ -0,0 +1,472 @@
+package ns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/syndtr/gocapability/capability"
+	"golang.org/x/sys/unix"
+
+	"go.polydawn.net/repeatr/executor"
+)
+
+// The argv[0] we re-exec ourselves with to become the init shim.
+const initArg0 = "repeatr-ns-init"
+
+// Everything the init shim needs to know to set up the container.
+//  Sent as json on fd 3.
+type initConfig struct {
+	Root     string // Host path of the rootfs.
+	Hostname string
+	Cwd      string
+	Exec     []string
+	Env      []string
+	Uid      uint32
+	Gid      uint32
+	Groups   []int // Supplementary gids.
+	Umask    int
+	Caps     []capability.Cap
+	Rlimits  []executor.Rlimit
+	ShmSize  int64
+	Rootless bool // If set, we're in a user namespace, and only ids we were given mappings for exist.
+	Loopback bool // If set, bring up the loopback interface.  (It starts down.)
+
+	ClockOffsets *clockOffsets // If set, start the job in a new time namespace, with these offsets.
+}
+
+// Offsets for the clocks of a time namespace, in seconds.
+type clockOffsets struct {
+	Monotonic int64
+	Boottime  int64
+}
+
+// CLONE_NEWTIME is newer than our x/sys.
+const cloneNewTime = 0x80
+
+// If we've been re-exec'd as the init shim, hijack the process.
+//  This happens as early as possible: before main, and before any other
+//  package gets up to anything interesting.
+func init() {
+	if os.Args[0] == initArg0 {
+		nsInit()
+	}
+}
+
+/*
+	Set up the container, then start the job command, and stay on as its
+	init: reaping whatever gets orphaned, and forwarding signals to the job.
+	Exits with the job's exit code (or 128+signal, as a shell would).
+
+	We're already in our new namespaces (the parent set clone flags).
+	If anything goes wrong, we write a message to fd 4 and exit;
+	we close fd 4 once the job has started (and it's close-on-exec, so
+	the job doesn't hold it), so if we make it that far, the parent
+	simply sees EOF.
+
+	The job's credentials, capabilities, and no_new_privs are ours by
+	then too: we drop to them before starting it.  So all the init has
+	over the job is being pid 1 -- and being non-dumpable, so the job
+	can't ptrace it, or get at our binary via /proc/1/exe.
+*/
+func nsInit() {
+	runtime.LockOSThread() // Capabilities are per-thread; we need the exec to come from the same thread we set them on.
+	errPipe := os.NewFile(4, "errpipe")
+	syscall.CloseOnExec(4)
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(errPipe, format, args...)
+		os.Exit(1)
+	}
+
+	var cfg initConfig
+	if err := json.NewDecoder(os.NewFile(3, "cfgpipe")).Decode(&cfg); err != nil {
+		fail("init: cannot read config: %s", err)
+	}
+	syscall.Close(3)
+
+	if err := setupMounts(cfg); err != nil {
+		fail("init: %s", err)
+	}
+	if err := unix.Sethostname([]byte(cfg.Hostname)); err != nil {
+		fail("init: cannot set hostname: %s", err)
+	}
+	if cfg.Loopback {
+		if err := bringUpLoopback(); err != nil {
+			fail("init: cannot bring up loopback: %s", err)
+		}
+	}
+	if err := setRlimits(cfg.Rlimits); err != nil {
+		fail("init: %s", err)
+	}
+	if cfg.ClockOffsets != nil {
+		if err := unshareTime(*cfg.ClockOffsets); err != nil {
+			fail("init: %s", err)
+		}
+	}
+	if err := pivotRoot(cfg.Root); err != nil {
+		fail("init: %s", err)
+	}
+	if err := syscall.Chdir(cfg.Cwd); err != nil {
+		fail("init: cannot chdir to %q: %s", cfg.Cwd, err)
+	}
+	if err := setCredentials(cfg); err != nil {
+		fail("init: %s", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		fail("init: cannot set no_new_privs: %s", err)
+	}
+
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		fail("init: cannot set non-dumpable: %s", err)
+	}
+	syscall.Umask(cfg.Umask)
+
+	// Catch signals before the job exists, so none get lost in between.
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+	pid, err := startJob(cfg)
+	if err != nil {
+		fail("init: cannot exec %q: %s", cfg.Exec[0], err)
+	}
+	errPipe.Close()
+	go forwardSignals(sigs, pid)
+	os.Exit(reap(pid))
+}
+
+/*
+	Fork and exec the job command.  It inherits everything we've set up.
+
+	The job gets its own process group; and if we have a terminal, that
+	group is put in the foreground: so signals from the terminal (^C and
+	friends) go straight to the job, and not also (via us) a second time.
+*/
+func startJob(cfg initConfig) (int, error) {
+	_, err := unix.IoctlGetTermios(0, unix.TCGETS)
+	return syscall.ForkExec(cfg.Exec[0], cfg.Exec, &syscall.ProcAttr{
+		Env:   cfg.Env,
+		Files: []uintptr{0, 1, 2},
+		Sys: &syscall.SysProcAttr{
+			Setpgid:    true,
+			Foreground: err == nil,
+			Ctty:       0,
+		},
+	})
+}
+
+// Send on every signal we get to the job, except the ones which are
+//  only about us (or the Go runtime).
+func forwardSignals(sigs <-chan os.Signal, pid int) {
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGCHLD, syscall.SIGURG:
+			continue
+		}
+		syscall.Kill(pid, sig.(syscall.Signal))
+	}
+}
+
+/*
+	Wait for children until the job exits, then return its exit code.
+
+	Anything else still running in the container is killed by the kernel
+	when we exit (we're its pid 1); anything which exited before the job
+	was reaped along the way.
+*/
+func reap(pid int) int {
+	for {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 127 // No children left: we can't have got here.
+		}
+		if wpid != pid {
+			continue
+		}
+		switch {
+		case ws.Exited():
+			return ws.ExitStatus()
+		case ws.Signaled():
+			return 128 + int(ws.Signal())
+		}
+	}
+}
+
+/*
+	Make the rootfs our root, and detach the host's.
+
+	pivot_root (unlike chroot) moves the whole mount namespace onto the
+	new root; once the old root is unmounted, there's nothing left in the
+	namespace to escape to.  The rootfs is a mount point already (see
+	setupMounts), which pivot_root requires.
+
+	This is runc's trick: pivoting "." onto itself stacks the old root
+	under the new one, so we need no dir to put it in.  (Making one would
+	touch the rootfs -- and its mtime -- after cradle has tidied it.)
+*/
+func pivotRoot(root string) error {
+	oldRoot, err := unix.Open("/", unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("cannot pivot root: %s", err)
+	}
+	defer unix.Close(oldRoot)
+	newRoot, err := unix.Open(root, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("cannot pivot root: %s", err)
+	}
+	defer unix.Close(newRoot)
+	if err := unix.Fchdir(newRoot); err != nil {
+		return fmt.Errorf("cannot pivot root: %s", err)
+	}
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("cannot pivot root: %s", err)
+	}
+	// The old root is now mounted over "/", under the new one.
+	//  Go back to it, and detach it.
+	if err := unix.Fchdir(oldRoot); err != nil {
+		return fmt.Errorf("cannot detach old root: %s", err)
+	}
+	if err := unix.Mount("", ".", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("cannot detach old root: %s", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("cannot detach old root: %s", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("cannot pivot root: %s", err)
+	}
+	return nil
+}
+
+/*
+	Make the same mounts as the runc executor's config does.
+	We're in a fresh mount namespace, so these all disappear on their own
+	when the job exits.  (Or rather, when we do: see nsInit.)
+*/
+func setupMounts(cfg initConfig) error {
+	// Make sure nothing we do propagates back out to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("cannot make mounts private: %s", err)
+	}
+	// Bind the rootfs onto itself, so it's a mount point we can pivot to.
+	//  (Recursively, to keep the input mounts already in it.)
+	if err := unix.Mount(cfg.Root, cfg.Root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("cannot bind rootfs: %s", err)
+	}
+	ptsOpts := "newinstance,ptmxmode=0666,mode=0620,gid=5"
+	if cfg.Rootless {
+		ptsOpts = "newinstance,ptmxmode=0666,mode=0620" // Gid 5 may not be mapped.
+	}
+	shmOpts := "mode=1777"
+	if cfg.ShmSize > 0 {
+		shmOpts += fmt.Sprintf(",size=%d", cfg.ShmSize)
+	}
+	for _, m := range []struct {
+		target string
+		fstype string
+		flags  uintptr
+		data   string
+	}{
+		{"/proc", "proc", unix.MS_NOSUID | unix.MS_NOEXEC | unix.MS_NODEV, ""},
+		{"/dev", "tmpfs", unix.MS_NOSUID | unix.MS_STRICTATIME, "mode=755,size=65536k"},
+		{"/dev/pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, ptsOpts},
+		{"/dev/shm", "tmpfs", unix.MS_NOSUID | unix.MS_NOEXEC | unix.MS_NODEV, shmOpts},
+		{"/dev/mqueue", "mqueue", unix.MS_NOSUID | unix.MS_NOEXEC | unix.MS_NODEV, ""},
+	} {
+		target := filepath.Join(cfg.Root, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("cannot make mountpoint %q: %s", m.target, err)
+		}
+		if err := unix.Mount(m.fstype, target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("cannot mount %q: %s", m.target, err)
+		}
+	}
+
+	// Populate /dev with the usual device nodes, bound in from the host.
+	for _, dev := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		target := filepath.Join(cfg.Root, "dev", dev)
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return fmt.Errorf("cannot make device %q: %s", dev, err)
+		}
+		f.Close()
+		if err := unix.Mount("/dev/"+dev, target, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("cannot make device %q: %s", dev, err)
+		}
+	}
+	for link, dest := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+		"ptmx":   "pts/ptmx",
+	} {
+		if err := os.Symlink(dest, filepath.Join(cfg.Root, "dev", link)); err != nil {
+			return fmt.Errorf("cannot make /dev/%s: %s", link, err)
+		}
+	}
+
+	// Hide, or make readonly, the bits of /proc runc does.
+	for _, p := range []string{
+		"/proc/kcore",
+		"/proc/latency_stats",
+		"/proc/timer_list",
+		"/proc/timer_stats",
+		"/proc/sched_debug",
+	} {
+		target := filepath.Join(cfg.Root, p)
+		if _, err := os.Stat(target); err != nil {
+			continue // Not all kernels have all of these.
+		}
+		if err := unix.Mount("/dev/null", target, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("cannot mask %q: %s", p, err)
+		}
+	}
+	for _, p := range []string{
+		"/proc/asound",
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+	} {
+		target := filepath.Join(cfg.Root, p)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		if err := unix.Mount(target, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("cannot make %q readonly: %s", p, err)
+		}
+		// The flags /proc was mounted with are repeated here, because in a
+		//  user namespace, a remount isn't allowed to clear them.
+		if err := unix.Mount(target, target, "", unix.MS_BIND|unix.MS_REC|unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV, ""); err != nil {
+			return fmt.Errorf("cannot make %q readonly: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// Set the IFF_UP flag on "lo".  A fresh network namespace has loopback
+//  configured already, just down; this is all it takes to get it working.
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		Name  [syscall.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte // Pad to the size of struct ifreq.
+	}
+	copy(ifr.Name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.Flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+/*
+	Make a new time namespace, with the given offsets for its clocks.
+
+	Unsharing a time namespace doesn't put us in it -- only our children,
+	and whatever we exec: so the job starts in it.  The offsets have to be
+	written before then, while no process is in the namespace yet.
+*/
+func unshareTime(offsets clockOffsets) error {
+	if err := unix.Unshare(cloneNewTime); err != nil {
+		return fmt.Errorf("cannot make time namespace: %s", err)
+	}
+	content := fmt.Sprintf("monotonic %d 0\nboottime %d 0\n", offsets.Monotonic, offsets.Boottime)
+	if err := ioutil.WriteFile("/proc/self/timens_offsets", []byte(content), 0); err != nil {
+		return fmt.Errorf("cannot set time namespace offsets: %s", err)
+	}
+	return nil
+}
+
+// The same default as the runc executor: NOFILE at 1024, unless configured.
+func setRlimits(rlimits []executor.Rlimit) error {
+	rlimits = append([]executor.Rlimit{{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024}}, rlimits...)
+	for _, rl := range rlimits {
+		resource, ok := rlimitTypes[rl.Type]
+		if !ok {
+			return fmt.Errorf("unknown rlimit type %q", rl.Type)
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: rl.Soft, Max: rl.Hard}); err != nil {
+			return fmt.Errorf("cannot set %s: %s", rl.Type, err)
+		}
+	}
+	return nil
+}
+
+var rlimitTypes = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+/*
+	Drop to the job's uid and gid, keeping exactly the capabilities
+	its policy grants.
+
+	The bounding set has to be trimmed while we're still fully root;
+	then keepcaps lets us hold onto our permitted set across setuid,
+	so we can raise what the policy grants into the effective, inheritable,
+	and ambient sets (ambient being what survives exec as a non-root user).
+*/
+func setCredentials(cfg initConfig) error {
+	caps, err := capability.NewPid(0)
+	if err != nil {
+		return fmt.Errorf("cannot set capabilities: %s", err)
+	}
+	caps.Clear(capability.BOUNDS)
+	caps.Set(capability.BOUNDS, cfg.Caps...)
+	if err := caps.Apply(capability.BOUNDS); err != nil {
+		return fmt.Errorf("cannot set capabilities: %s", err)
+	}
+
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot set keepcaps: %s", err)
+	}
+	if err := syscall.Setgroups(cfg.Groups); err != nil {
+		return fmt.Errorf("cannot set groups: %s", err)
+	}
+	if err := syscall.Setgid(int(cfg.Gid)); err != nil {
+		return fmt.Errorf("cannot set gid: %s", err)
+	}
+	if err := syscall.Setuid(int(cfg.Uid)); err != nil {
+		return fmt.Errorf("cannot set uid: %s", err)
+	}
+
+	caps.Clear(capability.CAPS | capability.AMBS)
+	caps.Set(capability.CAPS|capability.AMBIENT, cfg.Caps...)
+	if err := caps.Apply(capability.CAPS | capability.AMBS); err != nil {
+		return fmt.Errorf("cannot set capabilities: %s", err)
+	}
+	return nil
+}
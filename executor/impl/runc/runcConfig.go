@@ -1,7 +1,9 @@
 package runc
 
 import (
+	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/polydawn/refmt"
 	"github.com/polydawn/refmt/json"
@@ -9,21 +11,27 @@ import (
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/repeatr/executor/cradle"
 	"go.polydawn.net/repeatr/executor/policy"
 )
 
-func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string, tty bool) (interface{}, error) {
+// If idmaps is non-nil, the container gets a user namespace (this is how
+// we run rootless).  Features are what our runc supports, for the settings
+// which need something recent.
+func templateRuncConfig(hostname string, action api.FormulaAction, rootPath string, tty bool, config executor.Config, idmaps *executor.IdMappings, features runcFeatures) (interface{}, error) {
+	limits, opts := config.Limits, config.Job
+	umask, err := opts.ParseUmask()
+	if err != nil {
+		return nil, err
+	}
 	caps, err := policy.GetCapsForPolicy(action.Policy)
 	if err != nil {
 		return nil, err
 	}
 	capsStrs := policy.CapsToStrings(caps)
-	hostname := action.Hostname
-	if hostname == "" {
-		hostname = string(jobID)
-	}
 
-	return map[string]interface{}{
+	cfg := map[string]interface{}{
 		"ociVersion": "1.0.0-rc5",
 		"platform": map[string]interface{}{
 			"os":   "linux",
@@ -34,7 +42,8 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 			"user": map[string]interface{}{
 				"uid":            *action.Userinfo.Uid,
 				"gid":            *action.Userinfo.Gid,
-				"additionalGids": nil,
+				"additionalGids": opts.Groups,
+				"umask":          umask,
 			},
 			"args": action.Exec,
 			"env": func() (env []string) {
@@ -52,13 +61,7 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 				"permitted":   capsStrs,
 				"ambient":     capsStrs,
 			},
-			"rlimits": []interface{}{
-				map[string]interface{}{
-					"type": "RLIMIT_NOFILE",
-					"hard": 1024,
-					"soft": 1024,
-				},
-			},
+			"rlimits":         templateRlimits(limits),
 			"noNewPrivileges": true,
 		},
 		"root": map[string]interface{}{
@@ -120,7 +123,7 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 					"noexec",
 					"nodev",
 					"mode=1777",
-					"size=65536k",
+					shmSizeOption(limits),
 				},
 			},
 			map[string]interface{}{
@@ -135,14 +138,7 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 			},
 		},
 		"linux": map[string]interface{}{
-			"resources": map[string]interface{}{
-				"devices": []interface{}{
-					map[string]interface{}{
-						"allow":  false,
-						"access": "rwm",
-					},
-				},
-			},
+			"resources": templateResources(limits),
 			"namespaces": []interface{}{
 				map[string]interface{}{
 					"type": "pid",
@@ -178,7 +174,166 @@ func templateRuncConfig(jobID string, action api.FormulaAction, rootPath string,
 				"/proc/sysrq-trigger",
 			},
 		},
-	}, nil
+	}
+	if config.Job.Network != executor.Network_Host {
+		// Note that runc always brings up loopback in a new network
+		//  namespace, so "none" comes out the same as "loopback".
+		linux := cfg["linux"].(map[string]interface{})
+		linux["namespaces"] = append(linux["namespaces"].([]interface{}),
+			map[string]interface{}{
+				"type": "network",
+				"path": "",
+			},
+		)
+	}
+	if idmaps != nil {
+		templateRootless(cfg, *idmaps)
+	}
+	if config.Deterministic && features.hasNamespace("time") {
+		templateTimeNamespace(cfg)
+	}
+	return cfg, nil
+}
+
+// For deterministic mode: give the job a time namespace, with its monotonic
+//  and boottime clocks starting from zero -- if the kernel supports it.
+//  (Only call this if runc does, too: see runcFeatures.)
+func templateTimeNamespace(cfg map[string]interface{}) {
+	monotonic, boottime, ok := cradle.ClockOffsets()
+	if !ok {
+		return
+	}
+	linux := cfg["linux"].(map[string]interface{})
+	linux["namespaces"] = append(linux["namespaces"].([]interface{}),
+		map[string]interface{}{
+			"type": "time",
+			"path": "",
+		},
+	)
+	linux["timeOffsets"] = map[string]interface{}{
+		"monotonic": map[string]interface{}{
+			"secs":     monotonic,
+			"nanosecs": 0,
+		},
+		"boottime": map[string]interface{}{
+			"secs":     boottime,
+			"nanosecs": 0,
+		},
+	}
+}
+
+// Patch a config for running rootless, much as `runc spec --rootless` would:
+//  add a user namespace with our mappings, drop cgroup settings (we can't
+//  have any), and drop mount options which name gids that may not be mapped.
+func templateRootless(cfg map[string]interface{}, idmaps executor.IdMappings) {
+	linux := cfg["linux"].(map[string]interface{})
+	linux["namespaces"] = append(linux["namespaces"].([]interface{}),
+		map[string]interface{}{
+			"type": "user",
+			"path": "",
+		},
+	)
+	linux["uidMappings"] = templateIdMappings(idmaps.Uids)
+	linux["gidMappings"] = templateIdMappings(idmaps.Gids)
+	delete(linux, "resources")
+	for _, m := range cfg["mounts"].([]interface{}) {
+		m := m.(map[string]interface{})
+		opts, _ := m["options"].([]string)
+		var kept []string
+		for _, opt := range opts {
+			if !strings.HasPrefix(opt, "gid=") && !strings.HasPrefix(opt, "uid=") {
+				kept = append(kept, opt)
+			}
+		}
+		if opts != nil {
+			m["options"] = kept
+		}
+	}
+}
+
+func templateIdMappings(mappings []executor.IdMapping) []interface{} {
+	result := make([]interface{}, len(mappings))
+	for i, m := range mappings {
+		result[i] = map[string]interface{}{
+			"containerID": m.ContainerID,
+			"hostID":      m.HostID,
+			"size":        m.Size,
+		}
+	}
+	return result
+}
+
+// Rlimits for the process.  We always set NOFILE (to something more
+//  conservative than many hosts' defaults); any limits configured of the
+//  same type override it.
+func templateRlimits(limits executor.Limits) []interface{} {
+	rlimits := []executor.Rlimit{
+		{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024},
+	}
+	for _, rl := range limits.Rlimits {
+		if rl.Type == rlimits[0].Type {
+			rlimits[0] = rl
+			continue
+		}
+		rlimits = append(rlimits, rl)
+	}
+	result := make([]interface{}, len(rlimits))
+	for i, rl := range rlimits {
+		result[i] = map[string]interface{}{
+			"type": rl.Type,
+			"hard": rl.Hard,
+			"soft": rl.Soft,
+		}
+	}
+	return result
+}
+
+// The "linux.resources" section: our device policy, plus cgroup limits.
+func templateResources(limits executor.Limits) map[string]interface{} {
+	resources := map[string]interface{}{
+		"devices": []interface{}{
+			map[string]interface{}{
+				"allow":  false,
+				"access": "rwm",
+			},
+		},
+	}
+	if limits.Memory > 0 {
+		// Swap is limited to the same figure, so a job can't dodge
+		//  the memory limit by going to swap.
+		resources["memory"] = map[string]interface{}{
+			"limit": limits.Memory,
+			"swap":  limits.Memory,
+		}
+	}
+	cpu := map[string]interface{}{}
+	if limits.CpuQuota > 0 {
+		period := limits.CpuPeriod
+		if period == 0 {
+			period = 100000
+		}
+		cpu["quota"] = limits.CpuQuota
+		cpu["period"] = period
+	}
+	if limits.CpuShares > 0 {
+		cpu["shares"] = limits.CpuShares
+	}
+	if len(cpu) > 0 {
+		resources["cpu"] = cpu
+	}
+	if limits.Pids > 0 {
+		resources["pids"] = map[string]interface{}{
+			"limit": limits.Pids,
+		}
+	}
+	return resources
+}
+
+func shmSizeOption(limits executor.Limits) string {
+	if limits.ShmSize > 0 {
+		return fmt.Sprintf("size=%dk", limits.ShmSize/1024)
+	}
+	return "size=65536k"
 }
 
 func writeConfigToFile(path string, runcCfg interface{}) error {
@@ -0,0 +1,96 @@
+package runc
+
+import (
+	"testing"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/repeatr/executor/cradle"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+var denyAllDevices = []interface{}{
+	map[string]interface{}{
+		"allow":  false,
+		"access": "rwm",
+	},
+}
+
+func TestTemplateResources(t *testing.T) {
+	for _, tr := range []struct {
+		name   string
+		limits executor.Limits
+		want   map[string]interface{}
+	}{
+		{"no limits", executor.Limits{}, map[string]interface{}{
+			"devices": denyAllDevices,
+		}},
+		{"memory limits swap too", executor.Limits{Memory: 1 << 30}, map[string]interface{}{
+			"devices": denyAllDevices,
+			"memory":  map[string]interface{}{"limit": int64(1 << 30), "swap": int64(1 << 30)},
+		}},
+		{"cpu quota gets a default period", executor.Limits{CpuQuota: 50000}, map[string]interface{}{
+			"devices": denyAllDevices,
+			"cpu":     map[string]interface{}{"quota": int64(50000), "period": uint64(100000)},
+		}},
+		{"cpu quota and shares", executor.Limits{CpuQuota: 20000, CpuPeriod: 10000, CpuShares: 512}, map[string]interface{}{
+			"devices": denyAllDevices,
+			"cpu":     map[string]interface{}{"quota": int64(20000), "period": uint64(10000), "shares": uint64(512)},
+		}},
+		{"pids", executor.Limits{Pids: 100}, map[string]interface{}{
+			"devices": denyAllDevices,
+			"pids":    map[string]interface{}{"limit": int64(100)},
+		}},
+		{"rlimits and shm aren't cgroups", executor.Limits{ShmSize: 1 << 20, Rlimits: []executor.Rlimit{{"RLIMIT_NPROC", 1, 1}}}, map[string]interface{}{
+			"devices": denyAllDevices,
+		}},
+	} {
+		t.Run(tr.name, func(t *testing.T) {
+			WantEqual(t, templateResources(tr.limits), tr.want)
+		})
+	}
+}
+
+func TestTemplateRlimits(t *testing.T) {
+	for _, tr := range []struct {
+		name   string
+		limits executor.Limits
+		want   []interface{}
+	}{
+		{"default nofile", executor.Limits{}, []interface{}{
+			map[string]interface{}{"type": "RLIMIT_NOFILE", "hard": uint64(1024), "soft": uint64(1024)},
+		}},
+		{"nofile overridden, others added", executor.Limits{Rlimits: []executor.Rlimit{
+			{"RLIMIT_NPROC", 10, 20},
+			{"RLIMIT_NOFILE", 4096, 8192},
+		}}, []interface{}{
+			map[string]interface{}{"type": "RLIMIT_NOFILE", "hard": uint64(8192), "soft": uint64(4096)},
+			map[string]interface{}{"type": "RLIMIT_NPROC", "hard": uint64(20), "soft": uint64(10)},
+		}},
+	} {
+		t.Run(tr.name, func(t *testing.T) {
+			WantEqual(t, templateRlimits(tr.limits), tr.want)
+		})
+	}
+}
+
+func TestTemplateTimeNamespace(t *testing.T) {
+	if _, _, ok := cradle.ClockOffsets(); !ok {
+		t.Skip("kernel has no time namespaces")
+	}
+	action := cradle.FormulaDefaults(api.Formula{Action: api.FormulaAction{Exec: []string{"/bin/true"}}}).Action
+	hasTimeNs := func(features runcFeatures) bool {
+		cfg, err := templateRuncConfig("h", action, "/rootfs", false, executor.Config{Deterministic: true}, nil, features)
+		AssertNoError(t, err)
+		for _, ns := range cfg.(map[string]interface{})["linux"].(map[string]interface{})["namespaces"].([]interface{}) {
+			if ns.(map[string]interface{})["type"] == "time" {
+				return true
+			}
+		}
+		return false
+	}
+	var features runcFeatures
+	WantEqual(t, hasTimeNs(features), false) // A runc too old to tell us.
+	features = parseRuncFeatures([]byte(`{"ociVersionMax":"1.1.0","linux":{"namespaces":["mount","pid","time"]}}`))
+	WantEqual(t, hasTimeNs(features), true)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"syscall"
 
 	. "github.com/warpfork/go-errcat"
@@ -13,8 +14,10 @@ import (
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/cradle"
 	"go.polydawn.net/repeatr/executor/mixins"
+	"go.polydawn.net/repeatr/executor/policy"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/stitch"
@@ -25,32 +28,48 @@ type Executor struct {
 	cmdPath       string            // Absolute path to runc binary.
 	assemblerTool *stitch.Assembler // Contains: unpackTool, caching cfg, and placer tools.
 	packTool      rio.PackFunc
+	config        executor.Config // Host settings, such as resource limits.
+	features      runcFeatures    // What our runc supports.  Only probed if a setting depends on it.
 }
 
 func NewExecutor(
 	workDir fs.AbsolutePath,
 	unpackTool rio.UnpackFunc,
 	packTool rio.PackFunc,
+	config executor.Config,
 ) (repeatr.RunFunc, error) {
+	// Rootless containers can't have cgroups (at least, not without
+	//  delegation we don't attempt), so can't enforce most limits.
+	if config.Rootless && config.Limits.NeedsCgroups() {
+		return nil, Errorf(repeatr.ErrUsage, "memory, cpu, and pids limits are not supported in rootless mode")
+	}
 	asm, err := stitch.NewAssembler(unpackTool)
 	if err != nil {
 		return nil, repeatr.ReboxRioError(err)
 	}
-	cmdPath, err := findRuncBinary()
+	cmdPath, err := FindRuncBinary()
 	if err != nil {
 		return nil, err
 	}
+	// Deterministic mode uses a time namespace, which runc only knows
+	//  about since 1.2; ask whether ours does.
+	var features runcFeatures
+	if config.Deterministic {
+		features = probeRuncFeatures(cmdPath)
+	}
 	return Executor{
 		osfs.New(workDir),
 		cmdPath,
 		asm,
 		packTool,
+		config,
+		features,
 	}.Run, nil
 }
 
 // Look for the runc plugin binary -- we expect it to be in a path relative
 //   to our self, OR we'll take a hint from the REPEATR_PLUGINS_PATH env var.
-func findRuncBinary() (string, error) {
+func FindRuncBinary() (string, error) {
 	pluginsPath := os.Getenv("REPEATR_PLUGINS_PATH")
 	if pluginsPath == "" {
 		selfPath, err := os.Executable()
@@ -79,9 +98,9 @@ func (cfg Executor) Run(
 	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
 
 	// Workspace setup and params defaulting.
-	formula = cradle.FormulaDefaults(formula) // Initialize formula default values.
-	rr := api.FormulaRunRecord{}              // Start filling out record keeping!
-	mixins.InitRunRecord(&rr, formula)        // Includes picking a random guid for the job, which we use in all temp files.
+	formula = cradle.FormulaDefaults(formula)          // Initialize formula default values.
+	rr := api.FormulaRunRecord{}                       // Start filling out record keeping!
+	formula = mixins.InitJob(&rr, formula, cfg.config) // Includes picking a random guid for the job, which we use in all temp files.
 
 	// Make work dirs. Including whole workspace dir and parents, if necessary.
 	jobFs, chrootFs, err := mixins.MakeWorkDirs(cfg.workspaceFs, rr)
@@ -92,25 +111,28 @@ func (cfg Executor) Run(
 	// Use standard filesystem setup/teardown, handing it our 'run' thunk
 	//  to invoke while it's living.
 	rr.Results, err = mixins.WithFilesystem(ctx,
-		chrootFs, cfg.assemblerTool, cfg.packTool,
-		formula, formulaCtx, mon,
+		jobFs, chrootFs, cfg.assemblerTool, cfg.packTool,
+		formula, formulaCtx, mon, &rr, cfg.config,
 		func(chrootFs fs.FS) (err error) {
-			rr.ExitCode, err = cfg.run(ctx, rr.Guid, formula.Action, jobFs, chrootFs, input, mon)
+			rr.ExitCode, err = cfg.run(ctx, &rr, formula.Action, jobFs, chrootFs, input, mon)
 			return
 		},
 	)
+	mixins.RecordCancellation(&rr, err)
 	return &rr, err
 }
 
 func (cfg Executor) run(
 	ctx context.Context,
-	jobID string,
+	rr *api.FormulaRunRecord, // for the job ID, and recording resource usage.
 	action api.FormulaAction,
 	jobFs fs.FS, // a spot for other tmp/job-lifetime files.
 	chrootFs fs.FS,
 	input repeatr.InputControl,
 	mon repeatr.Monitor,
 ) (int, error) {
+	jobID := rr.Guid
+
 	// Check that action commands appear to be executable on this filesystem.
 	if err := mixins.CheckFSReadyForExec(action, chrootFs); err != nil {
 		return -1, err
@@ -123,7 +145,21 @@ func (cfg Executor) run(
 	if input.Chan != nil {
 		useTty = true
 	}
-	runcCfg, err := templateRuncConfig(jobID, action, chrootFs.BasePath().String(), useTty)
+	if err := policy.CheckNetwork(cfg.config.Job.Network, action.Policy); err != nil {
+		return -1, err
+	}
+	var idmaps *executor.IdMappings
+	if cfg.config.Rootless {
+		if err := policy.CheckRootless(action.Policy); err != nil {
+			return -1, err
+		}
+		mappings, err := executor.RootlessIdMappings(*action.Userinfo.Uid, *action.Userinfo.Gid)
+		if err != nil {
+			return -1, err
+		}
+		idmaps = &mappings
+	}
+	runcCfg, err := templateRuncConfig(cradle.Hostname(action, rr, cfg.config), action, chrootFs.BasePath().String(), useTty, cfg.config, idmaps, cfg.features)
 	if err != nil {
 		return -1, err
 	}
@@ -147,29 +183,76 @@ func (cfg Executor) run(
 		jobID,
 	)
 
-	// Wire I/O.
-	if input.Chan != nil {
-		// Dire hack: reach all the way out to the system stdin handle.
-		// We need this for TTY reasons.
-		// Future work: do our own PTY management, giving us room for handling
-		//  custom escape sequences, isolating this code better, etc.
-		cmd.Stdin = os.Stdin
+	// Wire I/O.  (See mixins.JobIO for how: a terminal if interactive,
+	//  and otherwise pipes.)
+	out := mixins.NewOutputForwarder(ctx, mon, cfg.config.Output)
+	defer out.Close()
+	jobIO, err := mixins.AttachIO(ctx, cmd, input, cfg.config.TerminalSize, out)
+	if err != nil {
+		return -1, err
 	}
-	proxy := mixins.NewOutputEventWriter(ctx, mon.Chan)
-	cmd.Stdout = proxy // TODO probably more here
-	cmd.Stderr = proxy // TODO probably more here
 
 	// Launch runc process.
 	if err := cmd.Start(); err != nil {
+		jobIO.Abort()
 		return -1, Errorf(repeatr.ErrExecutor, "executor failed to launch: %s", err)
 	}
+	jobIO.Started()
+
+	// List the job, for `repeatr ps` and `repeatr exec`.
+	defer mixins.RegisterJob(jobFs, mixins.RunningJob{
+		Guid:      jobID,
+		SetupHash: rr.FormulaID,
+		Executor:  "runc",
+		Pid:       cmd.Process.Pid,
+		Runtime:   cfg.cmdPath,
+		StateDir:  jobFs.BasePath().String() + "/tmp",
+		Uid:       *action.Userinfo.Uid,
+		Gid:       *action.Userinfo.Gid,
+	}, mon)()
+
+	// Relay cancellation to the container.
+	//  We ask runc to deliver signals, since it knows where the container's
+	//  init process is; if even that fails, we go after runc itself.
+	awaitCancel := mixins.SignalOnCancel(out.Context(), mon, func(sig syscall.Signal) error {
+		if err := cfg.stateCmd(jobFs, "kill", jobID, strconv.Itoa(int(sig))).Run(); err != nil {
+			cmd.Process.Signal(sig)
+			return err
+		}
+		return nil
+	})
 
 	// Watch logs; we have additional output handling to do.
 	// TODO
 
+	// Sample the container's cgroup stats while it runs.
+	stopStats := cfg.watchCgroupStats(jobFs, jobID)
+
 	// Await command completion; return its exit code.
 	//  (If we get this far, the code from the 'real' work proc is all that's left.)
-	return cmdWait(cmd)
+	exitCode, err := cmdWait(cmd)
+	jobIO.Wait()
+	stopStats().record(rr)
+	mixins.RecordRusage(rr, cmd.ProcessState)
+	out.Record(rr)
+	if awaitCancel() {
+		// A container killed out from under runc may leave its state behind;
+		//  force cleanup, so nothing is left holding the filesystem busy.
+		cfg.stateCmd(jobFs, "delete", "--force", jobID).Run()
+		if err := out.LimitErr(); err != nil {
+			return -1, err
+		}
+		return -1, Errorf(repeatr.ErrCancelled, "job cancelled: %s", ctx.Err())
+	}
+	return exitCode, err
+}
+
+// Template a command for one of the runc subcommands which operate on
+//  an existing container (kill, delete, etc), using the job's state dir.
+func (cfg Executor) stateCmd(jobFs fs.FS, args ...string) *exec.Cmd {
+	return exec.Command(cfg.cmdPath,
+		append([]string{"--root", jobFs.BasePath().String() + "/tmp"}, args...)...,
+	)
 }
 
 // copypasta glue for get-the-real-exitcode-plz
@@ -0,0 +1,55 @@
+package runc
+
+import (
+	"os/exec"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+)
+
+// Subset of what `runc features` reports runc supports.
+type runcFeatures struct {
+	Namespaces []string
+}
+
+/*
+	Ask runc what it supports.
+
+	runc before 1.1 has no `features` command at all; that's no error,
+	it just counts as supporting none of the things we'd ask about.
+	(Those are all newer than the command itself.)
+*/
+func probeRuncFeatures(cmdPath string) runcFeatures {
+	out, err := exec.Command(cmdPath, "features").Output()
+	if err != nil {
+		return runcFeatures{}
+	}
+	return parseRuncFeatures(out)
+}
+
+// Pick what we need out of the output of `runc features`.  It's decoded
+//  loosely, as a tree of maps: it reports much else, and more with each
+//  version.  Anything unparseable counts as supporting nothing.
+func parseRuncFeatures(out []byte) (features runcFeatures) {
+	var report map[string]interface{}
+	if err := refmt.Unmarshal(json.DecodeOptions{}, out, &report); err != nil {
+		return
+	}
+	linux, _ := report["linux"].(map[string]interface{})
+	namespaces, _ := linux["namespaces"].([]interface{})
+	for _, ns := range namespaces {
+		if ns, ok := ns.(string); ok {
+			features.Namespaces = append(features.Namespaces, ns)
+		}
+	}
+	return
+}
+
+func (f runcFeatures) hasNamespace(ns string) bool {
+	for _, x := range f.Namespaces {
+		if x == ns {
+			return true
+		}
+	}
+	return false
+}
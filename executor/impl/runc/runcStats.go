@@ -0,0 +1,116 @@
+package runc
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/rio/fs"
+)
+
+// How often we poll runc for the container's cgroup stats.
+const statsInterval = time.Second
+
+// The stats we keep, from those reported by `runc events --stats`.
+type cgroupStats struct {
+	CpuTotal  uint64 // nanoseconds
+	MemoryMax uint64 // bytes
+}
+
+/*
+	Pick our stats out of the output of `runc events --stats`.
+
+	It's decoded loosely, as a tree of maps: we want two figures out of
+	a great many, which vary with runc's version and the cgroup setup.
+*/
+func parseCgroupStats(out []byte) (*cgroupStats, error) {
+	var event map[string]interface{}
+	if err := refmt.Unmarshal(json.DecodeOptions{}, out, &event); err != nil {
+		return nil, err
+	}
+	return &cgroupStats{
+		CpuTotal:  lookupUint(event, "data", "cpu", "usage", "total"),
+		MemoryMax: lookupUint(event, "data", "memory", "usage", "max"),
+	}, nil
+}
+
+// Find a number in a tree of maps, or zero if it's not there.
+func lookupUint(tree map[string]interface{}, path ...string) uint64 {
+	for _, k := range path[:len(path)-1] {
+		tree, _ = tree[k].(map[string]interface{})
+	}
+	switch n := tree[path[len(path)-1]].(type) {
+	case int64:
+		if n >= 0 {
+			return uint64(n)
+		}
+	case uint64:
+		return n
+	case int:
+		if n >= 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+/*
+	Poll `runc events --stats` while the container runs.
+	Call the returned func after the container has exited to stop polling;
+	it returns the last sample taken, or nil if none was ever successful.
+
+	The container is deleted by runc as soon as it exits, so the last sample
+	may be up to one polling interval stale.  This matters little for the
+	figures we keep: peak memory usage is already a high-water mark, and
+	cpu time is still roughly correct.
+*/
+func (cfg Executor) watchCgroupStats(jobFs fs.FS, jobID string) (stop func() *cgroupStats) {
+	var last *cgroupStats
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			// Errors are expected: the container doesn't exist until runc
+			//  has gotten around to creating it.  We just try again.
+			out, err := cfg.stateCmd(jobFs, "events", "--stats", jobID).Output()
+			if err != nil {
+				continue
+			}
+			stats, err := parseCgroupStats(out)
+			if err != nil {
+				continue
+			}
+			last = stats
+		}
+	}()
+	return func() *cgroupStats {
+		close(quit)
+		wg.Wait()
+		return last
+	}
+}
+
+// Record the stats in the RunRecord's metadata.  Nil is a no-op.
+func (stats *cgroupStats) record(rr *api.FormulaRunRecord) {
+	if stats == nil {
+		return
+	}
+	if rr.Metadata == nil {
+		rr.Metadata = map[string]string{}
+	}
+	rr.Metadata["cgroup.cpu"] = (time.Duration(stats.CpuTotal) * time.Nanosecond).String()
+	rr.Metadata["cgroup.memory.max"] = strconv.FormatUint(stats.MemoryMax, 10)
+}
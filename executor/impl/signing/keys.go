@@ -0,0 +1,101 @@
+package signing
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+/*
+	Generate a new signing key and write it to a file, which must not
+	already exist.  Returns the public key, in the form used in trusted
+	keys files.
+
+	The key file holds the base64 of the key's 32-byte seed.
+	It's made readable only by us; keep it that way.
+*/
+func GenerateKeyFile(path string) (string, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", Errorf(repeatr.ErrExecutor, "cannot generate key: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", Errorf(repeatr.ErrUsage, "cannot write key file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(base64.StdEncoding.EncodeToString(key.Seed()) + "\n")); err != nil {
+		return "", Errorf(repeatr.ErrUsage, "cannot write key file: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Load a signing key written by GenerateKeyFile.
+func LoadKeyFile(path string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, Errorf(repeatr.ErrUsage, "cannot read signing key: %s", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, Errorf(repeatr.ErrUsage, "signing key file %q is malformed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Returns the public key for a signing key, in the form used in trusted keys files.
+func PublicKeyString(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+/*
+	TrustedKeys maps the base64 of each trusted public key to a name for it.
+*/
+type TrustedKeys map[string]string
+
+/*
+	Load a trusted keys file.
+
+	The format is like ssh's authorized_keys: one key per line, as base64,
+	optionally followed by whitespace and a name for the key (which is
+	otherwise named by its line number).  Blank lines and lines
+	starting with '#' are ignored.
+*/
+func LoadTrustedKeys(path string) (TrustedKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Errorf(repeatr.ErrUsage, "cannot read trusted keys: %s", err)
+	}
+	defer f.Close()
+	trusted := TrustedKeys{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		pub, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, Errorf(repeatr.ErrUsage, "trusted keys file %q line %d: malformed key", path, lineNum)
+		}
+		name := "line " + strconv.Itoa(lineNum)
+		if len(fields) > 1 {
+			name = strings.Join(fields[1:], " ")
+		}
+		trusted[fields[0]] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Errorf(repeatr.ErrUsage, "cannot read trusted keys: %s", err)
+	}
+	return trusted, nil
+}
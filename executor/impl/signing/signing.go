@@ -0,0 +1,95 @@
+/*
+	Ed25519 signatures for run records.
+
+	A signature covers the whole run record, except the signature itself,
+	and is stored in the record's metadata, so it goes everywhere the record
+	goes: into memos, `--format json` output, etc.
+*/
+package signing
+
+import (
+	"bytes"
+	"encoding/base64"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	. "github.com/warpfork/go-errcat"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+const (
+	MetadataKey_Pubkey    = "signature.pubkey"  // Base64 of the signer's ed25519 public key.
+	MetadataKey_Signature = "signature.ed25519" // Base64 of the signature.
+)
+
+/*
+	Sign the run record (in place), replacing any previous signature.
+*/
+func Sign(rr *api.FormulaRunRecord, key ed25519.PrivateKey) error {
+	msg, err := signedBytes(rr)
+	if err != nil {
+		return err
+	}
+	if rr.Metadata == nil {
+		rr.Metadata = map[string]string{}
+	}
+	rr.Metadata[MetadataKey_Pubkey] = PublicKeyString(key)
+	rr.Metadata[MetadataKey_Signature] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+	return nil
+}
+
+/*
+	Check the run record carries a valid signature by one of the trusted keys.
+	Returns the name of the key that signed it.
+
+	Errors are ErrJobInvalid if the record isn't signed, or is signed
+	by an untrusted key, or the signature doesn't match.
+*/
+func Verify(rr *api.FormulaRunRecord, trusted TrustedKeys) (string, error) {
+	pubStr, sigStr := rr.Metadata[MetadataKey_Pubkey], rr.Metadata[MetadataKey_Signature]
+	if pubStr == "" || sigStr == "" {
+		return "", Errorf(repeatr.ErrJobInvalid, "run record is not signed")
+	}
+	name, ok := trusted[pubStr]
+	if !ok {
+		return "", Errorf(repeatr.ErrJobInvalid, "run record is signed by untrusted key %s", pubStr)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		return "", Errorf(repeatr.ErrJobInvalid, "run record signature is malformed: %s", err)
+	}
+	pub, _ := base64.StdEncoding.DecodeString(pubStr) // Trusted keys are already validated.
+	msg, err := signedBytes(rr)
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), msg, sig) {
+		return "", Errorf(repeatr.ErrJobInvalid, "run record signature by key %q does not match", name)
+	}
+	return name, nil
+}
+
+// The bytes a signature covers: the run record's json, with the signature
+//  metadata left out.  Map keys are sorted, so this is stable.
+func signedBytes(rr *api.FormulaRunRecord) ([]byte, error) {
+	unsigned := *rr
+	unsigned.Metadata = nil
+	for k, v := range rr.Metadata {
+		if k == MetadataKey_Pubkey || k == MetadataKey_Signature {
+			continue
+		}
+		if unsigned.Metadata == nil {
+			unsigned.Metadata = map[string]string{}
+		}
+		unsigned.Metadata[k] = v
+	}
+	var buf bytes.Buffer
+	enc := refmt.NewMarshallerAtlased(json.EncodeOptions{}, &buf, api.Atlas_FormulaRunRecord)
+	if err := enc.Marshal(unsigned); err != nil {
+		return nil, Errorf(repeatr.ErrExecutor, "cannot serialize run record for signing: %s", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,49 @@
+package signing
+
+import (
+	"context"
+
+	. "github.com/warpfork/go-errcat"
+	"golang.org/x/crypto/ed25519"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+/*
+	Executor decorates another executor, signing the run records it returns.
+
+	Put it inside any memoization, so that memos are saved signed.
+*/
+type Executor struct {
+	key      ed25519.PrivateKey
+	delegate repeatr.RunFunc
+}
+
+func NewExecutor(
+	key ed25519.PrivateKey,
+	delegate repeatr.RunFunc,
+) (repeatr.RunFunc, error) {
+	return Executor{
+		key, delegate,
+	}.Run, nil
+}
+
+var _ repeatr.RunFunc = Executor{}.Run
+
+func (cfg Executor) Run(
+	ctx context.Context,
+	formula api.Formula,
+	formulaCtx repeatr.FormulaContext,
+	input repeatr.InputControl,
+	mon repeatr.Monitor,
+) (_ *api.FormulaRunRecord, err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+
+	rr, err := cfg.delegate(ctx, formula, formulaCtx, input, mon)
+	// Only complete records are worth vouching for.
+	if err != nil || rr == nil {
+		return rr, err
+	}
+	return rr, Sign(rr, cfg.key)
+}
@@ -0,0 +1,67 @@
+package signing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		keyPath := tmpDir.String() + "/key"
+		pub, err := GenerateKeyFile(keyPath)
+		AssertNoError(t, err)
+		key, err := LoadKeyFile(keyPath)
+		AssertNoError(t, err)
+		WantEqual(t, PublicKeyString(key), pub)
+		_, err = GenerateKeyFile(keyPath)
+		WantEqual(t, errcat.Category(err), repeatr.ErrUsage)
+
+		trustedPath := tmpDir.String() + "/trusted"
+		AssertNoError(t, ioutil.WriteFile(trustedPath, []byte("# comment\n\n"+pub+"  builder one\n"), 0644))
+		trusted, err := LoadTrustedKeys(trustedPath)
+		AssertNoError(t, err)
+		WantEqual(t, trusted, TrustedKeys{pub: "builder one"})
+
+		rr := &api.FormulaRunRecord{
+			Guid:      "rr1",
+			FormulaID: "abcdef",
+			Results:   map[api.AbsPath]api.WareID{"/out": {"tar", "qwer"}},
+			Metadata:  map[string]string{"rusage.utime": "1s"},
+		}
+		AssertNoError(t, Sign(rr, key))
+
+		t.Run("signatures should survive serialization", func(t *testing.T) {
+			var buf bytes.Buffer
+			AssertNoError(t, refmt.NewMarshallerAtlased(json.EncodeOptions{}, &buf, api.Atlas_FormulaRunRecord).Marshal(rr))
+			rr2 := &api.FormulaRunRecord{}
+			AssertNoError(t, refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, &buf, api.Atlas_FormulaRunRecord).Unmarshal(rr2))
+			name, err := Verify(rr2, trusted)
+			AssertNoError(t, err)
+			WantEqual(t, name, "builder one")
+		})
+		t.Run("tampered records should not verify", func(t *testing.T) {
+			rr2 := *rr
+			rr2.ExitCode = 1
+			_, err := Verify(&rr2, trusted)
+			WantEqual(t, errcat.Category(err), repeatr.ErrJobInvalid)
+		})
+		t.Run("records signed by untrusted keys should not verify", func(t *testing.T) {
+			_, err := Verify(rr, TrustedKeys{})
+			WantEqual(t, errcat.Category(err), repeatr.ErrJobInvalid)
+		})
+		t.Run("unsigned records should not verify", func(t *testing.T) {
+			_, err := Verify(&api.FormulaRunRecord{Guid: "rr1"}, trusted)
+			WantEqual(t, errcat.Category(err), repeatr.ErrJobInvalid)
+		})
+	})
+}
@@ -1,64 +1,330 @@
 package mixins
 
 import (
+	"bytes"
 	"context"
 	"io"
-	"io/ioutil"
+	"strconv"
+	"sync"
 	"time"
 
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+)
+
+// How long a partial line of output may wait for the rest of it before
+//  it's sent anyway.  (Prompts and progress bars don't end in a newline.)
+const OutputFlushInterval = 100 * time.Millisecond
+
+const (
+	outputChunkMax = 32 << 10 // A partial line this long is sent without waiting.
+	outputQueueMax = 1 << 20  // Writes block while this much output awaits the monitor.
 )
 
 /*
-	Returns an `io.Writer` which proxies each `Write` call
-	into a `repeatr.Event_Output` and fires it into the channel.
+	OutputForwarder turns the job's output into `executor.Event_StreamOutput`
+	events on the monitor channel.
+
+	Output is coalesced: each event carries whole lines where possible
+	(however many writes they came in), and a partial line is sent once
+	it's OutputFlushInterval old, or grows large.
+
+	Events are sent from a goroutine of the forwarder's own, so a slow
+	monitor doesn't stall the job's writes until a good amount of output
+	is queued for it -- at which point it does, rather than buffer without
+	bound.  If the context is cancelled, output is dropped instead.
 
-	If given a nil channel, the returned writer will be ioutil.Discard
-	(so yes, you can use it on `repeatr.Monitor.Chan` without even looking).
+	If the limits set a max, output past it is dropped, and a warning sent
+	in its place; or, if the limits say to kill, the forwarder's context
+	is cancelled (see Context), so the executor stops the job.
+
+	Close the forwarder after the job's process has been waited for, to
+	flush what's left.  (If given a nil channel, output is simply counted
+	and discarded, so yes, you can use it on `repeatr.Monitor.Chan`
+	without even looking.)
 */
-func NewOutputEventWriter(ctx context.Context, ch chan<- repeatr.Event) io.Writer {
-	if ch == nil {
-		return ioutil.Discard
-	}
-	return chanWriter{ctx, ch}
+type OutputForwarder struct {
+	parent context.Context // Output is dropped once this is cancelled.
+	ctx    context.Context // Also cancelled if the job should be killed for its output.
+	cancel context.CancelFunc
+	mon    repeatr.Monitor
+	limits executor.OutputLimits
+
+	mu       sync.Mutex
+	partial  map[executor.Stream]*partialLine
+	queue    []repeatr.Event
+	queued   int   // Bytes of output in the queue.
+	total    int64 // Bytes of output accepted.
+	exceeded bool  // Set once output hits the limit.
+	closed   bool
+	eager    bool // If set, partial lines aren't held back at all.  (See Interactive.)
+
+	kick chan struct{} // Wakes the pump.
+	room chan struct{} // Wakes writers waiting on the pump.
+	done chan struct{} // Closed when the pump has sent everything, after Close.
+	once sync.Once
 }
 
-type chanWriter struct {
-	ctx context.Context
-	ch  chan<- repeatr.Event
+type partialLine struct {
+	buf   []byte
+	since time.Time
 }
 
-func (chw chanWriter) Write(bs []byte) (int, error) {
-	select {
-	case chw.ch <- repeatr.Event_Output{
-		Time: time.Now(),
-		Msg:  string(bs),
-	}: // nice
-	case <-chw.ctx.Done():
-		return 0, nil
+func NewOutputForwarder(ctx context.Context, mon repeatr.Monitor, limits executor.OutputLimits) *OutputForwarder {
+	f := &OutputForwarder{
+		parent:  ctx,
+		mon:     mon,
+		limits:  limits,
+		partial: map[executor.Stream]*partialLine{},
+		kick:    make(chan struct{}, 1),
+		room:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
 	}
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	go f.pump()
+	return f
+}
+
+/*
+	Returns the `io.Writer` for one of the job's streams.
+
+	Writes never return an error: dropping output is the only thing we do
+	with it that can go wrong, and a short write would turn into an error
+	from `cmd.Wait`, obscuring the exit status.
+*/
+func (f *OutputForwarder) Writer(stream executor.Stream) io.Writer {
+	return streamWriter{f, stream}
+}
+
+type streamWriter struct {
+	f      *OutputForwarder
+	stream executor.Stream
+}
+
+func (w streamWriter) Write(bs []byte) (int, error) {
+	w.f.write(w.stream, bs)
 	return len(bs), nil
 }
 
 /*
-	Proxies each item in the channel into a call to the given `io.WriteCloser`.
-	The writer is closed when the channel is closed.
-	(Pairs well with `cmd.StdinPipe`.)
+	Stop holding back partial lines.  For a job on a terminal: its echo
+	comes a keystroke at a time, and waiting for the rest of the line
+	would just be lag.
 */
-func RunInputWriteForwarder(ctx context.Context, writeTo io.WriteCloser, ch <-chan string) {
-	go func() {
-		for {
-			select {
-			case chunk, ok := <-ch:
-				if !ok {
-					writeTo.Close()
-					return
+func (f *OutputForwarder) Interactive() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.eager = true
+}
+
+/*
+	Returns a context which is cancelled along with the one the forwarder
+	was made with, and also if the job exceeds its output limit in kill mode.
+	Executors should use it to decide when to stop the job.
+*/
+func (f *OutputForwarder) Context() context.Context {
+	return f.ctx
+}
+
+/*
+	Returns an ErrCancelled error if the job was stopped for exceeding
+	its output limit, or nil.
+*/
+func (f *OutputForwarder) LimitErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.exceeded || !f.limits.Kill {
+		return nil
+	}
+	return Errorf(repeatr.ErrCancelled, "job killed: output exceeded limit of %d bytes", f.limits.MaxBytes)
+}
+
+/*
+	Record the volume of the job's output in the RunRecord's metadata,
+	and whether it was truncated.
+*/
+func (f *OutputForwarder) Record(rr *api.FormulaRunRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recordMetadata(rr, "output.bytes", strconv.FormatInt(f.total, 10))
+	if f.exceeded {
+		recordMetadata(rr, "output.truncated", "true")
+	}
+}
+
+/*
+	Flush any remaining output, and wait for it to be sent.
+	Safe to call more than once (so it's fine to defer, as well).
+*/
+func (f *OutputForwarder) Close() {
+	f.once.Do(func() {
+		f.mu.Lock()
+		for _, stream := range []executor.Stream{executor.Stream_Stdout, executor.Stream_Stderr} {
+			f.flushPartial(stream)
+		}
+		f.closed = true
+		f.mu.Unlock()
+		notify(f.kick)
+		<-f.done
+		f.cancel()
+	})
+}
+
+func (f *OutputForwarder) write(stream executor.Stream, bs []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.exceeded || f.closed {
+		return
+	}
+	if max := f.limits.MaxBytes; max > 0 && f.total+int64(len(bs)) > max {
+		bs = bs[:max-f.total]
+		f.exceeded = true
+	}
+	f.total += int64(len(bs))
+
+	// Queue whole lines; keep the remainder until it's finished (or old, or big).
+	pl := f.partial[stream]
+	if pl == nil {
+		pl = &partialLine{}
+		f.partial[stream] = pl
+	}
+	if len(pl.buf) == 0 {
+		pl.since = time.Now()
+	}
+	pl.buf = append(pl.buf, bs...)
+	if i := bytes.LastIndexByte(pl.buf, '\n'); i >= 0 {
+		f.enqueue(stream, pl.buf[:i+1])
+		pl.buf = append([]byte(nil), pl.buf[i+1:]...)
+		pl.since = time.Now()
+	}
+	if len(pl.buf) >= outputChunkMax || f.eager {
+		f.flushPartial(stream)
+	}
+
+	if f.exceeded {
+		for _, stream := range []executor.Stream{executor.Stream_Stdout, executor.Stream_Stderr} {
+			f.flushPartial(stream)
+		}
+		msg := "job output exceeded limit; further output is dropped"
+		if f.limits.Kill {
+			msg = "job output exceeded limit; killing job"
+		}
+		f.queue = append(f.queue, repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   msg,
+			Detail: [][2]string{
+				{"limit", strconv.FormatInt(f.limits.MaxBytes, 10)},
+			},
+		})
+		if f.limits.Kill {
+			f.cancel()
+		}
+	}
+	notify(f.kick)
+
+	// Backpressure: if the monitor is falling behind, so does the job.
+	for f.queued > outputQueueMax && f.parent.Err() == nil {
+		f.mu.Unlock()
+		select {
+		case <-f.room:
+		case <-f.parent.Done():
+		}
+		f.mu.Lock()
+	}
+}
+
+// Call with the lock held.
+func (f *OutputForwarder) flushPartial(stream executor.Stream) {
+	pl := f.partial[stream]
+	if pl == nil || len(pl.buf) == 0 {
+		return
+	}
+	f.enqueue(stream, pl.buf)
+	pl.buf = nil
+}
+
+// Call with the lock held.
+func (f *OutputForwarder) enqueue(stream executor.Stream, bs []byte) {
+	f.queue = append(f.queue, executor.Event_StreamOutput{
+		Event_Output: repeatr.Event_Output{
+			Time: time.Now(),
+			Msg:  string(bs),
+		},
+		Stream: stream,
+	})
+	f.queued += len(bs)
+}
+
+// Sends queued events, and flushes partial lines as they age.
+//  Exits once closed and everything's sent.
+func (f *OutputForwarder) pump() {
+	defer close(f.done)
+	for {
+		f.mu.Lock()
+		evts := f.queue
+		f.queue, f.queued = nil, 0
+		closed := f.closed
+		var oldest time.Time
+		for _, pl := range f.partial {
+			if len(pl.buf) > 0 && (oldest.IsZero() || pl.since.Before(oldest)) {
+				oldest = pl.since
+			}
+		}
+		f.mu.Unlock()
+		notify(f.room)
+
+		for _, evt := range evts {
+			f.send(evt)
+		}
+		if len(evts) > 0 {
+			continue
+		}
+		if closed {
+			return
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !oldest.IsZero() {
+			timer = time.NewTimer(OutputFlushInterval - time.Since(oldest))
+			timeout = timer.C
+		}
+		select {
+		case <-f.kick:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-timeout:
+			f.mu.Lock()
+			for stream, pl := range f.partial {
+				if len(pl.buf) > 0 && time.Since(pl.since) >= OutputFlushInterval {
+					f.flushPartial(stream)
 				}
-				writeTo.Write([]byte(chunk))
-			case <-ctx.Done():
-				writeTo.Close()
-				return
 			}
+			f.mu.Unlock()
 		}
-	}()
+	}
+}
+
+func (f *OutputForwarder) send(evt repeatr.Event) {
+	if f.mon.Chan == nil {
+		return
+	}
+	select {
+	case f.mon.Chan <- evt: // nice
+	case <-f.parent.Done():
+		// Drop the output; nobody's waiting for it.
+	}
+}
+
+// Non-blocking wakeup for a chan with a buffer of one.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
 }
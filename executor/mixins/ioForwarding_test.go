@@ -0,0 +1,99 @@
+package mixins
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+// Drain events until the channel's been quiet for a bit.
+func drain(ch <-chan repeatr.Event) (msgs []string, logs []repeatr.Event_Log) {
+	for {
+		select {
+		case evt := <-ch:
+			if _, out, ok := executor.OutputEvent(evt); ok {
+				msgs = append(msgs, out.Msg)
+			} else if log, ok := evt.(repeatr.Event_Log); ok {
+				logs = append(logs, log)
+			}
+		case <-time.After(3 * OutputFlushInterval):
+			return
+		}
+	}
+}
+
+func TestOutputForwarder(t *testing.T) {
+	t.Run("output should be coalesced into lines", func(t *testing.T) {
+		ch := make(chan repeatr.Event, 10)
+		out := NewOutputForwarder(context.Background(), repeatr.Monitor{Chan: ch}, executor.OutputLimits{})
+		w := out.Writer(executor.Stream_Stdout)
+		w.Write([]byte("a"))
+		w.Write([]byte("b\nc"))
+		w.Write([]byte("d\ne"))
+		out.Close()
+		msgs, _ := drain(ch)
+		WantEqual(t, strings.Join(msgs, ""), "ab\ncd\ne")
+		for _, msg := range msgs[:len(msgs)-1] {
+			WantEqual(t, strings.HasSuffix(msg, "\n"), true)
+		}
+	})
+	t.Run("partial lines should be sent after a while", func(t *testing.T) {
+		ch := make(chan repeatr.Event, 10)
+		out := NewOutputForwarder(context.Background(), repeatr.Monitor{Chan: ch}, executor.OutputLimits{})
+		defer out.Close()
+		out.Writer(executor.Stream_Stdout).Write([]byte("prompt> "))
+		msgs, _ := drain(ch)
+		WantEqual(t, msgs, []string{"prompt> "})
+	})
+	t.Run("output past the limit should be dropped, with a warning", func(t *testing.T) {
+		ch := make(chan repeatr.Event, 10)
+		out := NewOutputForwarder(context.Background(), repeatr.Monitor{Chan: ch}, executor.OutputLimits{MaxBytes: 8})
+		out.Writer(executor.Stream_Stdout).Write([]byte("hello\n"))
+		out.Writer(executor.Stream_Stderr).Write([]byte("world\n"))
+		out.Writer(executor.Stream_Stderr).Write([]byte("more\n"))
+		out.Close()
+		msgs, logs := drain(ch)
+		WantEqual(t, msgs, []string{"hello\n", "wo"})
+		WantEqual(t, len(logs), 1)
+		WantEqual(t, out.LimitErr(), nil)
+		rr := &api.FormulaRunRecord{}
+		out.Record(rr)
+		WantEqual(t, rr.Metadata["output.bytes"], "8")
+		WantEqual(t, rr.Metadata["output.truncated"], "true")
+	})
+	t.Run("output past the limit should cancel, in kill mode", func(t *testing.T) {
+		out := NewOutputForwarder(context.Background(), repeatr.Monitor{}, executor.OutputLimits{MaxBytes: 8, Kill: true})
+		defer out.Close()
+		out.Writer(executor.Stream_Stdout).Write([]byte("hello\n"))
+		WantEqual(t, out.Context().Err(), nil)
+		out.Writer(executor.Stream_Stdout).Write([]byte("world\n"))
+		WantEqual(t, out.Context().Err(), context.Canceled)
+		WantEqual(t, Category(out.LimitErr()), repeatr.ErrCancelled)
+	})
+	t.Run("a stalled monitor should not hang the job once cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		out := NewOutputForwarder(ctx, repeatr.Monitor{Chan: make(chan repeatr.Event)}, executor.OutputLimits{})
+		done := make(chan struct{})
+		go func() {
+			io.Copy(out.Writer(executor.Stream_Stdout), strings.NewReader(strings.Repeat("spam\n", 1<<20)))
+			out.Close()
+			close(done)
+		}()
+		time.Sleep(OutputFlushInterval)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("writes still blocked after cancel")
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package mixins
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+// How long a job is given to exit after the polite signal on cancellation,
+// before we escalate to SIGKILL.
+const CancelGracePeriod = 5 * time.Second
+
+/*
+	Watches the context while a job runs, and if it's cancelled, signals the
+	job with SIGTERM, then escalates to SIGKILL if it hasn't exited by the
+	end of the grace period.
+
+	The signal func is how the executor delivers a signal to the job --
+	e.g. `runc kill`, or signalling a whole process group.
+	Failures to deliver a signal are logged to the monitor.
+
+	Call the returned func once the job's process has been waited for;
+	it stops the watcher and reports whether the job was cancelled.
+*/
+func SignalOnCancel(
+	ctx context.Context,
+	mon repeatr.Monitor,
+	signal func(syscall.Signal) error,
+) (awaitCancel func() (cancelled bool)) {
+	exited := make(chan struct{})
+	cancelled := false
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+			cancelled = true
+		}
+		sendSignal(mon, signal, syscall.SIGTERM)
+		select {
+		case <-exited:
+			return
+		case <-time.After(CancelGracePeriod):
+		}
+		sendSignal(mon, signal, syscall.SIGKILL)
+	}()
+	return func() bool {
+		close(exited)
+		wg.Wait()
+		return cancelled
+	}
+}
+
+func sendSignal(mon repeatr.Monitor, signal func(syscall.Signal) error, sig syscall.Signal) {
+	mon.Send(repeatr.Event_Log{
+		Time:  time.Now(),
+		Level: repeatr.LogInfo,
+		Msg:   "job cancelled; signalling",
+		Detail: [][2]string{
+			{"signal", sig.String()},
+		},
+	})
+	if err := signal(sig); err != nil {
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   "error signalling job: " + err.Error(),
+			Detail: [][2]string{
+				{"signal", sig.String()},
+				{"error", err.Error()},
+			},
+		})
+	}
+}
+
+/*
+	Annotate the RunRecord if the job was cancelled (rather than exiting of
+	its own accord), so that the record can't be mistaken for a job failure.
+
+	The exit code is reset to -1, since whatever the process reported as
+	it was being killed isn't meaningful.
+*/
+func RecordCancellation(rr *api.FormulaRunRecord, err error) {
+	if Category(err) != repeatr.ErrCancelled {
+		return
+	}
+	rr.ExitCode = -1
+	recordMetadata(rr, "cancelled", err.Error())
+}
@@ -0,0 +1,78 @@
+package mixins
+
+import (
+	"context"
+	"os/exec"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+)
+
+/*
+	JobIO wires a job's stdio, the same way for every executor:
+
+	  - If the job's `repeatr.InputControl` has a channel, the job is
+	    interactive, and gets a terminal (see Pty): the input is typed into
+	    it, everything the job prints comes out as stdout, closing the
+	    channel sends an end-of-file character, and the terminal follows
+	    `executor.Config.TerminalSize`.
+	  - Otherwise, the job's stdin is empty, and stdout and stderr each
+	    get a pipe, so the order of writes is only kept within a stream,
+	    not between them.
+
+	Either way, output goes to the OutputForwarder.
+
+	Use: AttachIO before starting the command; Started after; and Wait
+	once the command's been waited for (or Abort, if it failed to start).
+*/
+type JobIO struct {
+	ctx    context.Context
+	input  repeatr.InputControl
+	resize <-chan executor.WindowSize
+	out    *OutputForwarder
+	pty    *Pty   // Nil if not interactive.
+	wait   func() // Set once started.
+}
+
+func AttachIO(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	input repeatr.InputControl,
+	resize <-chan executor.WindowSize,
+	out *OutputForwarder,
+) (*JobIO, error) {
+	jio := &JobIO{ctx: ctx, input: input, resize: resize, out: out, wait: func() {}}
+	if input.Chan == nil {
+		cmd.Stdout = out.Writer(executor.Stream_Stdout)
+		cmd.Stderr = out.Writer(executor.Stream_Stderr)
+		return jio, nil
+	}
+	pty, err := OpenPty()
+	if err != nil {
+		return nil, err
+	}
+	pty.Attach(cmd)
+	out.Interactive()
+	jio.pty = pty
+	return jio, nil
+}
+
+// Call after the command has started.
+func (jio *JobIO) Started() {
+	if jio.pty != nil {
+		jio.wait = jio.pty.Forward(jio.ctx, jio.input, jio.resize, jio.out.Writer(executor.Stream_Stdout))
+	}
+}
+
+// Call if the command failed to start.
+func (jio *JobIO) Abort() {
+	if jio.pty != nil {
+		jio.pty.Close()
+	}
+}
+
+// Call after the command has been waited for; waits for the last of
+//  the output.  Safe to call more than once (so it's fine to defer, too).
+func (jio *JobIO) Wait() {
+	jio.wait()
+}
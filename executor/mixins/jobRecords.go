@@ -2,9 +2,13 @@ package mixins
 
 import (
 	"os"
+	"strconv"
+	"syscall"
 	"time"
 
 	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/repeatr/executor/cradle"
 	"go.polydawn.net/rio/lib/guid"
 )
 
@@ -23,3 +27,53 @@ func InitRunRecord(rr *api.FormulaRunRecord, frm api.Formula) {
 	rr.ExitCode = -1
 	rr.Hostname, _ = os.Hostname()
 }
+
+/*
+	Initialize the RunRecord for a new job (see InitRunRecord), then return
+	the formula as it should actually be run, with deterministic mode
+	applied if the config asks for it (see cradle.ApplyDeterminism).
+
+	In that order: the record's setupHash is of the formula as given.
+*/
+func InitJob(rr *api.FormulaRunRecord, frm api.Formula, config executor.Config) api.Formula {
+	InitRunRecord(rr, frm)
+	return cradle.ApplyDeterminism(frm, config)
+}
+
+/*
+	Record the wall-clock duration of a phase of the job
+	(e.g. "assemble", "exec", "pack") in the RunRecord's metadata.
+
+	Typical usage is to defer it at the start of the phase:
+	`defer mixins.RecordPhaseTime(rr, "pack", time.Now())`.
+*/
+func RecordPhaseTime(rr *api.FormulaRunRecord, phase string, start time.Time) {
+	recordMetadata(rr, "phase."+phase, time.Since(start).String())
+}
+
+/*
+	Record the resource usage of the job's process -- user and system cpu
+	time, and peak RSS -- in the RunRecord's metadata.
+
+	The usage includes all descendants of the process which it waited for;
+	which for a container runtime, means the whole container.
+	Does nothing if the process state is nil (e.g., it never started).
+*/
+func RecordRusage(rr *api.FormulaRunRecord, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	recordMetadata(rr, "rusage.utime", state.UserTime().String())
+	recordMetadata(rr, "rusage.stime", state.SystemTime().String())
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports maxrss in KiB.
+		recordMetadata(rr, "rusage.maxrss", strconv.FormatInt(rusage.Maxrss*1024, 10))
+	}
+}
+
+func recordMetadata(rr *api.FormulaRunRecord, key, value string) {
+	if rr.Metadata == nil {
+		rr.Metadata = map[string]string{}
+	}
+	rr.Metadata[key] = value
+}
@@ -0,0 +1,131 @@
+package mixins
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	"github.com/polydawn/refmt/obj/atlas"
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/rio/fs"
+)
+
+// The name of the file in a job's work dir which says it's running.
+const runningJobFilename = "job.json"
+
+/*
+	RunningJob describes a job while it runs, so that `repeatr ps` can list
+	it, and `repeatr exec` can get into it.
+
+	It's kept in the job's work dir (see MakeWorkDirs) from just after the
+	job starts until it exits.  If repeatr dies without removing it, its
+	pid won't be alive anymore, and ListRunningJobs skips it.
+*/
+type RunningJob struct {
+	Guid      string
+	SetupHash api.FormulaSetupHash
+	Executor  string
+	Started   string // RFC3339.
+	Pid       int    // On the host: the container runtime's, or the job's own first process.
+	Runtime   string // Path to the container runtime binary, if the executor uses one.
+	StateDir  string // The runtime's state dir (its `--root`), if the executor uses one.
+	Uid       int    // The job's user, as the job sees it.
+	Gid       int    // The job's group, as the job sees it.
+}
+
+var Atlas_RunningJob = atlas.MustBuild(
+	atlas.BuildEntry(RunningJob{}).StructMap().Autogenerate().Complete(),
+)
+
+/*
+	Record that a job has started, in its work dir.  Call the returned func
+	once the job has exited.
+
+	This is best effort: if the record can't be written, the job runs all
+	the same (it just won't be listed), and the monitor gets a warning.
+*/
+func RegisterJob(jobFs fs.FS, job RunningJob, mon repeatr.Monitor) (unregister func()) {
+	job.Started = time.Now().UTC().Format(time.RFC3339)
+	pth := filepath.Join(jobFs.BasePath().String(), runningJobFilename)
+	var buf bytes.Buffer
+	if err := refmt.NewMarshallerAtlased(json.EncodeOptions{}, &buf, Atlas_RunningJob).Marshal(job); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(pth, buf.Bytes(), 0600); err != nil {
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   "cannot record job as running (it won't be listed by `repeatr ps`): " + err.Error(),
+			Detail: [][2]string{
+				{"error", err.Error()},
+			},
+		})
+		return func() {}
+	}
+	return func() {
+		os.Remove(pth)
+	}
+}
+
+/*
+	List the jobs running in an executor's workspace dir, oldest first.
+
+	A workspace dir which doesn't exist (yet) has no jobs in it.
+*/
+func ListRunningJobs(workspaceDir fs.AbsolutePath) ([]RunningJob, error) {
+	dirs, err := ioutil.ReadDir(workspaceDir.String())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "cannot list jobs: %s", err)
+	}
+	var jobs []RunningJob
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		job, ok := loadRunningJob(filepath.Join(workspaceDir.String(), dir.Name(), runningJobFilename))
+		if !ok || !pidAlive(job.Pid) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started < jobs[j].Started
+	})
+	return jobs, nil
+}
+
+// Load a job record.  Missing or unreadable ones are skipped; they're
+//  from jobs which have finished (or are only just starting).
+func loadRunningJob(pth string) (job RunningJob, ok bool) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return job, false
+	}
+	defer f.Close()
+	if err := refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, f, Atlas_RunningJob).Unmarshal(&job); err != nil {
+		return job, false
+	}
+	return job, true
+}
+
+// Signal zero checks a process exists without touching it.  (EPERM still
+//  means it exists; it's just not ours.)
+func pidAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
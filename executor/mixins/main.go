@@ -2,12 +2,15 @@ package mixins
 
 import (
 	"context"
+	"os"
+	"time"
 
 	. "github.com/warpfork/go-errcat"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/repeatr/executor/cradle"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/stitch"
@@ -15,42 +18,105 @@ import (
 
 func WithFilesystem(
 	ctx context.Context,
+	jobFs fs.FS, // The job's work dir; removed after, unless the config says to keep it.
 	chrootFs fs.FS, // Unpack everything here.
 	assemblerTool *stitch.Assembler, // Using this tool.
 	packTool rio.PackFunc, // And this tool.
 	formula api.Formula, // Following these instructions.
 	formulaCtx repeatr.FormulaContext, // Fetching and saving from here.
 	mon repeatr.Monitor, // Logging to this.
+	rr *api.FormulaRunRecord, // Recording phase timings here.
+	config executor.Config, // Rootless mode and job options affect the setup.
 	fn func(fs.FS) error, // Then call this while it's set up.
 ) (results map[api.AbsPath]api.WareID, err error) {
 	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
 
+	// Keep or remove the work dir when we're done: deferred first, so it
+	//  happens last, once the input mounts are detached.
+	detached := true
+	defer func() {
+		finishWorkDir(jobFs, config.KeepWorkspace, err != nil || rr.ExitCode != 0, detached, mon)
+	}()
+
+	// Pick ownership for the filesystem.
+	//  Rootless, we can't create files owned by anyone but ourselves:
+	//  so that's what everything will be, and the executor is responsible
+	//  for mapping the job's uid and gid onto ours.  Inside the job, then,
+	//  *everything* is owned by the job's user, who can modify all of it.
+	//  (That's only the job's own copy; but it's not what the wares say.)
+	//  Outputs still come out right when the pack filters flatten ownership
+	//  (as they do by default); outputs asking to keep ownership would be
+	//  quietly wrong, so we refuse them.
+	umask, err := config.Job.ParseUmask()
+	if err != nil {
+		return nil, err
+	}
+	unpackFilter := api.FilesetUnpackFilter_Lossless
+	dirprops := cradle.DirpropsForUserinfo(*formula.Action.Userinfo, umask)
+	if config.Rootless {
+		if err := checkRootlessOutputs(formula); err != nil {
+			return nil, err
+		}
+		unpackFilter = api.FilesetUnpackFilter_LowPriv
+		dirprops.Uid, dirprops.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	}
+
 	// Shell out to assembler.
-	unpackSpecs := unpackSpecsForFormula(formula, formulaCtx, api.FilesetUnpackFilter_Lossless)
+	assembleStart := time.Now()
+	unpackSpecs := unpackSpecsForFormula(formula, formulaCtx, unpackFilter)
 	wgRioLogs := ForwardRioUnpackLogs(ctx, mon, unpackSpecs)
-	cleanupFunc, err := assemblerTool.Run(ctx, chrootFs, unpackSpecs, cradle.DirpropsForUserinfo(*formula.Action.Userinfo))
+	cleanupFunc, err := assemblerTool.Run(ctx, chrootFs, unpackSpecs, dirprops)
 	wgRioLogs.Wait()
 	if err != nil {
 		return nil, repeatr.ReboxRioError(err)
 	}
-	defer CleanupFuncWithLogging(cleanupFunc, mon)()
+	detached = false
+	defer CleanupFuncWithLogging(func() error {
+		err := cleanupFunc()
+		detached = err == nil
+		return err
+	}, mon)()
 
 	// Last bit of filesystem brushup: run cradle fs mutations.
-	if err := cradle.TidyFilesystem(formula, chrootFs); err != nil {
+	if err := cradle.TidyFilesystem(formula, chrootFs, dirprops, cradle.Hostname(formula.Action, rr, config), config.Job); err != nil {
 		return nil, err
 	}
+	RecordPhaseTime(rr, "assemble", assembleStart)
 
 	// Do the thing!
+	execStart := time.Now()
 	if err := fn(chrootFs); err != nil {
 		return nil, err
 	}
+	RecordPhaseTime(rr, "exec", execStart)
 
 	// Pack outputs.
+	defer RecordPhaseTime(rr, "pack", time.Now())
 	packSpecs := packSpecsForFormula(formula, formulaCtx, api.FilesetPackFilter_Flatten)
-	results, err = stitch.PackMulti(ctx, packTool, chrootFs, packSpecs)
+	results, err = stitch.PackMulti(ctx, ForwardRioPackLogs(ctx, mon, chrootFs.BasePath(), packTool), chrootFs, packSpecs)
 	return results, repeatr.ReboxRioError(err)
 }
 
+/*
+	Check that a formula's outputs can be packed faithfully in rootless mode:
+	that is, that none of them keeps ownership, since everything the job
+	sees is owned by one user.
+
+	(Inputs can't ask for their ownership to be kept: formulas have no
+	unpack filters.  They're flattened to the job's user, as above.)
+*/
+func checkRootlessOutputs(formula api.Formula) error {
+	for path, output := range formula.Outputs {
+		filter := output.Filter.Apply(api.FilesetPackFilter_Flatten)
+		keepUid, _ := filter.Uid()
+		keepGid, _ := filter.Gid()
+		if keepUid || keepGid {
+			return Errorf(repeatr.ErrUsage, "output %q keeps file ownership, which cannot be honored in rootless mode (flatten uid and gid, or run as root)", path)
+		}
+	}
+	return nil
+}
+
 /*
 	Reduce a formula to a slice of []stitch.UnpackSpec, ready to be used
 	invoking stitch.Assembler.Run().
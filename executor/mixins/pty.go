@@ -0,0 +1,194 @@
+package mixins
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	. "github.com/warpfork/go-errcat"
+	"golang.org/x/sys/unix"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+)
+
+// How long to keep reading a job's terminal after its process exits,
+//  in case something it left behind is still holding it open.
+const ptyDrainTimeout = time.Second
+
+/*
+	Pty is a pseudo-terminal for an interactive job.
+
+	We own the master side: input from the `repeatr.InputControl` is
+	written to it, what the job writes comes back out of it as output,
+	and we set its size.  The job gets the slave side as its stdio and
+	controlling terminal.
+
+	Container runtimes which allocate a terminal of their own (runc, runsc)
+	can be handed ours in the same way: they treat it as the user's
+	terminal, putting it in raw mode and following its size.
+
+	Use: OpenPty; Attach the command; start it; Forward; and once the
+	command has been waited for, call the func Forward returned.
+*/
+type Pty struct {
+	master *os.File
+	slave  *os.File
+}
+
+func OpenPty() (*Pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, Errorf(repeatr.ErrExecutor, "cannot allocate a terminal: %s", err)
+	}
+	unlock := 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		return nil, Errorf(repeatr.ErrExecutor, "cannot allocate a terminal: unlockpt: %s", errno)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, Errorf(repeatr.ErrExecutor, "cannot allocate a terminal: ptsname: %s", err)
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, Errorf(repeatr.ErrExecutor, "cannot allocate a terminal: %s", err)
+	}
+	return &Pty{master, slave}, nil
+}
+
+// Release the terminal, if it never got as far as Forward.
+//  (Otherwise, the func Forward returns does this.)
+func (p *Pty) Close() {
+	p.master.Close()
+	p.slave.Close()
+}
+
+/*
+	Set up the command to run on the terminal: with the slave as its stdio,
+	and as the controlling terminal of a new session.
+
+	The new session is also a new process group (and the command can't be
+	put in another one: don't set Setpgid), so signalling the group works
+	the same as without a terminal.
+*/
+func (p *Pty) Attach(cmd *exec.Cmd) {
+	cmd.Stdin = p.slave
+	cmd.Stdout = p.slave
+	cmd.Stderr = p.slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0 // The child's stdin.
+}
+
+/*
+	Start moving data through the terminal, once the attached command has
+	started: input to the master, and the master's output to the writer.
+	Sizes from the resize channel (which may be nil) are applied to the
+	terminal, which signals the job with SIGWINCH.
+
+	When the input channel is closed, the job gets an end-of-file character,
+	as if the user had typed one.  (Closing the master would hang up the
+	terminal entirely.)
+
+	Call the returned func after the command has been waited for; it waits
+	for the output to be drained, and releases the terminal.  (Calls after
+	the first do nothing.)
+*/
+func (p *Pty) Forward(ctx context.Context, input repeatr.InputControl, resize <-chan executor.WindowSize, output io.Writer) (wait func()) {
+	// The command has its own copy of the slave now; ours would keep
+	//  the master from ever seeing the end of output.
+	p.slave.Close()
+
+	stop := make(chan struct{})
+	if input.Chan != nil {
+		go func() {
+			for {
+				select {
+				case chunk, ok := <-input.Chan:
+					if !ok {
+						p.master.Write([]byte{eofChar(p.master)})
+						return
+					}
+					p.master.Write([]byte(chunk))
+				case <-stop:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	if resize != nil {
+		go func() {
+			for {
+				select {
+				case size, ok := <-resize:
+					if !ok {
+						return
+					}
+					p.Resize(size)
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Reading the master fails with EIO once every copy of the slave is
+		//  closed: that's our EOF.
+		io.Copy(output, p.master)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			drained := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+			case <-time.After(ptyDrainTimeout):
+				// Give up on it.  (The master is in blocking mode, so closing it
+				//  won't interrupt the copy; that ends when the straggler does.)
+			}
+			p.master.Close()
+		})
+	}
+}
+
+// Set the size of the terminal.  Errors are ignored: the job will just
+//  have a terminal of the wrong size.
+func (p *Pty) Resize(size executor.WindowSize) {
+	unix.IoctlSetWinsize(int(p.master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row: size.Rows,
+		Col: size.Cols,
+	})
+}
+
+// The terminal's end-of-file character; ctrl-D, unless the job has changed it.
+func eofChar(f *os.File) byte {
+	termios, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	if err != nil || termios.Cc[unix.VEOF] == 0 {
+		return 0x04
+	}
+	return termios.Cc[unix.VEOF]
+}
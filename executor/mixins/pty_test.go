@@ -0,0 +1,31 @@
+package mixins
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+)
+
+func TestPty(t *testing.T) {
+	pty, err := OpenPty()
+	AssertNoError(t, err)
+	cmd := exec.Command("/bin/sh", "-c", "test -t 0 && read x && echo got:$x")
+	pty.Attach(cmd)
+	AssertNoError(t, cmd.Start())
+	inputChan := make(chan string, 1)
+	inputChan <- "hello\n"
+	sizes := make(chan executor.WindowSize, 1)
+	sizes <- executor.WindowSize{Rows: 24, Cols: 100}
+	var buf bytes.Buffer
+	wait := pty.Forward(context.Background(), repeatr.InputControl{Chan: inputChan}, sizes, &buf)
+	cmd.Wait()
+	wait()
+	WantEqual(t, cmd.ProcessState.Success(), true)
+	WantEqual(t, strings.Contains(buf.String(), "got:hello\r\n"), true)
+}
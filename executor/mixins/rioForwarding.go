@@ -2,17 +2,23 @@ package mixins
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
+	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/stitch"
 )
 
 /*
 	Set `rio.Monitor`s on a bunch of unpackSpecs to all forward log events
-	to the `repeatr.Monitor` log events.
+	to the `repeatr.Monitor` log events, and progress events as
+	`executor.Event_Progress`.
 
 	The arg slice contents are modified in place.
 
@@ -32,18 +38,59 @@ func ForwardRioUnpackLogs(
 		wg.Add(1)
 		ch := make(chan rio.Event)
 		unpackSpecs[i].Monitor = rio.Monitor{ch}
+		path := api.AbsPath(unpackSpecs[i].Path.String())
 		go func() {
 			defer wg.Done()
-			forwardRioUnpackLogLoop(ctx, mon, ch)
+			forwardRioLogLoop(ctx, mon, executor.Phase_Unpack, path, ch, nil)
 		}()
 	}
 	return &wg
 }
 
-func forwardRioUnpackLogLoop(
+/*
+	Wraps a `rio.PackFunc` to forward its log and progress events to the
+	`repeatr.Monitor`, the same as ForwardRioUnpackLogs does for unpacking.
+
+	`stitch.PackMulti` gives us no per-ware monitor to set, so we
+	interpose on the pack func instead.  The host path it's called with
+	is reported relative to the given base (the job's filesystem).
+*/
+func ForwardRioPackLogs(
+	ctx context.Context,
+	mon repeatr.Monitor,
+	base fs.AbsolutePath,
+	packTool rio.PackFunc,
+) rio.PackFunc {
+	if mon.Chan == nil {
+		return packTool
+	}
+	return func(ctx2 context.Context, packType api.PackType, pathStr string, filt api.FilesetPackFilter, warehouse api.WarehouseLocation, _ rio.Monitor) (api.WareID, error) {
+		ch := make(chan rio.Event)
+		returned := make(chan struct{})
+		path := api.AbsPath("/" + strings.TrimLeft(strings.TrimPrefix(pathStr, base.String()), "/"))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardRioLogLoop(ctx, mon, executor.Phase_Pack, path, ch, returned)
+		}()
+		wareID, err := packTool(ctx2, packType, pathStr, filt, warehouse, rio.Monitor{ch})
+		close(returned)
+		wg.Wait()
+		return wareID, err
+	}
+}
+
+// Forward events until the rio channel is closed -- or, if `returned` is
+//  given, until it's closed (rio won't send anything after its func returns;
+//  whether it closes the channel is its business).
+func forwardRioLogLoop(
 	ctx context.Context,
 	mon repeatr.Monitor,
+	phase executor.Phase,
+	path api.AbsPath,
 	rioCh <-chan rio.Event,
+	returned <-chan struct{},
 ) {
 	for {
 		select {
@@ -60,14 +107,40 @@ func forwardRioUnpackLogLoop(
 					Detail: evt2.Detail,
 				}
 			case rio.Event_Progress:
-				// pass... for now
+				mon.Chan <- progressEvent(phase, path, evt2)
 			}
+		case <-returned:
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+func progressEvent(phase executor.Phase, path api.AbsPath, evt rio.Event_Progress) executor.Event_Progress {
+	desc := evt.Desc
+	if desc == "" {
+		desc = evt.Phase
+	}
+	return executor.Event_Progress{
+		Event_Log: repeatr.Event_Log{
+			Time:  evt.Time,
+			Level: repeatr.LogInfo,
+			Msg:   string(phase) + " " + string(path),
+			Detail: [][2]string{
+				{"desc", desc},
+				{"progress", strconv.Itoa(evt.TotalProg)},
+				{"work", strconv.Itoa(evt.TotalWork)},
+			},
+		},
+		Phase:     phase,
+		Path:      path,
+		Desc:      desc,
+		TotalProg: evt.TotalProg,
+		TotalWork: evt.TotalWork,
+	}
+}
+
 /*
 	Wraps a Rio stitch cleanup func to log any errors to the `repeatr.Event`
 	channel.
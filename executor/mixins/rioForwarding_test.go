@@ -0,0 +1,39 @@
+package mixins
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestForwardRioPackLogs(t *testing.T) {
+	// A pack func which reports progress, and (as it's allowed to) leaves
+	//  the monitor channel open.
+	packTool := func(_ context.Context, _ api.PackType, _ string, _ api.FilesetPackFilter, _ api.WarehouseLocation, mon rio.Monitor) (api.WareID, error) {
+		mon.Chan <- rio.Event_Progress{Time: time.Now(), Phase: "pack", TotalProg: 5, TotalWork: 10}
+		mon.Chan <- rio.Event_Progress{Time: time.Now(), Phase: "pack", TotalProg: 10, TotalWork: 10}
+		return api.WareID{"tar", "abc"}, nil
+	}
+	ch := make(chan repeatr.Event, 10)
+	wrapped := ForwardRioPackLogs(context.Background(), repeatr.Monitor{Chan: ch}, fs.MustAbsolutePath("/ws/job/chroot"), packTool)
+	wareID, err := wrapped(context.Background(), "tar", "/ws/job/chroot/out", api.FilesetPackFilter{}, "", rio.Monitor{})
+	AssertNoError(t, err)
+	WantEqual(t, wareID, api.WareID{"tar", "abc"})
+	close(ch)
+	var evts []executor.Event_Progress
+	for evt := range ch {
+		evts = append(evts, evt.(executor.Event_Progress))
+	}
+	AssertEqual(t, len(evts), 2)
+	WantEqual(t, evts[0].Msg, "pack /out")
+	WantEqual(t, evts[0].Path, api.AbsPath("/out"))
+	WantEqual(t, evts[0].Done(), false)
+	WantEqual(t, evts[1].Done(), true)
+}
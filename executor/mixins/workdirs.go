@@ -1,10 +1,21 @@
 package mixins
 
 import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	. "github.com/warpfork/go-errcat"
+	"golang.org/x/sys/unix"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
@@ -12,6 +23,9 @@ import (
 
 // Make work dirs.
 //  Including whole workspace dir and parents, if necessary.
+//  The job dir records our pid, so PruneWorkDirs can tell it's in use;
+//  it's made under a temporary name and renamed into place, so it's
+//  never seen without that record.
 //
 // The runrecord need only have gotten past `mixins.InitRunRecord` so far
 // (we use it for its guid).
@@ -24,13 +38,185 @@ func MakeWorkDirs(workspaceFs fs.FS, rr api.FormulaRunRecord) (
 	if err := fsOp.MkdirAll(osfs.New(fs.AbsolutePath{}), wsPath.CoerceRelative(), 0700); err != nil {
 		return nil, nil, Errorf(repeatr.ErrLocalCacheProblem, "cannot initialize workspace dirs: %s", err)
 	}
-	jobPath := fs.MustRelPath(rr.Guid)
-	chrootPath := jobPath.Join(fs.MustRelPath("chroot"))
-	if err := workspaceFs.Mkdir(jobPath, 0700); err != nil {
+	tmpPath, err := ioutil.TempDir(wsPath.String(), "."+rr.Guid+".")
+	if err != nil {
+		return nil, nil, Recategorize(repeatr.ErrLocalCacheProblem, err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpPath)
+		}
+	}()
+	ownerPath := filepath.Join(tmpPath, workDirOwnerFilename)
+	if err := ioutil.WriteFile(ownerPath, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		return nil, nil, Recategorize(repeatr.ErrLocalCacheProblem, err)
+	}
+	if err := os.Mkdir(filepath.Join(tmpPath, "chroot"), 0755); err != nil {
 		return nil, nil, Recategorize(repeatr.ErrLocalCacheProblem, err)
 	}
-	if err := workspaceFs.Mkdir(chrootPath, 0755); err != nil {
+	jobPath := wsPath.Join(fs.MustRelPath(rr.Guid))
+	if err := os.Rename(tmpPath, jobPath.String()); err != nil {
 		return nil, nil, Recategorize(repeatr.ErrLocalCacheProblem, err)
 	}
-	return osfs.New(wsPath.Join(jobPath)), osfs.New(wsPath.Join(chrootPath)), nil
+	return osfs.New(jobPath), osfs.New(jobPath.Join(fs.MustRelPath("chroot"))), nil
+}
+
+// The name of the file in a job's work dir with the pid of the repeatr
+//  process using it.
+const workDirOwnerFilename = "owner"
+
+/*
+	Remove a job's work dir once the job's done with it, or keep it,
+	according to the config; a kept one is reported to the monitor.
+
+	It's never removed if the input mounts in it couldn't be detached:
+	that would reach into them.
+*/
+func finishWorkDir(jobFs fs.FS, keep executor.KeepWorkspace, failed bool, detached bool, mon repeatr.Monitor) {
+	pth := jobFs.BasePath().String()
+	switch {
+	case keep == executor.KeepWorkspace_Always, keep == executor.KeepWorkspace_OnFailure && failed:
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogInfo,
+			Msg:   "job workspace kept at " + pth,
+			Detail: [][2]string{
+				{"path", pth},
+			},
+		})
+	case !detached:
+		mon.Send(repeatr.Event_Log{
+			Time:  time.Now(),
+			Level: repeatr.LogWarn,
+			Msg:   "job workspace left at " + pth + ": its input mounts could not be detached",
+			Detail: [][2]string{
+				{"path", pth},
+			},
+		})
+	default:
+		if err := os.RemoveAll(pth); err != nil {
+			mon.Send(repeatr.Event_Log{
+				Time:  time.Now(),
+				Level: repeatr.LogWarn,
+				Msg:   "error removing job workspace: " + err.Error(),
+				Detail: [][2]string{
+					{"path", pth},
+					{"error", err.Error()},
+				},
+			})
+		}
+	}
+}
+
+/*
+	Remove the job dirs in an executor's workspace dir which no live repeatr
+	process is using: those kept on purpose (see executor.KeepWorkspace), and
+	those left behind by runs which crashed.  Dirs modified more recently
+	than `olderThan` ago are spared.
+
+	Anything still mounted in a dir (as can happen after a crash) is
+	detached first; if that fails, the dir is left alone, and it's an error.
+
+	Returns the paths of the dirs removed.
+*/
+func PruneWorkDirs(workspaceDir fs.AbsolutePath, olderThan time.Duration) (pruned []string, err error) {
+	defer RequireErrorHasCategory(&err, repeatr.ErrorCategory(""))
+	dirs, err := ioutil.ReadDir(workspaceDir.String())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "cannot list workspace: %s", err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || time.Since(dir.ModTime()) < olderThan {
+			continue
+		}
+		pth := filepath.Join(workspaceDir.String(), dir.Name())
+		if workDirInUse(pth) {
+			continue
+		}
+		if err := detachMountsUnder(pth); err != nil {
+			return pruned, Errorf(repeatr.ErrLocalCacheProblem, "cannot prune %s: %s", pth, err)
+		}
+		if err := os.RemoveAll(pth); err != nil {
+			return pruned, Errorf(repeatr.ErrLocalCacheProblem, "cannot prune %s: %s", pth, err)
+		}
+		pruned = append(pruned, pth)
+	}
+	return pruned, nil
+}
+
+// A work dir is in use if the process which made it is alive.  (One with
+//  no owner file is from before we kept one.  Dirs still being made have
+//  one already: see MakeWorkDirs.)
+func workDirInUse(pth string) bool {
+	bs, err := ioutil.ReadFile(filepath.Join(pth, workDirOwnerFilename))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	return err == nil && pidAlive(pid)
+}
+
+// Unmount everything mounted at or under a path, deepest first.
+//  Mounts are detached lazily, so something still using one can't stop us.
+func detachMountsUnder(pth string) error {
+	mounts, err := mountsUnder(pth)
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(mounts))) // Children sort after their parents.
+	for _, mnt := range mounts {
+		if err := unix.Unmount(mnt, unix.MNT_DETACH); err != nil {
+			return Errorf(repeatr.ErrLocalCacheProblem, "cannot detach mount %s: %s", mnt, err)
+		}
+	}
+	return nil
+}
+
+// The mount points at or under a path, from /proc/self/mountinfo.
+func mountsUnder(pth string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "cannot list mounts: %s", err)
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The fifth field is the mount point (with spaces and such
+		//  escaped in octal).
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mnt := unescapeMountinfo(fields[4])
+		if mnt == pth || strings.HasPrefix(mnt, pth+"/") {
+			mounts = append(mounts, mnt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Errorf(repeatr.ErrLocalCacheProblem, "cannot list mounts: %s", err)
+	}
+	return mounts, nil
+}
+
+// Undo the octal escapes ("\040" for a space, etc) in a mountinfo field.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
 }
@@ -0,0 +1,93 @@
+package mixins
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+)
+
+func TestFinishWorkDir(t *testing.T) {
+	for _, tr := range []struct {
+		keep     executor.KeepWorkspace
+		failed   bool
+		detached bool
+		kept     bool
+	}{
+		{executor.KeepWorkspace_Never, true, true, false},
+		{executor.KeepWorkspace_OnFailure, false, true, false},
+		{executor.KeepWorkspace_OnFailure, true, true, true},
+		{executor.KeepWorkspace_Always, false, true, true},
+		{executor.KeepWorkspace_Never, false, false, true}, // Never remove what's still mounted!
+		{"", false, true, false},
+	} {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			jobDir := tmpDir.String() + "/job"
+			AssertNoError(t, os.MkdirAll(jobDir+"/chroot", 0755))
+			ch := make(chan repeatr.Event, 1)
+			finishWorkDir(osfs.New(tmpDir.Join(fs.MustRelPath("job"))), tr.keep, tr.failed, tr.detached, repeatr.Monitor{ch})
+			_, err := os.Stat(jobDir)
+			WantEqual(t, err == nil, tr.kept)
+			WantEqual(t, len(ch), map[bool]int{true: 1, false: 0}[tr.kept]) // Kept ones are reported.
+		})
+	}
+}
+
+func TestPruneWorkDirs(t *testing.T) {
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		for _, x := range []struct {
+			name  string
+			owner int // Zero for no owner file.
+		}{
+			{"live", os.Getpid()},
+			{"crashed", 999999999},
+			{"orphan", 0},
+		} {
+			pth := tmpDir.String() + "/" + x.name
+			AssertNoError(t, os.MkdirAll(pth+"/chroot/etc", 0755))
+			if x.owner != 0 {
+				AssertNoError(t, ioutil.WriteFile(pth+"/"+workDirOwnerFilename, []byte(strconv.Itoa(x.owner)), 0600))
+			}
+		}
+
+		pruned, err := PruneWorkDirs(tmpDir, time.Hour)
+		AssertNoError(t, err)
+		WantEqual(t, len(pruned), 0)
+
+		pruned, err = PruneWorkDirs(tmpDir, 0)
+		AssertNoError(t, err)
+		WantEqual(t, pruned, []string{tmpDir.String() + "/crashed", tmpDir.String() + "/orphan"})
+		_, err = os.Stat(tmpDir.String() + "/live")
+		AssertNoError(t, err)
+
+		// A fresh one is only ever seen with its owner file.
+		jobFs, chrootFs, err := MakeWorkDirs(osfs.New(tmpDir), api.FormulaRunRecord{Guid: "fresh"})
+		AssertNoError(t, err)
+		WantEqual(t, jobFs.BasePath().String(), tmpDir.String()+"/fresh")
+		WantEqual(t, chrootFs.BasePath().String(), tmpDir.String()+"/fresh/chroot")
+		pruned, err = PruneWorkDirs(tmpDir, 0)
+		AssertNoError(t, err)
+		WantEqual(t, len(pruned), 0)
+		names, err := ioutil.ReadDir(tmpDir.String())
+		AssertNoError(t, err)
+		WantEqual(t, len(names), 2) // "live" and "fresh": nothing left under a temporary name.
+
+		pruned, err = PruneWorkDirs(tmpDir.Join(fs.MustRelPath("nope")), 0)
+		AssertNoError(t, err)
+		WantEqual(t, len(pruned), 0)
+	})
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	WantEqual(t, unescapeMountinfo(`/plain/path`), "/plain/path")
+	WantEqual(t, unescapeMountinfo(`/with\040space\011tab`), "/with space\ttab")
+	WantEqual(t, unescapeMountinfo(`/trailing\04`), `/trailing\04`)
+}
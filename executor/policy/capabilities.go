@@ -7,7 +7,9 @@ import (
 	. "github.com/warpfork/go-errcat"
 
 	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/repeatr"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/repeatr/executor"
 )
 
 func GetCapsForPolicy(policy api.FormulaPolicy) ([]capability.Cap, error) {
@@ -80,6 +82,37 @@ func GetCapsForPolicy(policy api.FormulaPolicy) ([]capability.Cap, error) {
 	}
 }
 
+// Checks the policy can be honored by a rootless executor.
+// Capabilities in a user namespace only grant power over that namespace;
+// the policies which are meant to grant real power over the host can't work.
+func CheckRootless(policy api.FormulaPolicy) error {
+	switch policy {
+	case "", api.FormulaPolicy_Routine, api.FormulaPolicy_Governor:
+		return nil
+	default:
+		return Errorf(repeatr.ErrUsage, "policy %q cannot be honored in rootless mode (run as root to use it)", policy)
+	}
+}
+
+// Checks the network mode is valid, and allowed by the policy.
+// Only policies which already trust the job with the host may share
+// the host's network.
+func CheckNetwork(mode executor.NetworkMode, policy api.FormulaPolicy) error {
+	switch mode {
+	case "", executor.Network_None, executor.Network_Loopback:
+		return nil
+	case executor.Network_Host:
+		switch policy {
+		case api.FormulaPolicy_Governor, api.FormulaPolicy_Sysad:
+			return nil
+		default:
+			return Errorf(repeatr.ErrUsage, "network mode %q requires the governor or sysad policy", mode)
+		}
+	default:
+		return Errorf(repeatr.ErrUsage, "invalid network mode %q (must be one of none, loopback, host)", mode)
+	}
+}
+
 // Returns the capabilties as strings as documented in man 7 capabilities
 // (capslock, CAP_*, etc) (also, as runc understands them).
 func CapsToStrings(caps []capability.Cap) []string {
@@ -0,0 +1,161 @@
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+)
+
+/*
+	IdMappings describes how uids and gids inside a user namespace map to
+	the host, in the same form as /proc/[pid]/uid_map (and runc's config).
+*/
+type IdMappings struct {
+	Uids []IdMapping
+	Gids []IdMapping
+}
+
+type IdMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// A range of subordinate ids, as listed in /etc/subuid or /etc/subgid.
+type SubidRange struct {
+	Start uint32
+	Count uint32
+}
+
+// How many ids we map into a rootless job's namespace (besides the job's own).
+//  This covers all the ids conventionally found in a distro's files.
+const rootlessIdRange = 65536
+
+/*
+	Compute the id mappings for a rootless job which runs as the given
+	uid and gid.
+
+	The job's own uid and gid map to ours, so that it owns everything we
+	unpacked for it.  All other ids in the low range map onto our subordinate
+	ids, so the job can still chown files to other users, run setuid programs,
+	etc.  We need at least 65535 subordinate uids and gids to do this;
+	if there aren't enough, we refuse rather than give a job a weirdly
+	partial id space.
+*/
+func RootlessIdMappings(uid, gid int) (IdMappings, error) {
+	u, err := user.Current()
+	if err != nil {
+		return IdMappings{}, Errorf(repeatr.ErrExecutor, "rootless mode: cannot determine current user: %s", err)
+	}
+	subuids, err := LoadSubids("/etc/subuid", u.Username, u.Uid)
+	if err != nil {
+		return IdMappings{}, err
+	}
+	subgids, err := LoadSubids("/etc/subgid", u.Username, u.Uid)
+	if err != nil {
+		return IdMappings{}, err
+	}
+	var mappings IdMappings
+	mappings.Uids, err = mapIds(uint32(uid), uint32(os.Getuid()), subuids)
+	if err != nil {
+		return IdMappings{}, Errorf(repeatr.ErrExecutor, "rootless mode: not enough subordinate uids for user %q in /etc/subuid: %s", u.Username, err)
+	}
+	mappings.Gids, err = mapIds(uint32(gid), uint32(os.Getgid()), subgids)
+	if err != nil {
+		return IdMappings{}, Errorf(repeatr.ErrExecutor, "rootless mode: not enough subordinate gids for user %q in /etc/subgid: %s", u.Username, err)
+	}
+	return mappings, nil
+}
+
+/*
+	Parse a subuid(5) or subgid(5) file, returning all the ranges granted
+	to the user, who may be listed by either name or uid.
+*/
+func LoadSubids(path string, username string, uid string) ([]SubidRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Errorf(repeatr.ErrExecutor, "rootless mode needs subordinate ids: %s", err)
+	}
+	defer f.Close()
+	var ranges []SubidRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || (fields[0] != username && fields[0] != uid) {
+			continue
+		}
+		start, err1 := strconv.ParseUint(fields[1], 10, 32)
+		count, err2 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 != nil || err2 != nil {
+			return nil, Errorf(repeatr.ErrExecutor, "rootless mode: malformed line in %s: %q", path, line)
+		}
+		ranges = append(ranges, SubidRange{uint32(start), uint32(count)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Errorf(repeatr.ErrExecutor, "rootless mode: error reading %s: %s", path, err)
+	}
+	if len(ranges) == 0 {
+		return nil, Errorf(repeatr.ErrExecutor, "rootless mode needs subordinate ids: no entry for user %q in %s", username, path)
+	}
+	return ranges, nil
+}
+
+// Map id to hostID, and the rest of [0,rootlessIdRange) to the subid ranges.
+func mapIds(id uint32, hostID uint32, subids []SubidRange) ([]IdMapping, error) {
+	mappings := []IdMapping{{id, hostID, 1}}
+
+	// The container ranges we need to fill: everything in the low range
+	//  except the job's own id.
+	type span struct{ start, end uint32 }
+	var want []span
+	if id < rootlessIdRange {
+		if id > 0 {
+			want = append(want, span{0, id})
+		}
+		if id+1 < rootlessIdRange {
+			want = append(want, span{id + 1, rootlessIdRange})
+		}
+	} else {
+		want = append(want, span{0, rootlessIdRange})
+	}
+
+	// Hand out subids, in order, splitting across ranges as necessary.
+	var need, have uint64
+	for _, w := range want {
+		need += uint64(w.end - w.start)
+	}
+	for _, r := range subids {
+		have += uint64(r.Count)
+	}
+	if have < need {
+		return nil, fmt.Errorf("have %d, need %d", have, need)
+	}
+	subids = append([]SubidRange{}, subids...)
+	for _, w := range want {
+		for w.start < w.end {
+			n := w.end - w.start
+			if subids[0].Count < n {
+				n = subids[0].Count
+			}
+			mappings = append(mappings, IdMapping{w.start, subids[0].Start, n})
+			w.start += n
+			subids[0].Start += n
+			subids[0].Count -= n
+			if subids[0].Count == 0 {
+				subids = subids[1:]
+			}
+		}
+	}
+	return mappings, nil
+}
@@ -0,0 +1,76 @@
+package executor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "github.com/warpfork/go-errcat"
+
+	"go.polydawn.net/go-timeless-api/repeatr"
+	. "go.polydawn.net/repeatr/testutil"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestLoadSubids(t *testing.T) {
+	WithTmpdir(func(tmpDir fs.AbsolutePath) {
+		pth := filepath.Join(tmpDir.String(), "subuid")
+		AssertNoError(t, ioutil.WriteFile(pth, []byte(
+			"# comment\n"+
+				"alice:100000:65536\n"+
+				"bob:165536:65536\n"+
+				"1000:231072:10\n",
+		), 0644))
+
+		ranges, err := LoadSubids(pth, "alice", "1000")
+		WantNoError(t, err)
+		WantEqual(t, ranges, []SubidRange{{100000, 65536}, {231072, 10}})
+
+		_, err = LoadSubids(pth, "carol", "1002")
+		WantEqual(t, Category(err), repeatr.ErrExecutor)
+	})
+}
+
+func TestMapIds(t *testing.T) {
+	t.Run("job id in the middle of the range", func(t *testing.T) {
+		mappings, err := mapIds(1000, 501, []SubidRange{{100000, 65536}})
+		WantNoError(t, err)
+		WantEqual(t, mappings, []IdMapping{
+			{1000, 501, 1},
+			{0, 100000, 1000},
+			{1001, 101000, 64535},
+		})
+	})
+	t.Run("job id zero", func(t *testing.T) {
+		mappings, err := mapIds(0, 501, []SubidRange{{100000, 65536}})
+		WantNoError(t, err)
+		WantEqual(t, mappings, []IdMapping{
+			{0, 501, 1},
+			{1, 100000, 65535},
+		})
+	})
+	t.Run("job id above the range", func(t *testing.T) {
+		mappings, err := mapIds(100000, 501, []SubidRange{{100000, 65536}})
+		WantNoError(t, err)
+		WantEqual(t, mappings, []IdMapping{
+			{100000, 501, 1},
+			{0, 100000, 65536},
+		})
+	})
+	t.Run("subids split across ranges", func(t *testing.T) {
+		mappings, err := mapIds(1000, 501, []SubidRange{{100000, 500}, {200000, 70000}})
+		WantNoError(t, err)
+		WantEqual(t, mappings, []IdMapping{
+			{1000, 501, 1},
+			{0, 100000, 500},
+			{500, 200000, 500},
+			{1001, 200500, 64535},
+		})
+	})
+	t.Run("not enough subids", func(t *testing.T) {
+		_, err := mapIds(1000, 501, []SubidRange{{100000, 65534}})
+		if err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
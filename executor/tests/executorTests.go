@@ -1,12 +1,15 @@
 package tests
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/warpfork/go-errcat"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
 	. "go.polydawn.net/repeatr/testutil"
 )
 
@@ -158,3 +161,145 @@ func CheckRootyUserinfo(t *testing.T, runTool repeatr.RunFunc) {
 		WantEqual(t, txt, "0\nroot\n/root\n")
 	})
 }
+
+func CheckRootlessRefusesSysad(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("sysad policy should be refused in rootless mode", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action.Policy = api.FormulaPolicy_Sysad
+		_, _, err := run(t, runTool, frm, frmCtx)
+		WantEqual(t, errcat.Category(err), repeatr.ErrUsage)
+	})
+}
+
+func CheckRootlessRefusesKeptOwnership(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("outputs keeping ownership should be refused in rootless mode", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Outputs = map[api.AbsPath]api.FormulaOutputSpec{
+			"/": {PackType: "tar", Filter: api.FilesetPackFilter_Lossless},
+		}
+		_, _, err := run(t, runTool, frm, frmCtx)
+		WantEqual(t, errcat.Category(err), repeatr.ErrUsage)
+	})
+}
+
+func CheckNetworkNone(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("the default network mode should not reach the host network", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			// List interfaces other than loopback (there should be none),
+			//  then try to connect out (which should fail without delay:
+			//  there's no route).  Not every executor mounts /proc.
+			Exec: []string{"/bin/bash", "-c", `
+				if [ -r /proc/net/dev ] ; then
+					{ read ; read ; while read -r iface rest ; do
+						[ "$iface" != "lo:" ] && echo "$iface"
+					done ; } < /proc/net/dev
+				fi
+				( exec 3<>/dev/tcp/1.1.1.1/53 ) 2>/dev/null && echo reachable || echo unreachable
+			`},
+		}
+		rr, txt := shouldRun(t, runTool, frm, frmCtx)
+		WantEqual(t, rr.ExitCode, 0)
+		WantEqual(t, txt, "unreachable\n")
+	})
+}
+
+func CheckEtcFiles(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("cradle should make the user known in /etc/passwd", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			// Only bash builtins: look ourselves up by uid.
+			Exec: []string{"/bin/bash", "-c", `
+				while IFS=: read -r name x uid gid gecos home shell ; do
+					[ "$uid" = "$UID" ] && echo "$name $gid $home"
+				done < /etc/passwd
+			`},
+		}
+		rr, txt := shouldRun(t, runTool, frm, frmCtx)
+		WantEqual(t, rr.ExitCode, 0)
+		WantEqual(t, txt, "reuser 1000 /home/reuser\n")
+	})
+}
+
+// The job options CheckGroupsAndUmask expects the executor to be
+//  configured with.
+var GroupsAndUmaskOptions = executor.JobOptions{
+	Groups: []int{29, 44},
+	Umask:  "027",
+}
+
+func CheckGroupsAndUmask(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("supplementary groups and umask should be applied", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			Exec: []string{"/bin/bash", "-c", `echo "$UID ${GROUPS[*]}" ; umask`},
+		}
+		rr, txt := shouldRun(t, runTool, frm, frmCtx)
+		WantEqual(t, rr.ExitCode, 0)
+		WantEqual(t, txt, "1000 1000 29 44\n0027\n")
+	})
+}
+
+// For executors which can't set a umask: the groups half of CheckGroupsAndUmask.
+func CheckGroups(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("supplementary groups should be applied", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			Exec: []string{"/bin/bash", "-c", `echo "$UID ${GROUPS[*]}"`},
+		}
+		rr, txt := shouldRun(t, runTool, frm, frmCtx)
+		WantEqual(t, rr.ExitCode, 0)
+		WantEqual(t, txt, "1000 1000 29 44\n")
+	})
+}
+
+func CheckDeterministicMode(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("deterministic mode should pin SOURCE_DATE_EPOCH and hostname", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			Exec: []string{"/bin/bash", "-c", `echo "$SOURCE_DATE_EPOCH" ; cat /proc/sys/kernel/hostname`},
+		}
+		rr1, txt1 := shouldRun(t, runTool, frm, frmCtx)
+		WantEqual(t, rr1.ExitCode, 0)
+		rr2, txt2 := shouldRun(t, runTool, frm, frmCtx)
+		WantEqual(t, rr2.ExitCode, 0)
+		WantEqual(t, strings.SplitN(txt1, "\n", 2)[0], strconv.FormatInt(api.DefaultTime, 10))
+		WantEqual(t, txt1, txt2)
+	})
+}
+
+func CheckOutputStreams(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("stdout and stderr should be reported separately", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			Exec: []string{"/bin/bash", "-c", `echo out ; echo err >&2 ; echo more out`},
+		}
+		rr, bm, err := runBuffered(t, runTool, frm, frmCtx)
+		AssertNoError(t, err)
+		WantEqual(t, rr.ExitCode, 0)
+		WantEqual(t, bm.Stdout.String(), "out\nmore out\n")
+		WantEqual(t, bm.Stderr.String(), "err\n")
+	})
+}
+
+func CheckInteractive(t *testing.T, runTool repeatr.RunFunc) {
+	t.Run("interactive jobs should get a terminal, fed from the input channel", func(t *testing.T) {
+		frm, frmCtx := baseFormula.Clone(), baseFormulaCtx
+		frm.Action = api.FormulaAction{
+			Exec: []string{"/bin/bash", "-c", `test -t 0 || exit 9 ; read x ; echo "got:$x" ; cat`},
+		}
+		inputChan := make(chan string, 2)
+		inputChan <- "hello\n"
+		inputChan <- "bye\n"
+		close(inputChan) // Should be an EOF, which ends the cat.
+		rr, bm, err := runWithInput(t, runTool, frm, frmCtx, repeatr.InputControl{Chan: inputChan})
+		AssertNoError(t, err)
+		WantEqual(t, rr.ExitCode, 0)
+		// It's all on the terminal: echoed input and output, with its
+		//  newlines translated, and all of it as stdout.
+		WantEqual(t, strings.Contains(bm.Stdout.String(), "hello\r\n"), true)
+		WantEqual(t, strings.Contains(bm.Stdout.String(), "got:hello\r\n"), true)
+		WantEqual(t, strings.Count(bm.Stdout.String(), "bye\r\n"), 2) // Echo, then cat.
+		WantEqual(t, bm.Stderr.String(), "")
+	})
+}
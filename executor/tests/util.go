@@ -3,12 +3,12 @@ package tests
 import (
 	"bytes"
 	"context"
-	"io"
 	"sync"
 	"testing"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/repeatr"
+	"go.polydawn.net/repeatr/executor"
 	. "go.polydawn.net/repeatr/testutil"
 )
 
@@ -18,18 +18,27 @@ func shouldRun(t *testing.T, runTool repeatr.RunFunc, frm api.Formula, frmCtx re
 	return *rr, txt
 }
 func run(t *testing.T, runTool repeatr.RunFunc, frm api.Formula, frmCtx repeatr.FormulaContext) (*api.FormulaRunRecord, string, error) {
-	bm := bufferingMonitor{}
-	rr, err := runTool(context.Background(), frm, baseFormulaCtx, repeatr.InputControl{}, bm.monitor())
+	rr, bm, err := runBuffered(t, runTool, frm, frmCtx)
+	return rr, bm.Txt.String(), err
+}
+func runBuffered(t *testing.T, runTool repeatr.RunFunc, frm api.Formula, frmCtx repeatr.FormulaContext) (*api.FormulaRunRecord, *bufferingMonitor, error) {
+	return runWithInput(t, runTool, frm, frmCtx, repeatr.InputControl{})
+}
+func runWithInput(t *testing.T, runTool repeatr.RunFunc, frm api.Formula, frmCtx repeatr.FormulaContext, input repeatr.InputControl) (*api.FormulaRunRecord, *bufferingMonitor, error) {
+	bm := &bufferingMonitor{}
+	rr, err := runTool(context.Background(), frm, baseFormulaCtx, input, bm.monitor())
 	close(bm.Ch)
 	bm.await()
-	return rr, bm.Txt.String(), err
+	return rr, bm, err
 }
 
 type bufferingMonitor struct {
-	Ch  chan repeatr.Event
-	Wg  sync.WaitGroup
-	Txt bytes.Buffer
-	Err error
+	Ch     chan repeatr.Event
+	Wg     sync.WaitGroup
+	Txt    bytes.Buffer // All output, as it arrived.
+	Stdout bytes.Buffer // Just the output tagged as stdout.
+	Stderr bytes.Buffer // Just the output tagged as stderr.
+	Err    error
 }
 
 func (bm *bufferingMonitor) monitor() repeatr.Monitor {
@@ -40,7 +49,7 @@ func (bm *bufferingMonitor) monitor() repeatr.Monitor {
 	go func() {
 		defer bm.Wg.Done()
 		for msg := range bm.Ch {
-			bm.Err = dictateOutput(msg, &bm.Txt)
+			bm.Err = bm.dictateOutput(msg)
 		}
 	}()
 	return repeatr.Monitor{Chan: bm.Ch}
@@ -51,11 +60,20 @@ func (bm *bufferingMonitor) await() error {
 	return bm.Err
 }
 
-func dictateOutput(evt repeatr.Event, into io.Writer) error {
-	switch evt2 := evt.(type) {
-	case repeatr.Event_Output:
-		_, err := into.Write([]byte(evt2.Msg))
+func (bm *bufferingMonitor) dictateOutput(evt repeatr.Event) error {
+	stream, evt2, ok := executor.OutputEvent(evt)
+	if !ok {
+		return nil
+	}
+	if _, err := bm.Txt.Write([]byte(evt2.Msg)); err != nil {
+		return err
+	}
+	switch stream {
+	case executor.Stream_Stderr:
+		_, err := bm.Stderr.Write([]byte(evt2.Msg))
+		return err
+	default:
+		_, err := bm.Stdout.Write([]byte(evt2.Msg))
 		return err
 	}
-	return nil
 }